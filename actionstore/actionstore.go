@@ -5,64 +5,143 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"sync"
+	"time"
+
+	"rptsec.com/amg/logging"
 )
 
 // ActionResult store the result of an Action execution
 type ActionResult struct {
-	ResultJSON     string            `json:"outputJson"`
-	ResultFieldMap map[string]string `json:"outputFields"`
-	ErrStr         string            `json:"error"`
+	ResultJSON     string            `json:"outputJson,omitempty"`
+	ResultFieldMap map[string]string `json:"outputFields,omitempty"`
+	ErrStr         string            `json:"error,omitempty"`
 }
 
-type inputArgsToResultMapping struct {
+// MockScenario maps a set of input args to the result returned for them.
+// An input value of "*" matches any value.
+type MockScenario struct {
 	Input map[string]string `json:"input"`
 	ActionResult
 }
 
-type actionMockScenario struct {
-	ActionUrn             string                     `json:"actionUrn"`
-	ExecutionDurationSecs int                        `json:"executionDuration"`
-	Scenarios             []inputArgsToResultMapping `json:"scenarios"`
+// ActionMockScenario holds all the mock scenarios for a single action.
+type ActionMockScenario struct {
+	Name                  string         `json:"name,omitempty"`
+	ActionUrn             string         `json:"actionUrn"`
+	ExecutionDurationSecs int            `json:"executionDuration,omitempty"`
+	Scenarios             []MockScenario `json:"scenarios"`
+}
+
+// ActionCall records a call made to ExecuteAction
+type ActionCall struct {
+	Urn    string            `json:"urn"`
+	Params map[string]string `json:"params,omitempty"`
+	// Matched is false when no mock scenario matched the params
+	Matched bool `json:"matched"`
 }
 
 // ActionStore represents an instance of ActionStore containing a bunch of actions
 type ActionStore struct {
-	mockScenarios map[string]actionMockScenario
+	mockScenarios map[string]ActionMockScenario
+	mu            sync.Mutex
+	calls         []ActionCall
+	// latencyPerSec is slept for every second of the executionDuration of
+	// an action
+	latencyPerSec time.Duration
+	logger        logging.Logger
 }
 
 // NewActionStore creates a new instance of ActionStore
 func NewActionStore(mockScenarioFile string) *ActionStore {
-	jsonFile, err := os.Open(mockScenarioFile)
+	s, err := LoadMockScenarios(mockScenarioFile)
 	if err != nil {
-		fmt.Println("Error in opening mock scenarios file")
+		logging.Error(logging.Default(), "error in creating ActionStore instance", logging.F("error", err))
 		return nil
 	}
-	defer jsonFile.Close()
+	return NewActionStoreFromScenarios(s)
+}
 
-	byteValue, err := ioutil.ReadAll(jsonFile)
+// NewActionStoreFromScenarios creates a new instance of ActionStore from mock
+// scenarios that are already loaded. When an actionUrn appears more than once,
+// its scenarios are tried in the order they appear in s.
+func NewActionStoreFromScenarios(s []ActionMockScenario) *ActionStore {
+	as := &ActionStore{mockScenarios: make(map[string]ActionMockScenario), logger: logging.Default()}
+	for i := 0; i < len(s); i++ {
+		urn := s[i].ActionUrn
+		existing, ok := as.mockScenarios[urn]
+		if !ok {
+			existing = s[i]
+			existing.Scenarios = nil
+		}
+		existing.Scenarios = append(existing.Scenarios, s[i].Scenarios...)
+		as.mockScenarios[urn] = existing
+	}
+	return as
+}
+
+// LoadMockScenarios reads the list of mock scenarios from a json file
+func LoadMockScenarios(mockScenarioFile string) ([]ActionMockScenario, error) {
+	byteValue, err := ioutil.ReadFile(mockScenarioFile)
 	if err != nil {
-		fmt.Println("Error in reading the mock scenario file")
-		return nil
+		return nil, fmt.Errorf("error in reading the mock scenario file: %s", err.Error())
 	}
+	return ParseMockScenarios(byteValue)
+}
 
-	var s []actionMockScenario
-	json.Unmarshal(byteValue, &s)
+// ParseMockScenarios parses the json representation of a list of mock scenarios
+func ParseMockScenarios(data []byte) ([]ActionMockScenario, error) {
+	var s []ActionMockScenario
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("error in parsing mock scenarios: %s", err.Error())
+	}
+	return s, nil
+}
 
-	//fmt.Printf("%+v", s)
+// SimulateLatency makes every call sleep for d per second of the
+// executionDuration of its action, so that slow actions take longer than fast
+// ones.
+func (as *ActionStore) SimulateLatency(d time.Duration) {
+	as.latencyPerSec = d
+}
 
-	as := &ActionStore{mockScenarios: make(map[string]actionMockScenario)}
-	for i := 0; i < len(s); i++ {
-		urn := s[i].ActionUrn
-		as.mockScenarios[urn] = s[i]
-	}
-	return as
+// SetLogger sets the logger of the calls that match no mock scenario, which
+// is logging.Default() when the store is created.
+func (as *ActionStore) SetLogger(l logging.Logger) {
+	as.logger = l
 }
 
 // ExecuteAction exectes an action. It compares inputParams with mock scenarios
 func (as *ActionStore) ExecuteAction(
 	urn string, inputParams map[string]string) (*ActionResult, error) {
-	fmt.Printf("Executing action with urn: %s\n", urn)
+	ar := as.findMockResult(urn, inputParams)
+	if d := as.latencyPerSec * time.Duration(as.mockScenarios[urn].ExecutionDurationSecs); d > 0 {
+		time.Sleep(d)
+	}
+
+	params := make(map[string]string, len(inputParams))
+	for k, v := range inputParams {
+		params[k] = v
+	}
+	as.mu.Lock()
+	as.calls = append(as.calls, ActionCall{Urn: urn, Params: params, Matched: ar != nil})
+	as.mu.Unlock()
+
+	if ar == nil {
+		logging.Debug(as.logger, "no mock scenario matched", logging.F("urn", urn), logging.F("params", params))
+		return nil, errors.New("No scenarios found in mock data")
+	}
+	return ar, nil
+}
+
+// Calls returns the calls made to ExecuteAction so far, in the order they were made.
+func (as *ActionStore) Calls() []ActionCall {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return append([]ActionCall(nil), as.calls...)
+}
+
+func (as *ActionStore) findMockResult(urn string, inputParams map[string]string) *ActionResult {
 	// Check if a mock scenario exist for the urn
 	if val, ok := as.mockScenarios[urn]; ok {
 		for i := 0; i < len(val.Scenarios); i++ {
@@ -77,10 +156,9 @@ func (as *ActionStore) ExecuteAction(
 			if matched {
 				// fmt.Print("Matched")
 				copyAr := scenario.ActionResult
-				return &copyAr, nil
+				return &copyAr
 			}
 		}
 	}
-
-	return nil, errors.New("No scenarios found in mock data")
+	return nil
 }
@@ -19,3 +19,45 @@ func TestBasic(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal(result.ResultFieldMap["reputationScore"], "50")
 }
+
+func TestScenariosForSameUrnAreMerged(t *testing.T) {
+	assert := assert.New(t)
+	urn := "www.vt.com/soar-services/v1/checkIpReputation"
+	as := NewActionStoreFromScenarios([]ActionMockScenario{{
+		ActionUrn: urn,
+		Scenarios: []MockScenario{{
+			Input:        map[string]string{"ipv4Addr": "10.0.0.1"},
+			ActionResult: ActionResult{ResultFieldMap: map[string]string{"reputationScore": "1"}},
+		}},
+	}, {
+		ActionUrn: urn,
+		Scenarios: []MockScenario{{
+			Input:        map[string]string{"ipv4Addr": "*"},
+			ActionResult: ActionResult{ResultFieldMap: map[string]string{"reputationScore": "2"}},
+		}},
+	}})
+
+	result, err := as.ExecuteAction(urn, map[string]string{"ipv4Addr": "10.0.0.1"})
+	assert.Nil(err)
+	assert.Equal("1", result.ResultFieldMap["reputationScore"])
+
+	result, err = as.ExecuteAction(urn, map[string]string{"ipv4Addr": "10.0.0.2"})
+	assert.Nil(err)
+	assert.Equal("2", result.ResultFieldMap["reputationScore"])
+}
+
+func TestCallsAreRecorded(t *testing.T) {
+	assert := assert.New(t)
+	as := NewActionStore("./action-input-output.json")
+	urn := "www.vt.com/soar-services/v1/checkIpReputation"
+
+	_, err := as.ExecuteAction(urn, map[string]string{"ipv4Addr": "192.168.0.1"})
+	assert.Nil(err)
+	_, err = as.ExecuteAction(urn, map[string]string{"ipv4Addr": "10.0.0.1"})
+	assert.NotNil(err)
+
+	assert.Equal([]ActionCall{
+		{Urn: urn, Params: map[string]string{"ipv4Addr": "192.168.0.1"}, Matched: true},
+		{Urn: urn, Params: map[string]string{"ipv4Addr": "10.0.0.1"}, Matched: false},
+	}, as.Calls())
+}
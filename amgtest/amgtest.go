@@ -0,0 +1,270 @@
+// Package amgtest helps Go tests run playbooks against mocked actions and
+// assert on the outcome.
+//
+//	pb := amgtest.PlaybookFromFile(t, "playbook.yaml").MocksFromFile("mocks.json")
+//	run := pb.Run(map[string]string{"srcIp": "192.168.0.1"})
+//	run.AssertBranch("if3", true)
+//	run.AssertResult("ac1", "reputationScore", "50")
+//	run.AssertMockCalled("www.vt.com/soar-services/v1/checkIpReputation",
+//		map[string]string{"ipv4Addr": "192.168.0.1"})
+package amgtest
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/execution"
+	"rptsec.com/amg/testsuite"
+)
+
+// Playbook is a playbook along with the mocks it is run against.
+type Playbook struct {
+	t     testing.TB
+	data  []byte
+	mocks []actionstore.ActionMockScenario
+}
+
+// PlaybookFromString parses a playbook given as yaml. The test fails
+// immediately when the playbook can not be parsed.
+func PlaybookFromString(t testing.TB, yamlData string) *Playbook {
+	t.Helper()
+	if _, err := execution.NewNodesFromYaml([]byte(yamlData)); err != nil {
+		t.Fatalf("amgtest: %s", err.Error())
+	}
+	return &Playbook{t: t, data: []byte(yamlData)}
+}
+
+// PlaybookFromFile reads and parses a playbook file.
+func PlaybookFromFile(t testing.TB, path string) *Playbook {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("amgtest: error reading playbook: %s", err.Error())
+	}
+	return PlaybookFromString(t, string(data))
+}
+
+// MocksFromString adds mock scenarios given as json, or the equivalent yaml.
+// Scenarios added earlier are tried first.
+func (p *Playbook) MocksFromString(data string) *Playbook {
+	p.t.Helper()
+	jsonData, err := yaml.YAMLToJSON([]byte(data))
+	if err != nil {
+		p.t.Fatalf("amgtest: error in parsing mock scenarios: %s", err.Error())
+	}
+	mocks, err := actionstore.ParseMockScenarios(jsonData)
+	if err != nil {
+		p.t.Fatalf("amgtest: %s", err.Error())
+	}
+	p.mocks = append(p.mocks, mocks...)
+	return p
+}
+
+// MocksFromFile adds the mock scenarios in a mock scenario file.
+func (p *Playbook) MocksFromFile(path string) *Playbook {
+	p.t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		p.t.Fatalf("amgtest: error reading mock scenarios: %s", err.Error())
+	}
+	return p.MocksFromString(string(data))
+}
+
+// Mock adds a single scenario: when the action urn is called with input, it
+// returns the given output fields. An input value of "*" matches any value.
+func (p *Playbook) Mock(urn string, input map[string]string, outputFields map[string]string) *Playbook {
+	p.mocks = append(p.mocks, actionstore.ActionMockScenario{
+		ActionUrn: urn,
+		Scenarios: []actionstore.MockScenario{{
+			Input:        input,
+			ActionResult: actionstore.ActionResult{ResultFieldMap: outputFields},
+		}},
+	})
+	return p
+}
+
+// Run executes the playbook with the given alert data. If the test has failed
+// by the time it finishes, the annotated result of the run is logged.
+func (p *Playbook) Run(alert map[string]string) *Run {
+	p.t.Helper()
+	return p.RunAlert(execution.AlertFromStrings(alert))
+}
+
+// RunAlert is Run for an alert payload with nested objects and arrays, as
+// decoded by execution.ParseAlert.
+func (p *Playbook) RunAlert(alert map[string]interface{}) *Run {
+	p.t.Helper()
+	r := testsuite.Execute(p.data, alert, p.mocks)
+	if r.Err != nil {
+		p.t.Fatalf("amgtest: %s", r.Err.Error())
+	}
+	run := &Run{t: p.t, result: r, nodes: testsuite.IndexNodes(r.Nodes)}
+	p.t.Cleanup(func() {
+		if !p.t.Failed() {
+			return
+		}
+		if snapshot, err := testsuite.Snapshot(r.Nodes); err == nil {
+			p.t.Logf("amgtest: result of the playbook run:\n%s", snapshot)
+		}
+	})
+	return run
+}
+
+// Run is the outcome of a single run of a playbook.
+type Run struct {
+	t      testing.TB
+	result *testsuite.CaseResult
+	nodes  map[string]*execution.N
+}
+
+// Nodes returns the playbook annotated with the result of the run.
+func (r *Run) Nodes() []execution.N {
+	return r.result.Nodes
+}
+
+// Err returns the error that stopped the execution, if any.
+func (r *Run) Err() error {
+	return r.result.ExecErr
+}
+
+// MockCalls returns the calls made to the mocked actions, in order.
+func (r *Run) MockCalls() []actionstore.ActionCall {
+	return r.result.MockCalls
+}
+
+func (r *Run) node(id string) *execution.N {
+	r.t.Helper()
+	n, ok := r.nodes[id]
+	if !ok {
+		r.t.Errorf("amgtest: no node with id %q in the playbook", id)
+	}
+	return n
+}
+
+// AssertNodeState checks the state of a node, eg. execution.StateDone.
+func (r *Run) AssertNodeState(id string, state string) bool {
+	r.t.Helper()
+	n := r.node(id)
+	if n == nil {
+		return false
+	}
+	if n.State != state {
+		r.t.Errorf("node %s: expected state %q, got %q", id, state, n.State)
+		return false
+	}
+	return true
+}
+
+// AssertBranch checks the value that the condition of an if node evaluated to.
+func (r *Run) AssertBranch(id string, evaluatedTo bool) bool {
+	r.t.Helper()
+	n := r.node(id)
+	if n == nil {
+		return false
+	}
+	if n.State != execution.StateDone {
+		r.t.Errorf("if node %s: expected to be evaluated, state is %q", id, n.State)
+		return false
+	}
+	if n.ConditionEvaluatedTo != evaluatedTo {
+		r.t.Errorf("if node %s: expected condition to be %v, got %v", id, evaluatedTo, n.ConditionEvaluatedTo)
+		return false
+	}
+	return true
+}
+
+// AssertResult checks a result field of an action node.
+func (r *Run) AssertResult(id string, field string, value string) bool {
+	r.t.Helper()
+	n := r.node(id)
+	if n == nil {
+		return false
+	}
+	actual, ok := n.ResultFields[field]
+	if !ok {
+		r.t.Errorf("node %s: no result field %q, fields are %v", id, field, n.ResultFields)
+		return false
+	}
+	if actual != value {
+		r.t.Errorf("node %s: expected %s to be %q, got %q", id, field, value, actual)
+		return false
+	}
+	return true
+}
+
+// AssertExport checks the value of an exported var.
+func (r *Run) AssertExport(name string, value string) bool {
+	r.t.Helper()
+	actual, ok := r.result.Exports[name]
+	if !ok {
+		r.t.Errorf("export %s: not exported, exports are %v", name, r.result.Exports)
+		return false
+	}
+	if actual != value {
+		r.t.Errorf("export %s: expected %q, got %q", name, value, actual)
+		return false
+	}
+	return true
+}
+
+// AssertNoError checks that the execution finished without an error.
+func (r *Run) AssertNoError() bool {
+	r.t.Helper()
+	if r.result.ExecErr != nil {
+		r.t.Errorf("expected execution to succeed, got error: %s", r.result.ExecErr.Error())
+		return false
+	}
+	return true
+}
+
+// AssertError checks that the execution stopped with an error containing substr.
+func (r *Run) AssertError(substr string) bool {
+	r.t.Helper()
+	if r.result.ExecErr == nil {
+		r.t.Errorf("expected execution to fail with %q, it succeeded", substr)
+		return false
+	}
+	if !strings.Contains(r.result.ExecErr.Error(), substr) {
+		r.t.Errorf("expected execution error to contain %q, got %q", substr, r.result.ExecErr.Error())
+		return false
+	}
+	return true
+}
+
+// AssertMockCalled checks that the action urn was called with exactly params.
+func (r *Run) AssertMockCalled(urn string, params map[string]string) bool {
+	r.t.Helper()
+	var paramsUsed []map[string]string
+	for _, c := range r.result.MockCalls {
+		if c.Urn != urn {
+			continue
+		}
+		if reflect.DeepEqual(c.Params, params) {
+			return true
+		}
+		paramsUsed = append(paramsUsed, c.Params)
+	}
+	r.t.Errorf("expected %s to be called with %v, it was called with %v", urn, params, paramsUsed)
+	return false
+}
+
+// AssertMockCallCount checks the number of times the action urn was called.
+func (r *Run) AssertMockCallCount(urn string, count int) bool {
+	r.t.Helper()
+	actual := 0
+	for _, c := range r.result.MockCalls {
+		if c.Urn == urn {
+			actual++
+		}
+	}
+	if actual != count {
+		r.t.Errorf("expected %s to be called %d times, it was called %d times", urn, count, actual)
+		return false
+	}
+	return true
+}
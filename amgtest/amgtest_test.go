@@ -0,0 +1,101 @@
+package amgtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/execution"
+)
+
+const checkIPReputation = "www.vt.com/soar-services/v1/checkIpReputation"
+
+func TestSamplePlaybook(t *testing.T) {
+	pb := PlaybookFromFile(t, "../resources/sample-playbook.yaml").
+		MocksFromFile("../resources/sample-mock-scenario.json")
+
+	run := pb.Run(map[string]string{"srcIp": "192.168.0.1", "dstIp": "192.168.0.2"})
+	run.AssertNoError()
+	run.AssertNodeState("ac1", execution.StateDone)
+	run.AssertNodeState("ifNoAc1", execution.StateNotYetStarted)
+	run.AssertBranch("if3", true)
+	run.AssertResult("ifYesAc2", "reputationScore", "90")
+	run.AssertMockCalled(checkIPReputation, map[string]string{"ipv4Addr": "192.168.0.5"})
+	run.AssertMockCallCount(checkIPReputation, 3)
+}
+
+func TestInlinePlaybookAndMocks(t *testing.T) {
+	pb := PlaybookFromString(t, `
+- id: lookup
+  urn: urn:lookup
+  params:
+    ip: "@alert:srcIp"
+  exports:
+    score: reputationScore
+- id: check
+  type: if
+  condition: "$score > 80"
+  onTrue:
+    - id: block
+      urn: urn:block
+      params:
+        ip: "@alert:srcIp"
+`).MocksFromString(`
+- actionUrn: urn:block
+  scenarios:
+    - input: {ip: "*"}
+      outputFields: {blocked: "true"}
+`).Mock("urn:lookup", map[string]string{"ip": "10.0.0.1"}, map[string]string{"reputationScore": "95"})
+
+	run := pb.Run(map[string]string{"srcIp": "10.0.0.1"})
+	run.AssertExport("score", "95")
+	run.AssertBranch("check", true)
+	run.AssertResult("block", "blocked", "true")
+
+	run = pb.Run(map[string]string{"srcIp": "10.0.0.2"})
+	run.AssertError("lookup")
+	run.AssertNodeState("lookup", execution.StateFailed)
+	run.AssertMockCallCount("urn:block", 0)
+}
+
+// recorder captures the failures reported through testing.TB.
+type recorder struct {
+	testing.TB
+	errors   []string
+	cleanups []func()
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Failed() bool { return len(r.errors) > 0 }
+
+func (r *recorder) Logf(format string, args ...interface{}) {}
+
+func (r *recorder) Cleanup(f func()) { r.cleanups = append(r.cleanups, f) }
+
+func TestFailedAssertionsAreReported(t *testing.T) {
+	assert := assert.New(t)
+	rec := &recorder{TB: t}
+
+	pb := PlaybookFromFile(rec, "../resources/sample-playbook.yaml").
+		MocksFromFile("../resources/sample-mock-scenario.json")
+	run := pb.Run(map[string]string{"srcIp": "192.168.0.1", "dstIp": "192.168.0.2"})
+
+	assert.False(run.AssertBranch("if3", false))
+	assert.False(run.AssertResult("ac1", "reputationScore", "51"))
+	assert.False(run.AssertNodeState("missing", execution.StateDone))
+	assert.False(run.AssertMockCalled(checkIPReputation, map[string]string{"ipv4Addr": "10.0.0.1"}))
+	assert.Equal([]string{
+		"if node if3: expected condition to be false, got true",
+		`node ac1: expected reputationScore to be "51", got "50"`,
+		`amgtest: no node with id "missing" in the playbook`,
+		"expected www.vt.com/soar-services/v1/checkIpReputation to be called with map[ipv4Addr:10.0.0.1], " +
+			"it was called with [map[ipv4Addr:192.168.0.1] map[ipv4Addr:192.168.0.2] map[ipv4Addr:192.168.0.5]]",
+	}, rec.errors)
+	assert.Equal(1, len(rec.cleanups))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/batch"
+	"rptsec.com/amg/execution"
+)
+
+// runBacktest implements `amg backtest`, which replays a corpus of alerts
+// through a playbook and reports how the runs were distributed.
+func runBacktest(args []string) int {
+	fs := newFlagSet("backtest", "--alerts=<corpus.jsonl> [flags] <playbook>")
+	alertsFile := fs.String("alerts", "", "Corpus of alerts, one JSON object per line")
+	mockScenariosFile := fs.String("mock-scenario-file", "", "File with the recorded mock scenarios")
+	concurrency := fs.Int("concurrency", runtime.NumCPU(), "Number of alerts that are run at the same time")
+	out := addOutputFlags(fs, "text", "text|json|yaml")
+	logs := addLogFlags(fs)
+	parseArgs(fs, args)
+	if !logs.setup() {
+		return exitUsage
+	}
+	if fs.NArg() != 1 || *alertsFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	playbookData, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", fs.Arg(0), err.Error())
+		return exitInvalidPlaybook
+	}
+	if _, err := execution.NewNodesFromYaml(playbookData); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	var mocks []actionstore.ActionMockScenario
+	if *mockScenariosFile != "" {
+		if mocks, err = actionstore.LoadMockScenarios(*mockScenariosFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitInvalidPlaybook
+		}
+	}
+	corpus, err := os.Open(*alertsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	defer corpus.Close()
+
+	r := &batch.Runner{Playbook: playbookData, Mocks: mocks, Concurrency: *concurrency}
+	report, err := r.Backtest(corpus)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	report.Playbook = fs.Arg(0)
+
+	if *out.format == "text" {
+		report.WriteText(out.stdout())
+		return exitOK
+	}
+	d, err := out.marshal(report)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	out.stdout().Write(d)
+	return exitOK
+}
@@ -0,0 +1,252 @@
+package batch
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"rptsec.com/amg/execution"
+	"rptsec.com/amg/testsuite"
+)
+
+// BacktestReport aggregates the runs of a playbook over a corpus of alerts.
+type BacktestReport struct {
+	Playbook string `json:"playbook,omitempty"`
+	Alerts   int    `json:"alerts"`
+	Done     int    `json:"done"`
+	Failed   int    `json:"failed"`
+	Invalid  int    `json:"invalid"`
+	// ErrorRate is the percentage of the valid alerts whose run failed
+	ErrorRate float64 `json:"errorRate"`
+	// Branches are the if nodes, in the order of the playbook
+	Branches []BranchStats `json:"branches"`
+	// Actions are sorted by urn
+	Actions []ActionStats `json:"actions"`
+	// Errors are sorted by decreasing count
+	Errors []ErrorStats `json:"errors"`
+	// Latency is simulated from the execution durations of the mocks
+	Latency LatencyStats `json:"latencySecs"`
+}
+
+// BranchStats counts the outcomes of an if node.
+type BranchStats struct {
+	// Node is the id of the if node, or its position when the id is generated
+	Node         string `json:"node"`
+	Condition    string `json:"condition"`
+	True         int    `json:"true"`
+	False        int    `json:"false"`
+	NotEvaluated int    `json:"notEvaluated"`
+}
+
+// ActionStats counts the calls to an action.
+type ActionStats struct {
+	Urn   string `json:"urn"`
+	Calls int    `json:"calls"`
+	// Alerts is the number of alerts whose run called the action
+	Alerts int `json:"alerts"`
+	// Failed is the number of action nodes calling it that failed
+	Failed int `json:"failed"`
+	// Unmocked is the number of calls that no recorded mock matched
+	Unmocked int `json:"unmocked"`
+}
+
+// ErrorStats counts the runs that stopped with an error.
+type ErrorStats struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+// LatencyStats are percentiles of the simulated duration of the runs, in
+// seconds. A run lasts the sum of the execution durations of the mocks of the
+// actions it called.
+type LatencyStats struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+// Backtest runs the playbook for every alert read from in and aggregates
+// the outcomes.
+func (r *Runner) Backtest(in io.Reader) (*BacktestReport, error) {
+	durations := make(map[string]int)
+	for _, m := range r.Mocks {
+		if _, ok := durations[m.ActionUrn]; !ok {
+			durations[m.ActionUrn] = m.ExecutionDurationSecs
+		}
+	}
+
+	report := &BacktestReport{}
+	branches := make(map[string]*BranchStats)
+	var branchOrder []string
+	actions := make(map[string]*ActionStats)
+	errorCounts := make(map[string]int)
+	var latencies []float64
+
+	err := r.eachAlert(in, func(rec *Record, run *testsuite.CaseResult) error {
+		report.Alerts++
+		switch rec.State {
+		case StateInvalid:
+			report.Invalid++
+			return nil
+		case execution.StateFailed:
+			report.Failed++
+			errorCounts[rec.Error]++
+		default:
+			report.Done++
+		}
+
+		testsuite.WalkWithPosition(run.Nodes, "", func(pos string, n *execution.N) {
+			switch n.NodeType {
+			case "if":
+				key := n.ID
+				if n.GeneratedID() {
+					key = pos
+				}
+				b, ok := branches[key]
+				if !ok {
+					b = &BranchStats{Node: key, Condition: n.Condition}
+					branches[key] = b
+					branchOrder = append(branchOrder, key)
+				}
+				switch {
+				case n.State != execution.StateDone:
+					b.NotEvaluated++
+				case n.ConditionEvaluatedTo:
+					b.True++
+				default:
+					b.False++
+				}
+			case "execute":
+				if n.State == execution.StateFailed && n.Err != "" {
+					actionStats(actions, n.Urn).Failed++
+				}
+			}
+		})
+
+		latency := 0
+		called := make(map[string]bool)
+		for _, c := range run.MockCalls {
+			a := actionStats(actions, c.Urn)
+			a.Calls++
+			if !c.Matched {
+				a.Unmocked++
+			}
+			if !called[c.Urn] {
+				called[c.Urn] = true
+				a.Alerts++
+			}
+			latency += durations[c.Urn]
+		}
+		latencies = append(latencies, float64(latency))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if valid := report.Alerts - report.Invalid; valid > 0 {
+		report.ErrorRate = 100 * float64(report.Failed) / float64(valid)
+	}
+	report.Branches = []BranchStats{}
+	for _, key := range branchOrder {
+		report.Branches = append(report.Branches, *branches[key])
+	}
+	report.Actions = []ActionStats{}
+	for _, a := range actions {
+		report.Actions = append(report.Actions, *a)
+	}
+	sort.Slice(report.Actions, func(i, j int) bool { return report.Actions[i].Urn < report.Actions[j].Urn })
+	report.Errors = []ErrorStats{}
+	for e, count := range errorCounts {
+		report.Errors = append(report.Errors, ErrorStats{e, count})
+	}
+	sort.Slice(report.Errors, func(i, j int) bool {
+		if report.Errors[i].Count != report.Errors[j].Count {
+			return report.Errors[i].Count > report.Errors[j].Count
+		}
+		return report.Errors[i].Error < report.Errors[j].Error
+	})
+	report.Latency = latencyStats(latencies)
+	return report, nil
+}
+
+func actionStats(actions map[string]*ActionStats, urn string) *ActionStats {
+	a, ok := actions[urn]
+	if !ok {
+		a = &ActionStats{Urn: urn}
+		actions[urn] = a
+	}
+	return a
+}
+
+func latencyStats(latencies []float64) LatencyStats {
+	if len(latencies) == 0 {
+		return LatencyStats{}
+	}
+	sort.Float64s(latencies)
+	sum := 0.0
+	for _, l := range latencies {
+		sum += l
+	}
+	return LatencyStats{
+		Mean: sum / float64(len(latencies)),
+		P50:  percentile(latencies, 50),
+		P90:  percentile(latencies, 90),
+		P99:  percentile(latencies, 99),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// maxErrorsInText bounds the distinct errors listed by WriteText
+const maxErrorsInText = 10
+
+// WriteText writes the report in a form meant to be read in a terminal.
+func (b *BacktestReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "backtest of %s over %d alerts\n", b.Playbook, b.Alerts)
+	fmt.Fprintf(w, "  done %d, failed %d (%.1f%% error rate), invalid %d\n", b.Done, b.Failed, b.ErrorRate, b.Invalid)
+
+	fmt.Fprintf(w, "branches:\n")
+	for _, br := range b.Branches {
+		evaluated := br.True + br.False
+		fmt.Fprintf(w, "  %s (%s): true %d (%.1f%%), false %d (%.1f%%), not evaluated %d\n",
+			br.Node, br.Condition, br.True, share(br.True, evaluated), br.False, share(br.False, evaluated), br.NotEvaluated)
+	}
+
+	fmt.Fprintf(w, "actions:\n")
+	for _, a := range b.Actions {
+		fmt.Fprintf(w, "  %s: %d calls in %d alerts, %d failed, %d unmocked\n", a.Urn, a.Calls, a.Alerts, a.Failed, a.Unmocked)
+	}
+
+	l := b.Latency
+	fmt.Fprintf(w, "simulated latency (secs): mean %.1f, p50 %g, p90 %g, p99 %g, max %g\n", l.Mean, l.P50, l.P90, l.P99, l.Max)
+
+	if len(b.Errors) > 0 {
+		fmt.Fprintf(w, "errors:\n")
+		for i, e := range b.Errors {
+			if i == maxErrorsInText {
+				fmt.Fprintf(w, "  ... %d more\n", len(b.Errors)-maxErrorsInText)
+				break
+			}
+			fmt.Fprintf(w, "  %6d  %s\n", e.Count, e.Error)
+		}
+	}
+}
+
+func share(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,55 @@
+package batch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/actionstore"
+)
+
+func TestBacktestSampleCorpus(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook, err := ioutil.ReadFile("../resources/sample-playbook.yaml")
+	assert.Nil(err)
+	mocks, err := actionstore.LoadMockScenarios("../resources/sample-mock-scenario.json")
+	assert.Nil(err)
+	corpus, err := os.Open("../resources/sample-alerts.jsonl")
+	assert.Nil(err)
+	defer corpus.Close()
+
+	r := &Runner{Playbook: playbook, Mocks: mocks, Concurrency: 4}
+	report, err := r.Backtest(corpus)
+	assert.Nil(err)
+
+	assert.Equal(8, report.Alerts)
+	assert.Equal(6, report.Done)
+	assert.Equal(2, report.Failed)
+	assert.Equal(25.0, report.ErrorRate)
+	assert.Equal([]BranchStats{{Node: "if3", Condition: "@node:ac1$reputationScore == 50", True: 3, False: 3, NotEvaluated: 2}},
+		report.Branches)
+	assert.Equal(ActionStats{Urn: "www.rptsec.com/sms/v1/getDomainForIp", Calls: 3, Alerts: 3}, report.Actions[0])
+	assert.Equal(ActionStats{Urn: "www.vt.com/soar-services/v1/checkIpReputation", Calls: 23, Alerts: 8, Failed: 2, Unmocked: 1},
+		report.Actions[2])
+	assert.Equal(2, len(report.Errors))
+	// Runs on the yes path call three 5 second and two 3 second actions.
+	assert.Equal(21.0, report.Latency.Max)
+
+	var text bytes.Buffer
+	report.WriteText(&text)
+	assert.Contains(text.String(), "if3 (@node:ac1$reputationScore == 50): true 3 (50.0%), false 3 (50.0%), not evaluated 2")
+}
+
+func TestPercentile(t *testing.T) {
+	assert := assert.New(t)
+
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	assert.Equal(5.0, percentile(values, 50))
+	assert.Equal(9.0, percentile(values, 90))
+	assert.Equal(10.0, percentile(values, 99))
+	assert.Equal(1.0, percentile(values, 0))
+}
@@ -0,0 +1,235 @@
+// Package batch runs a playbook for every alert in a stream of JSON alerts,
+// one alert per line, and writes a JSON result record per line.
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/execution"
+	"rptsec.com/amg/testsuite"
+)
+
+// StateInvalid is the state of a record for a line that is not a JSON object.
+const StateInvalid = "Invalid"
+
+// maxLineSize bounds the size of an alert line
+const maxLineSize = 16 * 1024 * 1024
+
+// Record is the result of running the playbook for one alert.
+type Record struct {
+	// Line of the alert in the input, starting at 1
+	Line int `json:"line"`
+	// AlertID is the value of the id field of the alert, if any
+	AlertID string `json:"alertId,omitempty"`
+	// State is Done when the execution finished without error, Failed when it
+	// stopped with an error and Invalid when the line could not be parsed.
+	State   string            `json:"state"`
+	Nodes   map[string]string `json:"nodes,omitempty"`
+	Exports map[string]string `json:"exports,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	// NodeErrors maps the id of a failed node to its error
+	NodeErrors map[string]string `json:"nodeErrors,omitempty"`
+	// Concurrency is the largest number of actions that ran at the same
+	// time, when they may run in parallel
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// Summary counts the records written by a run.
+type Summary struct {
+	Alerts  int
+	Failed  int
+	Invalid int
+}
+
+// Runner runs a playbook against mocked actions for each alert it reads.
+type Runner struct {
+	Playbook []byte
+	Mocks    []actionstore.ActionMockScenario
+	// Concurrency is the number of alerts run at the same time, at least 1
+	Concurrency int
+	// IDField is the alert field reported as the id of the alert, "id" by default
+	IDField string
+	// Options set how the nodes of each alert and the mocks are run
+	Options testsuite.ExecuteOptions
+}
+
+type job struct {
+	seq, line int
+	data      []byte
+}
+
+type result struct {
+	seq     int
+	outcome interface{}
+}
+
+// outcome is the result of running the playbook for one alert. run is nil
+// for invalid alerts.
+type outcome struct {
+	record *Record
+	run    *testsuite.CaseResult
+}
+
+// Run reads alerts from in and writes a record for each of them to out, in
+// the order of the alerts. Blank lines are skipped.
+func (r *Runner) Run(in io.Reader, out io.Writer) (Summary, error) {
+	var summary Summary
+	enc := json.NewEncoder(out)
+	err := r.eachAlert(in, func(rec *Record, _ *testsuite.CaseResult) error {
+		summary.Alerts++
+		switch rec.State {
+		case execution.StateFailed:
+			summary.Failed++
+		case StateInvalid:
+			summary.Invalid++
+		}
+		return enc.Encode(rec)
+	})
+	return summary, err
+}
+
+// eachAlert runs the playbook for every alert read from in and calls handle
+// with the results in the order of the alerts. The result of the run is nil
+// for invalid alerts.
+func (r *Runner) eachAlert(in io.Reader, handle func(*Record, *testsuite.CaseResult) error) error {
+	return r.each(in,
+		func(line int, data []byte) interface{} {
+			rec, run := r.runAlert(line, data)
+			return outcome{rec, run}
+		},
+		func(o interface{}) error {
+			return handle(o.(outcome).record, o.(outcome).run)
+		})
+}
+
+// each calls run for every non-blank line read from in, Concurrency lines at
+// a time, and calls handle with what run returned in the order of the lines.
+// Lines are read at most twice Concurrency ahead of the first one not handled
+// yet, so that a slow alert does not let the results after it pile up. Once
+// handle returns an error no more lines are run.
+func (r *Runner) each(in io.Reader, run func(line int, data []byte) interface{}, handle func(interface{}) error) error {
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan job)
+	results := make(chan result)
+	// window holds a value for every line read and not handled yet.
+	window := make(chan struct{}, 2*concurrency)
+	stop := make(chan struct{})
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		seq, line := 0, 0
+		for scanner.Scan() {
+			line++
+			data := bytes.TrimSpace(scanner.Bytes())
+			if len(data) == 0 {
+				continue
+			}
+			select {
+			case <-stop:
+				return
+			case window <- struct{}{}:
+			}
+			jobs <- job{seq, line, append([]byte{}, data...)}
+			seq++
+		}
+		readErr = scanner.Err()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- result{j.seq, run(j.line, j.data)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results that finish early wait in pending until the ones before them
+	// are handled.
+	var handleErr error
+	pending := make(map[int]result)
+	next := 0
+	for res := range results {
+		pending[res.seq] = res
+		for p, ok := pending[next]; ok; p, ok = pending[next] {
+			delete(pending, next)
+			next++
+			if handleErr != nil {
+				continue
+			}
+			if handleErr = handle(p.outcome); handleErr != nil {
+				close(stop)
+				continue
+			}
+			<-window
+		}
+	}
+	if readErr != nil {
+		return fmt.Errorf("error reading alerts: %s", readErr.Error())
+	}
+	return handleErr
+}
+
+func (r *Runner) runAlert(line int, data []byte) (*Record, *testsuite.CaseResult) {
+	rec := &Record{Line: line}
+	alert, err := execution.ParseAlert(data)
+	if err != nil {
+		rec.State = StateInvalid
+		rec.Error = err.Error()
+		return rec, nil
+	}
+	idField := r.IDField
+	if idField == "" {
+		idField = "id"
+	}
+	if id, ok := execution.LookupPath(alert, idField); ok {
+		rec.AlertID = id.StringVal()
+	}
+
+	res := testsuite.ExecuteWithOptions(r.Playbook, alert, r.Mocks, r.Options)
+	if res.Err != nil {
+		rec.State = StateInvalid
+		rec.Error = res.Err.Error()
+		return rec, nil
+	}
+	rec.State = execution.StateDone
+	if res.ExecErr != nil {
+		rec.State = execution.StateFailed
+		rec.Error = res.ExecErr.Error()
+	}
+	if r.Options.MaxParallel > 1 {
+		rec.Concurrency = res.PeakConcurrency
+	}
+	if len(res.Exports) > 0 {
+		rec.Exports = res.Exports
+	}
+	rec.Nodes = make(map[string]string)
+	for id, n := range testsuite.IndexNodes(res.Nodes) {
+		rec.Nodes[id] = n.State
+		if n.Err != "" {
+			if rec.NodeErrors == nil {
+				rec.NodeErrors = make(map[string]string)
+			}
+			rec.NodeErrors[id] = n.Err
+		}
+	}
+	return rec, res
+}
@@ -0,0 +1,106 @@
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/actionstore"
+)
+
+func TestRunWritesRecordsInOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook, err := ioutil.ReadFile("../resources/sample-playbook.yaml")
+	assert.Nil(err)
+	mocks, err := actionstore.LoadMockScenarios("../resources/sample-mock-scenario.json")
+	assert.Nil(err)
+
+	in := strings.Join([]string{
+		`{"id": "a-1", "srcIp": "192.168.0.1", "dstIp": "192.168.0.2"}`,
+		``,
+		`{"id": "a-2", "srcIp": "192.168.0.3", "dstIp": "192.168.0.2"}`,
+		`not json`,
+		`{"id": "a-3", "srcIp": "127.0.0.1", "dstIp": "192.168.0.2"}`,
+	}, "\n")
+	var out bytes.Buffer
+	r := &Runner{Playbook: playbook, Mocks: mocks, Concurrency: 3}
+	summary, err := r.Run(strings.NewReader(in), &out)
+	assert.Nil(err)
+	assert.Equal(Summary{Alerts: 4, Failed: 1, Invalid: 1}, summary)
+
+	var records []Record
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var rec Record
+		assert.Nil(json.Unmarshal([]byte(line), &rec))
+		records = append(records, rec)
+	}
+	assert.Equal(4, len(records))
+
+	assert.Equal(1, records[0].Line)
+	assert.Equal("a-1", records[0].AlertID)
+	assert.Equal("Done", records[0].State)
+	assert.Equal("Done", records[0].Nodes["ifYesAc2"])
+
+	assert.Equal(3, records[1].Line)
+	assert.Equal("a-2", records[1].AlertID)
+	assert.Equal("Not-Yet-Started", records[1].Nodes["ifYesAc2"])
+
+	assert.Equal(4, records[2].Line)
+	assert.Equal(StateInvalid, records[2].State)
+	assert.Contains(records[2].Error, "not a JSON object")
+
+	assert.Equal(5, records[3].Line)
+	assert.Equal("Failed", records[3].State)
+	assert.Equal("Localhost address. Please correct.", records[3].NodeErrors["ac1"])
+}
+
+// blockingWriter blocks the first write until release is closed, and fails
+// every write.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return 0, errors.New("broken pipe")
+}
+
+func TestRunBoundsAlertsInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &Runner{Playbook: []byte(`[{id: a, urn: urn:none, params: {ip: "@alert:ip"}}]`), Concurrency: 2}
+	in, feed := io.Pipe()
+	defer in.Close()
+	var fed int32
+	go func() {
+		for i := 0; i < 1000; i++ {
+			if _, err := feed.Write([]byte(`{"ip": "10.0.0.1"}` + "\n")); err != nil {
+				return
+			}
+			atomic.AddInt32(&fed, 1)
+		}
+		feed.Close()
+	}()
+
+	// While the first record can not be written, the alerts after it are
+	// read at most a window ahead, and none once writing failed.
+	out := &blockingWriter{release: make(chan struct{})}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.True(atomic.LoadInt32(&fed) <= 8, "read %d alerts", atomic.LoadInt32(&fed))
+		close(out.release)
+	}()
+	_, err := r.Run(in, out)
+	assert.EqualError(err, "broken pipe")
+	time.Sleep(10 * time.Millisecond)
+	assert.True(atomic.LoadInt32(&fed) <= 8, "read %d alerts", atomic.LoadInt32(&fed))
+}
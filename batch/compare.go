@@ -0,0 +1,216 @@
+package batch
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/execution"
+	"rptsec.com/amg/testsuite"
+)
+
+// Comparison lists the alerts whose outcome differs between two versions of
+// a playbook.
+type Comparison struct {
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Alerts int    `json:"alerts"`
+	// Diffs are the alerts that differ, in the order of the corpus
+	Diffs []AlertDiff `json:"diffs"`
+}
+
+// AlertDiff explains how the outcome for one alert differs.
+type AlertDiff struct {
+	Line        int      `json:"line"`
+	AlertID     string   `json:"alertId,omitempty"`
+	Differences []string `json:"differences"`
+}
+
+// Compare runs the old and the new version of a playbook against every alert
+// read from in, with the same mocks, and returns the alerts for which they
+// differ in branch decisions, action calls, exports or final verdict.
+func Compare(oldPlaybook []byte, newPlaybook []byte, mocks []actionstore.ActionMockScenario,
+	concurrency int, in io.Reader) (*Comparison, error) {
+	oldRunner := &Runner{Playbook: oldPlaybook, Mocks: mocks}
+	newRunner := &Runner{Playbook: newPlaybook, Mocks: mocks}
+	r := &Runner{Concurrency: concurrency}
+
+	c := &Comparison{Diffs: []AlertDiff{}}
+	err := r.each(in,
+		func(line int, data []byte) interface{} {
+			oldRec, oldRun := oldRunner.runAlert(line, data)
+			newRec, newRun := newRunner.runAlert(line, data)
+			return [2]outcome{{oldRec, oldRun}, {newRec, newRun}}
+		},
+		func(o interface{}) error {
+			pair := o.([2]outcome)
+			c.Alerts++
+			if differences := compareOutcomes(pair[0], pair[1]); len(differences) > 0 {
+				c.Diffs = append(c.Diffs, AlertDiff{
+					Line:        pair[0].record.Line,
+					AlertID:     pair[0].record.AlertID,
+					Differences: differences,
+				})
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func compareOutcomes(before outcome, after outcome) []string {
+	var differences []string
+	if v1, v2 := verdict(before.record), verdict(after.record); v1 != v2 {
+		differences = append(differences, fmt.Sprintf("verdict: %s -> %s", v1, v2))
+	}
+	if before.run == nil || after.run == nil {
+		return differences
+	}
+
+	oldBranches, newBranches := decisions(before.run), decisions(after.run)
+	for _, id := range unionKeys(oldBranches, newBranches) {
+		if d1, d2 := describeDecision(oldBranches, id), describeDecision(newBranches, id); d1 != d2 {
+			differences = append(differences, fmt.Sprintf("branch %s: %s -> %s", id, d1, d2))
+		}
+	}
+
+	oldCalls, newCalls := callCounts(before.run), callCounts(after.run)
+	for _, call := range unionCountKeys(oldCalls, newCalls) {
+		if n1, n2 := oldCalls[call], newCalls[call]; n1 != n2 {
+			differences = append(differences, fmt.Sprintf("call %s: %s -> %s", call, times(n1), times(n2)))
+		}
+	}
+
+	for _, name := range unionKeys(before.run.Exports, after.run.Exports) {
+		if e1, e2 := describeExport(before.run.Exports, name), describeExport(after.run.Exports, name); e1 != e2 {
+			differences = append(differences, fmt.Sprintf("export %s: %s -> %s", name, e1, e2))
+		}
+	}
+	return differences
+}
+
+// verdict is the final state of a run along with its error.
+func verdict(rec *Record) string {
+	if rec.Error == "" {
+		return rec.State
+	}
+	return fmt.Sprintf("%s (%s)", rec.State, rec.Error)
+}
+
+// decisions maps each if node to its state, or to the path it took when done.
+// Nodes with generated ids are keyed by their position.
+func decisions(run *testsuite.CaseResult) map[string]string {
+	d := make(map[string]string)
+	testsuite.WalkWithPosition(run.Nodes, "", func(pos string, n *execution.N) {
+		if n.NodeType != "if" {
+			return
+		}
+		key := n.ID
+		if n.GeneratedID() {
+			key = pos
+		}
+		switch {
+		case n.State != execution.StateDone:
+			d[key] = "not evaluated (" + n.State + ")"
+		case n.ConditionEvaluatedTo:
+			d[key] = "true"
+		default:
+			d[key] = "false"
+		}
+	})
+	return d
+}
+
+func describeDecision(decisions map[string]string, id string) string {
+	if d, ok := decisions[id]; ok {
+		return d
+	}
+	return "no such node"
+}
+
+// callCounts counts the calls made with each urn and params.
+func callCounts(run *testsuite.CaseResult) map[string]int {
+	counts := make(map[string]int)
+	for _, c := range run.MockCalls {
+		counts[formatCall(c)]++
+	}
+	return counts
+}
+
+func formatCall(c actionstore.ActionCall) string {
+	params := make([]string, 0, len(c.Params))
+	for k, v := range c.Params {
+		params = append(params, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(params)
+	return fmt.Sprintf("%s(%s)", c.Urn, strings.Join(params, ", "))
+}
+
+func times(n int) string {
+	switch n {
+	case 0:
+		return "not called"
+	case 1:
+		return "called once"
+	}
+	return fmt.Sprintf("called %d times", n)
+}
+
+func describeExport(exports map[string]string, name string) string {
+	if v, ok := exports[name]; ok {
+		return fmt.Sprintf("%q", v)
+	}
+	return "not exported"
+}
+
+// unionKeys returns the keys of a and b, sorted.
+func unionKeys(a map[string]string, b map[string]string) []string {
+	set := make(map[string]bool)
+	for k := range a {
+		set[k] = true
+	}
+	for k := range b {
+		set[k] = true
+	}
+	return sortedSet(set)
+}
+
+// unionCountKeys returns the keys of a and b, sorted.
+func unionCountKeys(a map[string]int, b map[string]int) []string {
+	set := make(map[string]bool)
+	for k := range a {
+		set[k] = true
+	}
+	for k := range b {
+		set[k] = true
+	}
+	return sortedSet(set)
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteText writes the comparison in a form meant to be read in a terminal.
+func (c *Comparison) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "compared %s and %s over %d alerts: %d differ\n", c.Old, c.New, c.Alerts, len(c.Diffs))
+	for _, d := range c.Diffs {
+		if d.AlertID != "" {
+			fmt.Fprintf(w, "\nalert %s (line %d):\n", d.AlertID, d.Line)
+		} else {
+			fmt.Fprintf(w, "\nalert on line %d:\n", d.Line)
+		}
+		for _, difference := range d.Differences {
+			fmt.Fprintf(w, "  %s\n", difference)
+		}
+	}
+}
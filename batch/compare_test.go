@@ -0,0 +1,53 @@
+package batch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/actionstore"
+)
+
+func TestCompareReportsDifferingAlerts(t *testing.T) {
+	assert := assert.New(t)
+
+	oldPlaybook, err := ioutil.ReadFile("../resources/sample-playbook.yaml")
+	assert.Nil(err)
+	mocks, err := actionstore.LoadMockScenarios("../resources/sample-mock-scenario.json")
+	assert.Nil(err)
+	newPlaybook := strings.Replace(string(oldPlaybook), "@node:ac1$reputationScore == 50", "@node:ac1$reputationScore >= 52", 1)
+	newPlaybook = strings.Replace(newPlaybook, `ipv4Addr: "192.168.0.5"`, `ipv4Addr: "127.0.0.1"`, 1)
+
+	corpus := strings.Join([]string{
+		`{"id": "a-1", "srcIp": "192.168.0.1", "dstIp": "192.168.0.2"}`,
+		`{"id": "a-2", "srcIp": "127.0.0.1", "dstIp": "192.168.0.2"}`,
+		`{"id": "a-3", "srcIp": "192.168.0.3", "dstIp": "192.168.0.2"}`,
+	}, "\n")
+	c, err := Compare(oldPlaybook, []byte(newPlaybook), mocks, 2, strings.NewReader(corpus))
+	assert.Nil(err)
+	assert.Equal(3, c.Alerts)
+	assert.Equal(2, len(c.Diffs))
+
+	assert.Equal("a-1", c.Diffs[0].AlertID)
+	assert.Equal([]string{
+		"verdict: Done -> Failed (node ac4: Localhost address. Please correct.)",
+		"branch if3: true -> false",
+		`call www.rptsec.com/sms/v1/getDomainForIp(ipv4Addr="192.168.0.1"): called once -> not called`,
+		`call www.vt.com/soar-services/v1/checkDomainReputation(domainName="www.gooddomain.com"): called once -> not called`,
+		`call www.vt.com/soar-services/v1/checkIpReputation(ipv4Addr="127.0.0.1"): not called -> called once`,
+		`call www.vt.com/soar-services/v1/checkIpReputation(ipv4Addr="192.168.0.4"): not called -> called once`,
+		`call www.vt.com/soar-services/v1/checkIpReputation(ipv4Addr="192.168.0.5"): called once -> not called`,
+	}, c.Diffs[0].Differences)
+
+	// a-2 fails on ac1 in both versions.
+	assert.Equal("a-3", c.Diffs[1].AlertID)
+	assert.Equal(3, c.Diffs[1].Line)
+
+	var text bytes.Buffer
+	c.WriteText(&text)
+	assert.Contains(text.String(), "over 3 alerts: 2 differ")
+	assert.Contains(text.String(), "alert a-3 (line 3):\n  verdict: Done -> Failed")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	y "github.com/ghodss/yaml"
+	"rptsec.com/amg/logging"
+)
+
+// Exit codes of the amg commands
+const (
+	exitOK = 0
+	// exitFailure is returned when a test case, golden comparison, property
+	// or mutation score fails, or the output can not be written
+	exitFailure = 1
+	// exitUsage is returned for unknown commands and bad flags
+	exitUsage = 2
+	// exitInvalidPlaybook is returned when the playbook, or another input file
+	// such as alert data, mocks or a suite, can not be read or is invalid
+	exitInvalidPlaybook = 3
+	// exitExecutionFailure is returned when the playbook ran and failed
+	exitExecutionFailure = 4
+)
+
+// outputFlags are the flags shared by the commands that print a result.
+type outputFlags struct {
+	format *string
+	quiet  *bool
+}
+
+func addOutputFlags(fs *flag.FlagSet, defaultFormat string, formats string) *outputFlags {
+	return &outputFlags{
+		format: fs.String("output", defaultFormat, "Format of the output: "+formats),
+		quiet:  fs.Bool("quiet", false, "Print nothing on stdout, only set the exit code"),
+	}
+}
+
+// marshal encodes v as json or yaml, depending on the --output flag.
+func (o *outputFlags) marshal(v interface{}) ([]byte, error) {
+	switch *o.format {
+	case "json":
+		d, err := json.MarshalIndent(v, "", "  ")
+		return append(d, '\n'), err
+	case "yaml":
+		return y.Marshal(v)
+	}
+	return nil, fmt.Errorf("unknown output format: %s", *o.format)
+}
+
+// stdout is where the command writes its output, discarded with --quiet.
+func (o *outputFlags) stdout() io.Writer {
+	if *o.quiet {
+		return ioutil.Discard
+	}
+	return os.Stdout
+}
+
+// logFlags are the flags of the commands that run playbooks, which set how the
+// engine logs to stderr.
+type logFlags struct {
+	level  *string
+	format *string
+}
+
+func addLogFlags(fs *flag.FlagSet) *logFlags {
+	return &logFlags{
+		level:  fs.String("log-level", "warn", "Level of the engine messages logged to stderr: debug|info|warn|error|off"),
+		format: fs.String("log-format", "text", "Format of the engine messages: text|json"),
+	}
+}
+
+// setup makes the engine log to stderr as set by the flags. It returns false,
+// after printing why, when a flag has a bad value.
+func (l *logFlags) setup() bool {
+	level, err := logging.ParseLevel(*l.level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return false
+	}
+	format, err := logging.ParseFormat(*l.format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return false
+	}
+	logging.SetDefault(logging.New(os.Stderr, level, format))
+	return true
+}
+
+// newFlagSet returns a flag set for a command whose usage line is
+// "amg <name> <usage>".
+func newFlagSet(name string, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: amg %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of a command, which may come before, after or
+// between its arguments, eg. `amg compare old.yaml new.yaml --alerts x`.
+func parseArgs(fs *flag.FlagSet, args []string) {
+	var flags, positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			positional = append(positional, arg)
+			continue
+		}
+		flags = append(flags, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		// A flag that is not boolean takes the next argument as its value.
+		if f := fs.Lookup(name); f != nil && i+1 < len(args) {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+				flags = append(flags, args[i])
+			}
+		}
+	}
+	fs.Parse(append(append(flags, "--"), positional...))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArgsAcceptsFlagsAfterArguments(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	alerts := fs.String("alerts", "", "")
+	quiet := fs.Bool("quiet", false, "")
+	parseArgs(fs, []string{"old.yaml", "--alerts", "corpus.jsonl", "new.yaml", "--quiet", "--", "-odd.yaml"})
+	assert.Equal("corpus.jsonl", *alerts)
+	assert.True(*quiet)
+	assert.Equal([]string{"old.yaml", "new.yaml", "-odd.yaml"}, fs.Args())
+
+	fs = flag.NewFlagSet("run", flag.ContinueOnError)
+	alerts = fs.String("alerts", "", "")
+	parseArgs(fs, []string{"--alerts=x.jsonl", "-"})
+	assert.Equal("x.jsonl", *alerts)
+	assert.Equal([]string{"-"}, fs.Args())
+}
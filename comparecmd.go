@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/batch"
+	"rptsec.com/amg/execution"
+)
+
+// runCompare implements `amg compare old.yaml new.yaml --alerts corpus.jsonl`,
+// which reports the alerts whose outcome differs between two versions of a
+// playbook.
+func runCompare(args []string) int {
+	fs := newFlagSet("compare", "<old-playbook> <new-playbook> --alerts=<corpus.jsonl> [flags]")
+	alertsFile := fs.String("alerts", "", "Corpus of alerts, one JSON object per line")
+	mockScenariosFile := fs.String("mock-scenario-file", "", "File with the mock scenarios that both versions run against")
+	concurrency := fs.Int("concurrency", runtime.NumCPU(), "Number of alerts that are run at the same time")
+	out := addOutputFlags(fs, "text", "text|json|yaml")
+	logs := addLogFlags(fs)
+	parseArgs(fs, args)
+	if !logs.setup() {
+		return exitUsage
+	}
+	if fs.NArg() != 2 || *alertsFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	var playbooks [2][]byte
+	for i, path := range fs.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", path, err.Error())
+			return exitInvalidPlaybook
+		}
+		if _, err := execution.NewNodesFromYaml(data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			return exitInvalidPlaybook
+		}
+		playbooks[i] = data
+	}
+	var mocks []actionstore.ActionMockScenario
+	var err error
+	if *mockScenariosFile != "" {
+		if mocks, err = actionstore.LoadMockScenarios(*mockScenariosFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitInvalidPlaybook
+		}
+	}
+	corpus, err := os.Open(*alertsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	defer corpus.Close()
+
+	c, err := batch.Compare(playbooks[0], playbooks[1], mocks, *concurrency, corpus)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	c.Old, c.New = fs.Arg(0), fs.Arg(1)
+
+	if *out.format == "text" {
+		c.WriteText(out.stdout())
+	} else {
+		d, err := out.marshal(c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitUsage
+		}
+		out.stdout().Write(d)
+	}
+	if len(c.Diffs) > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,31 @@
+package execution
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ParseAlert decodes an alert payload, which must be a JSON object. Numbers
+// are kept as json.Number so that they keep their literal form.
+func ParseAlert(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var alert map[string]interface{}
+	if err := dec.Decode(&alert); err != nil {
+		return nil, fmt.Errorf("alert is not a JSON object: %s", err.Error())
+	}
+	if alert == nil {
+		return nil, fmt.Errorf("alert is not a JSON object")
+	}
+	return alert, nil
+}
+
+// AlertFromStrings builds an alert payload from flat string fields.
+func AlertFromStrings(fields map[string]string) map[string]interface{} {
+	alert := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		alert[k] = v
+	}
+	return alert
+}
@@ -0,0 +1,469 @@
+package execution
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/logging"
+)
+
+// CheckpointFormat is the version of the format of the checkpoints written by
+// Checkpoint. Resume reads checkpoints of this version only.
+const CheckpointFormat = 1
+
+// checkpoint is the JSON form of an execution and its state.
+type checkpoint struct {
+	Format      int    `json:"format"`
+	ExecutionID string `json:"executionId"`
+	// Playbook is the hash of the nodes of the playbook, see nodeKeys
+	Playbook string          `json:"playbook"`
+	Version  uint64          `json:"version"`
+	State    checkpointState `json:"state"`
+}
+
+type checkpointState struct {
+	Version      uint64                      `json:"version"`
+	StartTs      int64                       `json:"startTs"`
+	DoneTs       int64                       `json:"doneTs,omitempty"`
+	LastUpdateTs int64                       `json:"lastUpdateTs"`
+	Error        string                      `json:"error,omitempty"`
+	Alert        map[string]interface{}      `json:"alert,omitempty"`
+	Actions      map[string]checkpointAction `json:"actions,omitempty"`
+	Ifs          map[string]checkpointIf     `json:"ifs,omitempty"`
+	Loops        map[string]checkpointLoop   `json:"loops,omitempty"`
+	Exports      map[string]checkpointExport `json:"exports,omitempty"`
+}
+
+type checkpointAction struct {
+	Version        uint64                    `json:"version"`
+	WaitingOnInput bool                      `json:"waitingOnInput,omitempty"`
+	Done           bool                      `json:"done,omitempty"`
+	Error          string                    `json:"error,omitempty"`
+	Params         map[string]string         `json:"params,omitempty"`
+	UsedValues     map[string]string         `json:"usedValues,omitempty"`
+	Result         *actionstore.ActionResult `json:"result,omitempty"`
+}
+
+type checkpointIf struct {
+	Version           uint64            `json:"version"`
+	WaitingOnInput    bool              `json:"waitingOnInput,omitempty"`
+	Done              bool              `json:"done,omitempty"`
+	Error             string            `json:"error,omitempty"`
+	ConcreteCondition string            `json:"concreteCondition,omitempty"`
+	Values            map[string]string `json:"values,omitempty"`
+	EvaluatedToTrue   bool              `json:"evaluatedToTrue,omitempty"`
+}
+
+type checkpointLoop struct {
+	Version          uint64 `json:"version"`
+	WaitingOnInput   bool   `json:"waitingOnInput,omitempty"`
+	Done             bool   `json:"done,omitempty"`
+	CurrentIteration int    `json:"currentIteration"`
+	// Iterations and Values are keyed by the number of the iteration
+	Iterations map[string]checkpointState `json:"iterations,omitempty"`
+	Values     map[string]interface{}     `json:"values,omitempty"`
+}
+
+type checkpointExport struct {
+	Version uint64      `json:"version"`
+	Value   interface{} `json:"value"`
+}
+
+// Checkpoint returns the state of the execution, including the nested loop
+// states, the exports and the alert, as versioned JSON that Resume continues
+// from.
+func (ex *Execution) Checkpoint() ([]byte, error) {
+	data, _, err := ex.checkpoint()
+	return data, err
+}
+
+// checkpoint returns the checkpoint of the execution and its version.
+func (ex *Execution) checkpoint() ([]byte, uint64, error) {
+	s := ex.Status(0)
+	k := newNodeKeys(ex.startNode)
+	data, err := json.Marshal(checkpoint{
+		Format:      CheckpointFormat,
+		ExecutionID: ex.id,
+		Playbook:    k.hash,
+		Version:     s.version,
+		State:       s.checkpointState(k),
+	})
+	return data, s.version, err
+}
+
+// nodeKeys maps the ids of the nodes of a playbook to the keys of their
+// states in a checkpoint, and back. The key of a node is its position, such
+// as [2].onTrue[0], as the ids generated for the nodes without one change
+// from one parse of the playbook to the next. Ids of nodes that are not in
+// the playbook are their own keys.
+type nodeKeys struct {
+	keys map[string]string
+	ids  map[string]string
+	// hash is a hash of the position, type, action, params, exports and
+	// condition of every node, which tells the playbook the keys are for.
+	// The ids are left out as they are generated.
+	hash string
+}
+
+func newNodeKeys(first Node) *nodeKeys {
+	k := &nodeKeys{keys: make(map[string]string), ids: make(map[string]string)}
+	h := sha256.New()
+	k.walk(first, "", h)
+	k.hash = hex.EncodeToString(h.Sum(nil))
+	return k
+}
+
+func (k *nodeKeys) walk(first Node, prefix string, h io.Writer) {
+	i := 0
+	for n := first; n != nil; n = n.Next() {
+		pos := fmt.Sprintf("%s[%d]", prefix, i)
+		i++
+		var id string
+		switch n := n.(type) {
+		case *ActionNode:
+			id = n.Id
+			// Maps are printed sorted by key.
+			fmt.Fprintf(h, "%s action %q %q %q\n", pos, n.urn, n.inputParams, n.exportResultAs)
+		case *IfNode:
+			id = n.Id
+			fmt.Fprintf(h, "%s if %q\n", pos, n.condition)
+			k.walk(n.YesPathFirstNode, pos+".onTrue", h)
+			k.walk(n.NoPathFirstNode, pos+".onFalse", h)
+		case *ForNode:
+			id = n.Id
+			fmt.Fprintf(h, "%s for %q\n", pos, n.IterateOnVar)
+			k.walk(n.FirstLoopNode, pos+".loop", h)
+		}
+		k.keys[id] = pos
+		k.ids[pos] = id
+	}
+}
+
+// key returns the key of the node with the given id.
+func (k *nodeKeys) key(id string) string {
+	if key, ok := k.keys[id]; ok {
+		return key
+	}
+	return id
+}
+
+// id returns the id of the node with the given key.
+func (k *nodeKeys) id(key string) string {
+	if id, ok := k.ids[key]; ok {
+		return id
+	}
+	return key
+}
+
+// checkpointState converts a snapshot, which is not changed any more, to its
+// JSON form.
+func (e *ExecState) checkpointState(k *nodeKeys) checkpointState {
+	c := checkpointState{
+		Version:      e.version,
+		StartTs:      e.execStartTs,
+		DoneTs:       e.execDoneTs,
+		LastUpdateTs: e.lastUpdateTs,
+		Error:        e.ErrStr,
+		Alert:        e.alert,
+		Actions:      make(map[string]checkpointAction),
+		Ifs:          make(map[string]checkpointIf),
+		Loops:        make(map[string]checkpointLoop),
+		Exports:      make(map[string]checkpointExport),
+	}
+	for id, a := range e.actionResults {
+		c.Actions[k.key(id)] = checkpointAction{a.version, a.waitingOnInput, a.done, a.errStr,
+			a.concreteInputParams, a.usedValues, a.actionResult}
+	}
+	for id, i := range e.ifResults {
+		c.Ifs[k.key(id)] = checkpointIf{i.version, i.waitingOnInput, i.done, i.errStr,
+			i.concreteCondition, i.varValues, i.evaluatedToTrue}
+	}
+	for id, f := range e.forResults {
+		l := checkpointLoop{
+			Version:          f.version,
+			WaitingOnInput:   f.waitingOnInput,
+			Done:             f.done,
+			CurrentIteration: f.currentIterationNumber,
+			Iterations:       make(map[string]checkpointState),
+			Values:           make(map[string]interface{}),
+		}
+		for n, st := range f.iterations() {
+			l.Iterations[strconv.Itoa(n)] = st.checkpointState(k)
+		}
+		for n, v := range f.iterationValues() {
+			l.Values[strconv.Itoa(n)] = v.Interface()
+		}
+		c.Loops[k.key(id)] = l
+	}
+	for name, v := range e.exportedValues {
+		c.Exports[name] = checkpointExport{e.exportVersions[name], v.Interface()}
+	}
+	return c
+}
+
+// iterations returns the states of the iterations of the loop, including the
+// current one.
+func (f *ForExecState) iterations() map[int]*ExecState {
+	states := make(map[int]*ExecState)
+	for n, st := range f.iterationResultMap {
+		states[n] = st
+	}
+	if f.currentIterationState != nil {
+		states[f.currentIterationNumber] = f.currentIterationState
+	}
+	return states
+}
+
+func (f *ForExecState) iterationValues() map[int]*ValueWrapper {
+	values := make(map[int]*ValueWrapper)
+	for n, v := range f.iterationValMap {
+		values[n] = v
+	}
+	if f.currentIterationVal != nil {
+		values[f.currentIterationNumber] = f.currentIterationVal
+	}
+	return values
+}
+
+// decodeCheckpoint reads a checkpoint written by Checkpoint for the playbook
+// whose node keys are k, and rejects it if it was written for another one. The states it returns share w.
+func decodeCheckpoint(data []byte, k *nodeKeys, w *stateWatch) (*checkpoint, *ExecState, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var c checkpoint
+	if err := dec.Decode(&c); err != nil {
+		return nil, nil, fmt.Errorf("error in reading checkpoint: %s", err.Error())
+	}
+	if c.Format != CheckpointFormat {
+		return nil, nil, fmt.Errorf("checkpoint format %d is not supported, expected %d", c.Format, CheckpointFormat)
+	}
+	if c.Playbook != k.hash {
+		return nil, nil, fmt.Errorf("checkpoint was taken for another playbook, its nodes do not match")
+	}
+	state, err := c.State.execState(k, w)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &c, state, nil
+}
+
+func (c checkpointState) execState(k *nodeKeys, w *stateWatch) (*ExecState, error) {
+	e := NewExecStateForAlert(c.Alert)
+	e.watch = w
+	e.version = c.Version
+	e.execStartTs = c.StartTs
+	e.execDoneTs = c.DoneTs
+	e.lastUpdateTs = c.LastUpdateTs
+	e.ErrStr = c.Error
+	for key, a := range c.Actions {
+		e.actionResults[k.id(key)] = &ActionExecState{
+			version:             a.Version,
+			waitingOnInput:      a.WaitingOnInput,
+			done:                a.Done,
+			errStr:              a.Error,
+			concreteInputParams: a.Params,
+			usedValues:          a.UsedValues,
+			actionResult:        a.Result,
+		}
+		if a.Done && a.Result == nil {
+			return nil, fmt.Errorf("error in reading checkpoint: node %s is done without a result", key)
+		}
+	}
+	for key, i := range c.Ifs {
+		if i.Values == nil {
+			i.Values = make(map[string]string)
+		}
+		e.ifResults[k.id(key)] = &IfExecState{i.Version, i.WaitingOnInput, i.Done, i.Error,
+			i.ConcreteCondition, i.Values, i.EvaluatedToTrue}
+	}
+	for key, l := range c.Loops {
+		f := &ForExecState{
+			version:                l.Version,
+			waitingOnInput:         l.WaitingOnInput,
+			done:                   l.Done,
+			currentIterationNumber: l.CurrentIteration,
+			iterationResultMap:     make(map[int]*ExecState),
+			iterationValMap:        make(map[int]*ValueWrapper),
+		}
+		for it, st := range l.Iterations {
+			n, err := strconv.Atoi(it)
+			if err != nil {
+				return nil, fmt.Errorf("error in reading checkpoint: loop %s has iteration %q", key, it)
+			}
+			if f.iterationResultMap[n], err = st.execState(k, w); err != nil {
+				return nil, err
+			}
+			f.iterationValMap[n] = WrapValue(l.Values[it])
+		}
+		// The current iteration is the last one started.
+		if st, ok := f.iterationResultMap[f.currentIterationNumber]; ok {
+			f.currentIterationState = st
+			f.currentIterationVal = f.iterationValMap[f.currentIterationNumber]
+			delete(f.iterationResultMap, f.currentIterationNumber)
+			delete(f.iterationValMap, f.currentIterationNumber)
+		}
+		e.forResults[k.id(key)] = f
+	}
+	for name, x := range c.Exports {
+		e.exportedValues[name] = WrapValue(x.Value)
+		e.exportVersions[name] = x.Version
+	}
+	return e, nil
+}
+
+// actionDone reports whether an action node is done, as it may be in the
+// state of a resumed execution.
+func (e *ExecState) actionDone(id string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	a, ok := e.actionResults[id]
+	return ok && a.done && a.errStr == ""
+}
+
+// ifEvaluated returns the branch an if node took, if its condition was
+// evaluated without error.
+func (e *ExecState) ifEvaluated(id string) (bool, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	i, ok := e.ifResults[id]
+	if !ok || !i.done || i.errStr != "" {
+		return false, false
+	}
+	return i.evaluatedToTrue, true
+}
+
+// loopProgress reports whether a loop is done, and returns the states of the
+// iterations it started.
+func (e *ExecState) loopProgress(id string) (bool, map[int]*ExecState) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	f, ok := e.forResults[id]
+	if !ok {
+		return false, nil
+	}
+	return f.done, f.iterations()
+}
+
+// Resume continues an execution from a checkpoint written by Checkpoint, for
+// the same playbook, whose nodes are matched by their position. Actions that
+// are done are not run again, and if nodes that were evaluated take the
+// branch they took, while the nodes that failed or had not finished run
+// again. The alert is the one of the checkpoint. It returns an error, without
+// running any node, when the checkpoint can not be read or was taken for a
+// playbook whose nodes are not the same.
+func (ex *Execution) Resume(data []byte) error {
+	c, state, err := decodeCheckpoint(data, newNodeKeys(ex.startNode), ex.execState.watch)
+	if err != nil {
+		return err
+	}
+	state.watch.mu.Lock()
+	if state.watch.version < c.Version {
+		state.watch.version = c.Version
+	}
+	state.watch.mu.Unlock()
+	ex.id = c.ExecutionID
+	ex.execState = state
+	ex.Start()
+	return nil
+}
+
+// SetCheckpointFile makes the execution write its checkpoint to path after
+// every change of its state. The file is replaced atomically, so it always
+// holds a whole checkpoint. Checkpoints are written by a goroutine of their
+// own, so the nodes do not wait for the file: when the state changes while
+// one is written, only the latest version is written next. The last version
+// is written before Start returns. Errors in writing it are logged. It must
+// be called before Start or Resume.
+func (ex *Execution) SetCheckpointFile(path string) {
+	ex.checkpointFile = path
+}
+
+// writeCheckpoints writes the checkpoint to the checkpoint file of the
+// execution whenever the state changes. It returns a function that writes
+// the last version, if it is not written yet, and stops.
+func (ex *Execution) writeCheckpoints() func() {
+	if ex.checkpointFile == "" {
+		return func() {}
+	}
+	changed := make(chan struct{}, 1)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	w := ex.execState.watch
+	w.mu.Lock()
+	w.onChange = func() {
+		// A change already signalled is written with this one.
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	w.mu.Unlock()
+
+	go func() {
+		defer close(stopped)
+		var written uint64
+		write := func() {
+			if w.current() == written {
+				return
+			}
+			data, version, err := ex.checkpoint()
+			if err == nil {
+				err = writeFileAtomic(ex.checkpointFile, data)
+			}
+			if err != nil {
+				logging.Error(ex.logger, "unable to write checkpoint", logging.F("execution", ex.id),
+					logging.F("file", ex.checkpointFile), logging.F("error", err))
+				return
+			}
+			written = version
+		}
+		for {
+			select {
+			case <-changed:
+				write()
+			case <-done:
+				write()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		w.mu.Lock()
+		w.onChange = nil
+		w.mu.Unlock()
+		close(done)
+		<-stopped
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// to path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,287 @@
+package execution
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"rptsec.com/amg/actionstore"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: vt
+  urn: urn:vt
+  params: {ip: "@alert:srcIp"}
+  exports: {malicious: raw.stats.malicious}
+- id: check
+  type: if
+  condition: "$malicious > 5"
+  onTrue:
+    - id: block
+      urn: urn:block
+      params: {ip: "@alert:srcIp", count: "$malicious"}
+`))
+	assert.Nil(err)
+	vt := actionstore.ActionMockScenario{ActionUrn: "urn:vt", Scenarios: []actionstore.MockScenario{{
+		Input:        map[string]string{"ip": "*"},
+		ActionResult: actionstore.ActionResult{ResultJSON: `{"stats": {"malicious": 7}}`},
+	}}}
+	block := actionstore.ActionMockScenario{ActionUrn: "urn:block", Scenarios: []actionstore.MockScenario{{
+		Input:        map[string]string{"ip": "*"},
+		ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"blocked": "true"}},
+	}}}
+
+	// The first run fails on block, which has no mock yet.
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "checkpoint.json")
+	ex := NewExecutionForAlert(p, map[string]interface{}{"srcIp": "10.0.0.1"},
+		actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{vt}))
+	ex.SetCheckpointFile(file)
+	ex.Start()
+	assert.EqualError(ex.Err(), "node block: No scenarios found in mock data")
+	data, err := ioutil.ReadFile(file)
+	assert.Nil(err)
+	checkpoint, err := ex.Checkpoint()
+	assert.Nil(err)
+	assert.JSONEq(string(checkpoint), string(data))
+	var decoded map[string]interface{}
+	assert.Nil(json.Unmarshal(data, &decoded))
+	assert.Equal(float64(CheckpointFormat), decoded["format"])
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(1, len(files))
+
+	// The resumed run only runs block, with the values of the first run.
+	as := actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{vt, block})
+	resumed := NewExecutionForAlert(p, nil, as)
+	assert.Nil(resumed.Resume(data))
+	assert.Nil(resumed.Err())
+	assert.Equal(ex.ID(), resumed.ID())
+	assert.Equal([]actionstore.ActionCall{{Urn: "urn:block",
+		Params: map[string]string{"ip": "10.0.0.1", "count": "7"}, Matched: true}}, as.Calls())
+	malicious := resumed.execState.ExportedValues()["malicious"]
+	assert.Equal(NumberValue, malicious.Kind)
+	blocked, ok := resumed.execState.NodeResult("block", "blocked")
+	assert.True(ok)
+	assert.Equal("true", blocked)
+	assert.True(resumed.Status(0).version > ex.Status(0).version)
+
+	hash := newNodeKeys(p.FirstNode).hash
+	for data, msg := range map[string]string{
+		`{"format": 2}`: "checkpoint format 2 is not supported, expected 1",
+		`[1]`:           "error in reading checkpoint",
+		`{"format": 1, "playbook": "` + hash + `", "state": {"actions": {"[0]": {"done": true}}}}`: "node [0] is done without a result",
+	} {
+		err := NewExecutionForAlert(p, nil, as).Resume([]byte(data))
+		if assert.NotNil(err, data) {
+			assert.Contains(err.Error(), msg, data)
+		}
+	}
+}
+
+func TestCheckpointFileOfParallelExecution(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- {id: a, urn: urn:lookup, params: {ip: "@alert:srcIp"}}
+- {id: b, urn: urn:lookup, params: {ip: "@alert:srcIp"}}
+- {id: c, urn: urn:lookup, params: {ip: "@alert:srcIp"}}
+- {id: d, urn: urn:lookup, params: {ip: "@node:a$score"}}
+`))
+	assert.Nil(err)
+	mocks := []actionstore.ActionMockScenario{{ActionUrn: "urn:lookup", Scenarios: []actionstore.MockScenario{{
+		Input:        map[string]string{"ip": "*"},
+		ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"score": "7"}},
+	}}}}
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "checkpoint.json")
+
+	ex := NewExecutionForAlert(p, map[string]interface{}{"srcIp": "10.0.0.1"},
+		actionstore.NewActionStoreFromScenarios(mocks))
+	ex.SetMaxParallel(4)
+	ex.SetCheckpointFile(file)
+	// The last checkpoint is written by the time the execution finishes.
+	var written []byte
+	ex.AddObserver(ObserverFunc(func(e Event) {
+		if e.Type == EventExecutionFinished {
+			written, _ = ioutil.ReadFile(file)
+		}
+	}))
+	ex.Start()
+	assert.Nil(ex.Err())
+	checkpoint, err := ex.Checkpoint()
+	assert.Nil(err)
+	assert.JSONEq(string(checkpoint), string(written))
+}
+
+func TestCheckpointOfAnotherPlaybook(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook := func(condition string) *Playbook {
+		p, err := NewPlaybookFromYaml([]byte(`
+- id: lookup
+  urn: urn:lookup
+  params: {ip: "@alert:srcIp"}
+- id: check
+  type: if
+  condition: "` + condition + `"
+  onTrue:
+    - {id: block, urn: urn:block}
+`))
+		assert.Nil(err)
+		return p
+	}
+	as := actionstore.NewActionStoreFromScenarios(nil)
+	ex := NewExecutionForAlert(playbook("@alert:srcIp == 10.0.0.1"), map[string]interface{}{"srcIp": "10.0.0.1"}, as)
+	ex.Start()
+	data, err := ex.Checkpoint()
+	assert.Nil(err)
+
+	assert.Nil(NewExecutionForAlert(playbook("@alert:srcIp == 10.0.0.1"), nil, as).Resume(data))
+	other := actionstore.NewActionStoreFromScenarios(nil)
+	resumed := NewExecutionForAlert(playbook("@alert:srcIp != 10.0.0.1"), nil, other)
+	assert.EqualError(resumed.Resume(data), "checkpoint was taken for another playbook, its nodes do not match")
+	assert.Equal(0, len(other.Calls()))
+}
+
+func TestCheckpointGeneratedIds(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlData := []byte(`
+- urn: urn:lookup
+  params: {ip: "@alert:srcIp"}
+- type: if
+  condition: "@alert:srcIp == 10.0.0.1"
+  onTrue:
+    - urn: urn:lookup
+      params: {ip: "@alert:srcIp"}
+`)
+	mocks := []actionstore.ActionMockScenario{{ActionUrn: "urn:lookup", Scenarios: []actionstore.MockScenario{{
+		Input:        map[string]string{"ip": "*"},
+		ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"score": "7"}},
+	}}}}
+	p, err := NewPlaybookFromYaml(yamlData)
+	assert.Nil(err)
+	ex := NewExecutionForAlert(p, map[string]interface{}{"srcIp": "10.0.0.1"},
+		actionstore.NewActionStoreFromScenarios(mocks))
+	ex.Start()
+	assert.Nil(ex.Err())
+	data, err := ex.Checkpoint()
+	assert.Nil(err)
+	assert.Contains(string(data), `"[1].onTrue[0]"`)
+
+	// The nodes of the playbook built again get other ids.
+	rebuilt, err := NewPlaybookFromYaml(yamlData)
+	assert.Nil(err)
+	assert.NotEqual(p.FirstNode.(*ActionNode).Id, rebuilt.FirstNode.(*ActionNode).Id)
+	as := actionstore.NewActionStoreFromScenarios(mocks)
+	resumed := NewExecutionForAlert(rebuilt, nil, as)
+	assert.Nil(resumed.Resume(data))
+	assert.Nil(resumed.Err())
+	assert.Equal(0, len(as.Calls()))
+	score, ok := resumed.execState.NodeResult(rebuilt.FirstNode.(*ActionNode).Id, "score")
+	assert.True(ok)
+	assert.Equal("7", score)
+}
+
+func TestCheckpointLoops(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewExecutionForAlert(&Playbook{}, map[string]interface{}{"ips": []interface{}{"a", "b"}},
+		actionstore.NewActionStoreFromScenarios(nil))
+	loop := &ForNode{GenericExecutionNode: GenericExecutionNode{"loop", ForNodeT, nil}}
+	state := ex.execState
+	state.startForLoop(loop, false)
+	for i, ip := range []string{"a", "b"} {
+		nested := newNestedExecState(state)
+		state.startForLoopIteration(loop, i+1, WrapStringValue(ip), nested)
+		nested.startActionExecution("lookup")
+		nested.updateSuccessResultForAction("lookup",
+			&actionstore.ActionResult{ResultFieldMap: map[string]string{"ip": ip}}, nil)
+	}
+	data, err := ex.Checkpoint()
+	assert.Nil(err)
+
+	c, restored, err := decodeCheckpoint(data, newNodeKeys(nil), newStateWatch())
+	assert.Nil(err)
+	assert.Equal(ex.ID(), c.ExecutionID)
+	ips, ok := restored.GetVal("@alert:ips")
+	assert.True(ok)
+	assert.Equal(ListValue, ips.Kind)
+	done, iterations := restored.loopProgress("loop")
+	assert.False(done)
+	assert.Equal(2, len(iterations))
+	for n, ip := range map[int]string{1: "a", 2: "b"} {
+		val, ok := iterations[n].NodeResult("lookup", "ip")
+		assert.True(ok)
+		assert.Equal(ip, val)
+	}
+	assert.Equal("b", restored.forResults["loop"].currentIterationVal.StringVal())
+}
+
+func TestResumeLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	// for nodes are not read from yaml yet, so the loop is built here.
+	lookup := &ActionNode{
+		GenericExecutionNode: GenericExecutionNode{"lookup", ActionNodeT, nil},
+		urn:                  "urn:lookup",
+		inputParams:          map[string]string{"host": "@alert:host"},
+	}
+	loop := &ForNode{
+		GenericExecutionNode: GenericExecutionNode{"loop", ForNodeT, nil},
+		IterateOnVar:         "@alert:ips",
+		FirstLoopNode:        lookup,
+	}
+	p := &Playbook{FirstNode: loop}
+	alert := map[string]interface{}{"host": "h", "ips": []interface{}{"a", "b", "c"}}
+	mocks := []actionstore.ActionMockScenario{{ActionUrn: "urn:lookup", Scenarios: []actionstore.MockScenario{{
+		Input:        map[string]string{"host": "*"},
+		ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"ok": "true"}},
+	}}}}
+
+	// Every iteration runs, up to the last one.
+	as := actionstore.NewActionStoreFromScenarios(mocks)
+	ex := NewExecutionForAlert(p, alert, as)
+	ex.Start()
+	assert.Nil(ex.Err())
+	assert.Equal(3, len(as.Calls()))
+	done, iterations := ex.execState.loopProgress("loop")
+	assert.True(done)
+	assert.Equal(3, len(iterations))
+
+	// A failed iteration fails the loop, which is not done.
+	ex = NewExecutionForAlert(p, alert, actionstore.NewActionStoreFromScenarios(nil))
+	ex.Start()
+	assert.EqualError(ex.Err(), "node lookup: No scenarios found in mock data")
+	done, iterations = ex.execState.loopProgress("loop")
+	assert.False(done)
+	assert.Equal(1, len(iterations))
+	data, err := ex.Checkpoint()
+	assert.Nil(err)
+
+	// The resumed loop runs the failed iteration again, and the others.
+	as = actionstore.NewActionStoreFromScenarios(mocks)
+	resumed := NewExecutionForAlert(p, nil, as)
+	assert.Nil(resumed.Resume(data))
+	assert.Nil(resumed.Err())
+	assert.Equal(3, len(as.Calls()))
+	done, _ = resumed.execState.loopProgress("loop")
+	assert.True(done)
+
+	// A finished loop is not run again.
+	data, err = resumed.Checkpoint()
+	assert.Nil(err)
+	as = actionstore.NewActionStoreFromScenarios(mocks)
+	assert.Nil(NewExecutionForAlert(p, nil, as).Resume(data))
+	assert.Equal(0, len(as.Calls()))
+}
@@ -2,48 +2,50 @@ package execution
 
 import (
 	"fmt"
-	"strconv"
 	"strings"
 )
 
-// Condition represents a conditional expression used in 'IF'.
+// Condition represents a conditional expression used in 'IF'. See expr.go for
+// the language.
 type Condition struct {
-	actualExpression   string
-	concreteExpression string
-	varResolutionList  []string
-	valueMap           map[string]*ValueWrapper
-	lhs                string
-	rhs                string
-	operator           string
+	actualExpression  string
+	varResolutionList []string
+	valueMap          map[string]*ValueWrapper
+	root              expr
+	// required are the vars that must have a value, see requiredVars
+	required map[string]bool
+	parseErr error
+	err      error
 }
 
 // NewCondition creates a new *Condition
 func NewCondition(expr string) *Condition {
-	// TODO: Compile the varResolutionMap
 	c := &Condition{
-		expr, "", make([]string, 0, 2), make(map[string]*ValueWrapper), "", "", "",
+		actualExpression:  expr,
+		varResolutionList: make([]string, 0, 2),
+		valueMap:          make(map[string]*ValueWrapper),
+		required:          make(map[string]bool),
 	}
 	c.parse()
 	return c
 }
 
 func (c *Condition) parse() {
-	// Currently only few forms are supported
-	// Plan is to use grammar and add more sophisticated evaluation
-	expr := c.actualExpression
-	binaryOperators := []string{"==", ">", ">=", "<", "<=", "!="}
-	for _, op := range binaryOperators {
-		if splitStr := strings.Split(expr, op); len(splitStr) == 2 {
-			c.operator = op
-			if c.lhs = strings.Trim(splitStr[0], " "); isResolutionNeeded(c.lhs) {
-				c.varResolutionList = append(c.varResolutionList, c.lhs)
-			}
-			if c.rhs = strings.Trim(splitStr[1], " "); isResolutionNeeded(c.rhs) {
-				c.varResolutionList = append(c.varResolutionList, c.rhs)
-			}
-			break
+	root, p, err := parseExpr(c.actualExpression)
+	if err != nil {
+		c.parseErr = err
+		return
+	}
+	switch root.(type) {
+	case *callExpr, *infixExpr:
+		if k := staticKind(root); k != AnyValue && k != BoolValue {
+			c.parseErr = fmt.Errorf("condition is a %s, not a boolean", k)
+			return
 		}
 	}
+	c.root = root
+	c.varResolutionList = append(c.varResolutionList, p.vars...)
+	requiredVars(root, c.required)
 }
 
 func isResolutionNeeded(token string) bool {
@@ -53,41 +55,106 @@ func isResolutionNeeded(token string) bool {
 	return false
 }
 
-func evaluateBinaryExpression(lhsVal string, rhsVal string, operator string) (bool, bool) {
-	lhsNum, err1 := strconv.Atoi(lhsVal)
-	rhsNum, err2 := strconv.Atoi(rhsVal)
-	var bothAreNumbers bool = (err1 == nil) && (err2 == nil)
+// Operands returns the left operand, the operator and the right operand of the
+// condition, as written. The operator is empty if the condition is not a
+// single comparison, such as "@alert:srcIp inCidr 10.0.0.0/8" or "$score > 50".
+func (c *Condition) Operands() (string, string, string) {
+	switch e := c.root.(type) {
+	case *compareExpr:
+		return e.lhsText, e.op, e.rhsText
+	case *infixExpr:
+		return e.lhsText, e.name, e.rhsText
+	}
+	return "", "", ""
+}
+
+// Comparison is a comparison of a condition, or a function written between
+// its operands, as written.
+type Comparison struct {
+	Lhs, Op, Rhs string
+	// OpPos is the offset of the operator in the condition
+	OpPos int
+}
+
+func (c Comparison) String() string {
+	return fmt.Sprintf("%s %s %s", c.Lhs, c.Op, c.Rhs)
+}
+
+// Comparisons returns the comparisons of the condition in the order they are
+// written, including those combined with and, or and not.
+func (c *Condition) Comparisons() []Comparison {
+	var comparisons []Comparison
+	walkExpr(c.root, func(e expr) {
+		if cmp, ok := comparisonOf(e); ok {
+			comparisons = append(comparisons, cmp)
+		}
+	})
+	return comparisons
+}
 
-	if bothAreNumbers {
-		return evaluateBinaryExprNumbers(lhsNum, rhsNum, operator), true
+// Requirement is the outcome a comparison must have.
+type Requirement struct {
+	Comparison
+	Want bool
+}
+
+// Requirements returns the ways the condition evaluates to want, each as the
+// outcomes of the comparisons evaluated on the way, in order. ok is false if
+// the condition is not made of comparisons combined with and, or and not.
+func (c *Condition) Requirements(want bool) (alternatives [][]Requirement, ok bool) {
+	return requirements(c.root, want)
+}
+
+func requirements(e expr, want bool) ([][]Requirement, bool) {
+	if cmp, ok := comparisonOf(e); ok {
+		return [][]Requirement{{{cmp, want}}}, true
+	}
+	switch e := e.(type) {
+	case *notExpr:
+		return requirements(e.x, !want)
+	case *logicalExpr:
+		lhs, ok := requirements(e.lhs, want)
+		if !ok {
+			return nil, false
+		}
+		rhs, ok := requirements(e.rhs, want)
+		if !ok {
+			return nil, false
+		}
+		if want != (e.op == "or") {
+			// Both sides are evaluated and must be want.
+			return joinRequirements(lhs, rhs), true
+		}
+		// Either the left side decides, or it does not and the right side
+		// is want.
+		other, ok := requirements(e.lhs, !want)
+		if !ok {
+			return nil, false
+		}
+		return append(lhs, joinRequirements(other, rhs)...), true
 	}
+	return nil, false
+}
 
-	switch operator {
-	case "==":
-		return strings.Compare(lhsVal, rhsVal) == 0, true
-	case "!=":
-		return strings.Compare(lhsVal, rhsVal) != 0, true
-	default:
-		return false, false
+// joinRequirements returns every alternative of a followed by one of b.
+func joinRequirements(a, b [][]Requirement) [][]Requirement {
+	var joined [][]Requirement
+	for _, x := range a {
+		for _, y := range b {
+			joined = append(joined, append(append([]Requirement{}, x...), y...))
+		}
 	}
+	return joined
 }
 
-func evaluateBinaryExprNumbers(lhs int, rhs int, op string) bool {
-	switch op {
-	case "==":
-		return lhs == rhs
-	case "!=":
-		return lhs != rhs
-	case ">":
-		return lhs > rhs
-	case ">=":
-		return lhs >= rhs
-	case "<":
-		return lhs < rhs
-	case "<=":
-		return lhs <= rhs
+func comparisonOf(e expr) (Comparison, bool) {
+	switch e := e.(type) {
+	case *compareExpr:
+		return Comparison{e.lhsText, e.op, e.rhsText, e.opPos}, true
+	case *infixExpr:
+		return Comparison{e.lhsText, e.name, e.rhsText, e.opPos}, true
 	}
-	return false
+	return Comparison{}, false
 }
 
 // UnknownVarsList returns the list of variables whose values are not known
@@ -100,25 +167,58 @@ func (c *Condition) SetVarValue(varName string, val *ValueWrapper) {
 	c.valueMap[varName] = val
 }
 
-// Evaluate the condition and return {result, possible}
+// Evaluate the condition and return {result, possible}. Operands are
+// compared with their types, see CompareValues, and the condition must
+// evaluate to a boolean, or to the string true or false.
 func (c *Condition) Evaluate() (bool, bool) {
-	var lhsVal string = c.lhs
-	if isResolutionNeeded(c.lhs) {
-		lhsV, present := c.valueMap[c.lhs]
-		if !present {
-			return false, false
-		}
-		lhsVal = lhsV.AsString()
+	if c.parseErr != nil {
+		return false, false
+	}
+	v, err := c.root.eval(c.valueMap)
+	if err != nil {
+		c.err = err
+		return false, false
+	}
+	result, ok := v.Bool()
+	if !ok {
+		c.err = fmt.Errorf("condition is %s %s, not a boolean", v.Kind, v.StringVal())
+		return false, false
 	}
-	var rhsVal string = c.rhs
-	if isResolutionNeeded(c.rhs) {
-		rhsV, present := c.valueMap[c.rhs]
-		if !present {
-			return false, false
+	c.err = nil
+	return result, true
+}
+
+// Err returns why the condition could not be parsed, or why the last
+// evaluation was not possible.
+func (c *Condition) Err() error {
+	if c.parseErr != nil {
+		return c.parseErr
+	}
+	return c.err
+}
+
+// Optional tells whether a variable of the condition may be left without a
+// value, because it is guarded by ?? or exists, only interpolated with a
+// default, or only used where it may not be evaluated.
+func (c *Condition) Optional(name string) bool {
+	if c.required[name] {
+		return false
+	}
+	for _, v := range c.varResolutionList {
+		if v == name {
+			return true
 		}
-		rhsVal = rhsV.AsString()
 	}
+	return false
+}
 
-	fmt.Printf("Evaluating expression: %s %s %s\n", lhsVal, c.operator, rhsVal)
-	return evaluateBinaryExpression(lhsVal, rhsVal, c.operator)
+// isPredicate tells whether the condition is more than a bare literal, which
+// is most likely a comparison missing its operator. A bare var is a predicate
+// when its value is a boolean, as in "@node:ac1$isKnownBad".
+func (c *Condition) isPredicate() bool {
+	switch c.root.(type) {
+	case *literalExpr, *templateExpr, *listExpr:
+		return false
+	}
+	return true
 }
@@ -0,0 +1,272 @@
+package execution
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionOperators(t *testing.T) {
+	assert := assert.New(t)
+	for expr, expected := range map[string]bool{
+		"5 == 5": true, "5 != 5": false, "6 > 5": true, "5 >= 5": true,
+		"4 < 5": true, "5 <= 4": false, "abc == abc": true, "abc != abd": true,
+		"50.5 > 50": true, "0.1 == 0.10": true, "true != false": true, "'a b' == 'a b'": true,
+	} {
+		c := NewCondition(expr)
+		result, ok := c.Evaluate()
+		assert.True(ok, expr)
+		assert.Equal(expected, result, expr)
+	}
+
+	lhs, op, rhs := NewCondition("@node:ac1$score >= 50").Operands()
+	assert.Equal([]string{"@node:ac1$score", ">=", "50"}, []string{lhs, op, rhs})
+
+	c := NewCondition("@alert:severity >= 7")
+	c.SetVarValue("@alert:severity", WrapStringValue("high"))
+	_, ok := c.Evaluate()
+	assert.False(ok)
+	assert.NotNil(c.Err())
+}
+
+func TestConditionExpressions(t *testing.T) {
+	assert := assert.New(t)
+
+	values := map[string]*ValueWrapper{
+		"@alert:srcIp":               WrapStringValue("192.168.1.7"),
+		"@alert:url":                 WrapStringValue("https://Login.Example.co.uk:8443/reset?x=1"),
+		"@alert:hash":                WrapStringValue("d41d8cd98f00b204e9800998ecf8427e"),
+		"@alert:tags":                WrapValue([]interface{}{"phishing", "finance"}),
+		"@alert:user":                WrapStringValue("Alice"),
+		`@alert:labels["a b"]`:       WrapStringValue("x"),
+		"@node:vt$raw.data.stats[0]": WrapValue(5),
+		"$score":                     WrapValue(50.5),
+	}
+	for expr, expected := range map[string]bool{
+		`@alert:srcIp inCidr "192.168.0.0/16"`:                   true,
+		`inCidr(@alert:srcIp, ["10.0.0.0/8", "172.16.0.0/12"])`:  false,
+		`isPrivateIp(@alert:srcIp) && $score > 50`:               true,
+		`not isPrivateIp(@alert:srcIp) or $score >= 60`:          false,
+		`!(@alert:user matches "^a")`:                            true,
+		`lower(@alert:user) matches "^a\w+$"`:                    true,
+		`@alert:tags contains "phishing"`:                        true,
+		`"finance" in @alert:tags and len(@alert:tags) == 2`:     true,
+		`@alert:user in [Bob, "Carol"]`:                          false,
+		`@alert:user startsWith Al && @alert:user endsWith "ce"`: true,
+		`domainOf(@alert:url) == "login.example.co.uk"`:          true,
+		`tld(@alert:url) == uk`:                                  true,
+		`hashType(@alert:hash) == md5 && isHash(@alert:hash)`:    true,
+		`isHash(@alert:user)`:                                    false,
+		`@alert:labels["a b"] == x`:                              true,
+		`@node:vt$raw.data.stats[0] > 3`:                         true,
+		`(1 == 2 or 2 == 2) and (3 == 3)`:                        true,
+		`"${@alert:user | lower}" == alice`:                      false,
+		`${@alert:user | lower} == alice`:                        true,
+	} {
+		c := NewCondition(expr)
+		if !assert.Nil(c.Err(), expr) {
+			continue
+		}
+		for _, v := range c.UnknownVarsList() {
+			c.SetVarValue(v, values[v])
+		}
+		result, ok := c.Evaluate()
+		assert.True(ok, "%s: %v", expr, c.Err())
+		assert.Equal(expected, result, expr)
+	}
+
+	c := NewCondition(`@alert:srcIp inCidr "10.0.0.0/8" or isPrivateIp($ip)`)
+	assert.Equal([]string{"@alert:srcIp", "$ip"}, c.UnknownVarsList())
+	lhs, op, rhs := NewCondition(`@alert:srcIp inCidr "10.0.0.0/8"`).Operands()
+	assert.Equal([]string{"@alert:srcIp", "inCidr", `"10.0.0.0/8"`}, []string{lhs, op, rhs})
+	_, op, _ = c.Operands()
+	assert.Equal("", op)
+
+	// The right hand side of or is not evaluated once the left one is true.
+	c = NewCondition(`1 == 1 or $missing == 2`)
+	result, ok := c.Evaluate()
+	assert.True(ok)
+	assert.True(result)
+}
+
+func TestConditionComparisons(t *testing.T) {
+	assert := assert.New(t)
+
+	cond := `$score > 50 and not (@alert:srcIp inCidr "10.0.0.0/8" or @alert:user == admin)`
+	c := NewCondition(cond)
+	var written []string
+	for _, cmp := range c.Comparisons() {
+		written = append(written, cmp.String())
+		assert.Equal(cmp.Op, cond[cmp.OpPos:cmp.OpPos+len(cmp.Op)])
+	}
+	assert.Equal([]string{"$score > 50", `@alert:srcIp inCidr "10.0.0.0/8"`, "@alert:user == admin"}, written)
+
+	describe := func(alternatives [][]Requirement) []string {
+		var described []string
+		for _, requirements := range alternatives {
+			var parts []string
+			for _, r := range requirements {
+				parts = append(parts, fmt.Sprintf("%s=%v", r.String(), r.Want))
+			}
+			described = append(described, strings.Join(parts, ", "))
+		}
+		return described
+	}
+	alternatives, ok := c.Requirements(true)
+	assert.True(ok)
+	assert.Equal([]string{
+		`$score > 50=true, @alert:srcIp inCidr "10.0.0.0/8"=false, @alert:user == admin=false`,
+	}, describe(alternatives))
+	alternatives, ok = c.Requirements(false)
+	assert.True(ok)
+	assert.Equal([]string{
+		"$score > 50=false",
+		`$score > 50=true, @alert:srcIp inCidr "10.0.0.0/8"=true`,
+		`$score > 50=true, @alert:srcIp inCidr "10.0.0.0/8"=false, @alert:user == admin=true`,
+	}, describe(alternatives))
+
+	_, ok = NewCondition("isPrivateIp(@alert:srcIp)").Requirements(true)
+	assert.False(ok)
+}
+
+func TestConditionDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	values := map[string]*ValueWrapper{
+		"@alert:score": WrapValue(70),
+		"@alert:owner": WrapValue(nil),
+		"@alert:user":  WrapStringValue("alice"),
+	}
+	for expr, expected := range map[string]bool{
+		"@alert:score ?? 0 > 50":                              true,
+		"@alert:missing ?? 0 > 50":                            false,
+		"@alert:missing ?? @alert:score ?? 0 == 70":           true,
+		`@alert:owner ?? "nobody" == nobody`:                  true,
+		"exists(@alert:score) and not exists(@alert:missing)": true,
+		"exists(@alert:owner)":                                false,
+		"exists(@alert:missing) and @alert:missing > 5":       false,
+		`${@alert:missing ?? "-"} == "-"`:                     true,
+	} {
+		c := NewCondition(expr)
+		if !assert.Nil(c.Err(), expr) {
+			continue
+		}
+		for _, v := range c.UnknownVarsList() {
+			c.SetVarValue(v, values[v])
+		}
+		result, ok := c.Evaluate()
+		assert.True(ok, "%s: %v", expr, c.Err())
+		assert.Equal(expected, result, expr)
+	}
+
+	c := NewCondition(`exists(@alert:a) and @alert:b > len(@alert:c ?? "") or @alert:d == 1`)
+	assert.Equal([]string{"@alert:a", "@alert:b", "@alert:c", "@alert:d"}, c.UnknownVarsList())
+	for v, optional := range map[string]bool{"@alert:a": true, "@alert:b": true, "@alert:c": true, "@alert:d": true} {
+		assert.Equal(optional, c.Optional(v), v)
+	}
+	c = NewCondition(`@alert:a > (@alert:b ?? @alert:c)`)
+	assert.False(c.Optional("@alert:a"))
+	assert.True(c.Optional("@alert:b"))
+	assert.False(c.Optional("@alert:c"))
+	assert.False(c.Optional("@alert:x"))
+
+	// A variable that is needed after all has no value.
+	c = NewCondition("exists(@alert:missing) or @alert:missing > 5")
+	_, ok := c.Evaluate()
+	assert.False(ok)
+	assert.EqualError(c.Err(), "@alert:missing has no value")
+	assert.NotNil(NewCondition("exists(@alert:a, @alert:b)").Err())
+}
+
+func TestConditionStringBooleans(t *testing.T) {
+	assert := assert.New(t)
+
+	values := map[string]*ValueWrapper{
+		"@node:ac1$isKnownBad": WrapStringValue("true"),
+		"@node:ac2$isKnownBad": WrapStringValue("false"),
+		"@alert:severity":      WrapStringValue("high"),
+	}
+	for expr, expected := range map[string]bool{
+		"@node:ac1$isKnownBad":                          true,
+		"@node:ac2$isKnownBad":                          false,
+		"not @node:ac1$isKnownBad":                      false,
+		"@node:ac1$isKnownBad and @node:ac2$isKnownBad": false,
+		"@node:ac1$isKnownBad or @node:ac2$isKnownBad":  true,
+		"!@node:ac2$isKnownBad && 1 < 2":                true,
+	} {
+		c := NewCondition(expr)
+		for _, name := range c.UnknownVarsList() {
+			c.SetVarValue(name, values[name])
+		}
+		result, ok := c.Evaluate()
+		assert.True(ok, expr)
+		assert.Nil(c.Err(), expr)
+		assert.Equal(expected, result, expr)
+	}
+
+	// Other strings are still not booleans.
+	for expr, msg := range map[string]string{
+		"@alert:severity":                          "condition is string high, not a boolean",
+		"@alert:severity and @node:ac1$isKnownBad": "and applies to booleans, not string high",
+	} {
+		c := NewCondition(expr)
+		for _, name := range c.UnknownVarsList() {
+			c.SetVarValue(name, values[name])
+		}
+		_, ok := c.Evaluate()
+		assert.False(ok, expr)
+		assert.EqualError(c.Err(), msg, expr)
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for expr, msg := range map[string]string{
+		"@alert:a ==":                       "unexpected end of expression",
+		"@alert:a == 1 1":                   `unexpected "1" at 14`,
+		"shout(@alert:a)":                   "unknown function shout",
+		"inCidr(@alert:a)":                  "inCidr takes 2 arguments, got 1",
+		`@alert:a == "x`:                    "unclosed string",
+		"(@alert:a == 1":                    "expected ) at 14",
+		"@alert:a = 1":                      `unexpected '=' at 9`,
+		"@alert:a in in":                    `unexpected "in" at 12`,
+		"@alert:a == [1, 2":                 "expected , or ] at 17",
+		`len("abc")`:                        "condition is a number, not a boolean",
+		`"a" in "abc"`:                      "argument 2 of in must be a list, got string abc",
+		`lower(@alert:a, 1)`:                "lower takes 1 arguments, got 2",
+		`len(@alert:a) > 1 and isHash([1])`: "argument 1 of isHash must be a string, got list",
+	} {
+		c := NewCondition(expr)
+		if assert.NotNil(c.Err(), expr) {
+			assert.Contains(c.Err().Error(), msg, expr)
+		}
+		_, ok := c.Evaluate()
+		assert.False(ok, expr)
+	}
+
+	for expr, msg := range map[string]string{
+		`inCidr("not-an-ip", "10.0.0.0/8")`: `inCidr: "not-an-ip" is not an IP address`,
+		`"x" matches "("`:                   "matches: invalid regex",
+		`1 and true`:                        "and applies to booleans, not number 1",
+	} {
+		c := NewCondition(expr)
+		assert.Nil(c.Err(), expr)
+		_, ok := c.Evaluate()
+		assert.False(ok, expr)
+		if assert.NotNil(c.Err(), expr) {
+			assert.Contains(c.Err().Error(), msg, expr)
+		}
+	}
+
+	// Arguments whose kind is only known once evaluated are checked before
+	// the call.
+	c := NewCondition("lower(@alert:a) == x")
+	assert.Nil(c.Err())
+	c.SetVarValue("@alert:a", WrapValue([]interface{}{"x"}))
+	_, ok := c.Evaluate()
+	assert.False(ok)
+	assert.EqualError(c.Err(), `argument 1 of lower must be a string, got list ["x"]`)
+}
@@ -0,0 +1,136 @@
+package execution
+
+import (
+	"encoding/json"
+	"time"
+
+	"rptsec.com/amg/actionstore"
+)
+
+// EventType names the step of an execution that an Event reports.
+type EventType string
+
+const (
+	// EventExecutionStarted is sent before the first node runs
+	EventExecutionStarted EventType = "ExecutionStarted"
+	// EventExecutionFinished is sent once no node runs any more, with the
+	// error that stopped the execution, if any
+	EventExecutionFinished EventType = "ExecutionFinished"
+	// EventNodeStarted is sent when a node starts to run
+	EventNodeStarted EventType = "NodeStarted"
+	// EventVarResolved is sent when a node gets the value of a variable,
+	// with the time it waited for it
+	EventVarResolved EventType = "VarResolved"
+	// EventActionRequest is sent when an action is called with its params
+	EventActionRequest EventType = "ActionRequest"
+	// EventActionResult is sent when an action succeeded, with its result
+	// and exports
+	EventActionResult EventType = "ActionResult"
+	// EventIfEvaluated is sent when the condition of an if node is
+	// evaluated, with the values it used
+	EventIfEvaluated EventType = "IfEvaluated"
+	// EventNodeFailed is sent when a node fails, with its error
+	EventNodeFailed EventType = "NodeFailed"
+)
+
+// Event reports a step of an execution. Only the fields that apply to its
+// type are set.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Duration is the time the step took: the whole execution, the wait for
+	// a variable, the call of an action or the evaluation of a condition,
+	// including the wait for its variables
+	Duration time.Duration `json:"duration,omitempty"`
+	NodeID   string        `json:"nodeId,omitempty"`
+	NodeType TypeOfNode    `json:"nodeType,omitempty"`
+	Urn      string        `json:"urn,omitempty"`
+	// Var and Value are the variable resolved
+	Var   string        `json:"var,omitempty"`
+	Value *ValueWrapper `json:"value,omitempty"`
+	// Params are the params of an action request
+	Params  map[string]string         `json:"params,omitempty"`
+	Result  *actionstore.ActionResult `json:"result,omitempty"`
+	Exports map[string]*ValueWrapper  `json:"exports,omitempty"`
+	// Condition, Values and Branch are the condition of an if node, the
+	// values of its variables and what it evaluated to. Branch is written
+	// only for EventIfEvaluated, and then even when false, as that is the
+	// onFalse branch.
+	Condition string            `json:"condition,omitempty"`
+	Values    map[string]string `json:"values,omitempty"`
+	Branch    bool              `json:"branch"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// MarshalJSON writes the event with branch only for EventIfEvaluated.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event Event
+	out := struct {
+		event
+		Branch *bool `json:"branch,omitempty"`
+	}{event: event(e)}
+	if e.Type == EventIfEvaluated {
+		out.Branch = &e.Branch
+	}
+	return json.Marshal(out)
+}
+
+// Observer is notified of the events of an execution. The events of nodes
+// that run at the same time are sent from their goroutines, so an observer
+// of such an execution must be safe for concurrent use. The execution waits
+// for OnEvent to return. The values, maps and results of an event are shared
+// with the execution and must not be changed.
+type Observer interface {
+	OnEvent(e Event)
+}
+
+// ObserverFunc adapts a function to an Observer.
+type ObserverFunc func(e Event)
+
+// OnEvent calls f(e).
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// AddObserver adds an observer notified of the events of the execution. It
+// must be called before Start.
+func (ex *Execution) AddObserver(o Observer) {
+	ex.observers = append(ex.observers, o)
+}
+
+// Events returns a channel that receives the events of the execution, and is
+// closed after EventExecutionFinished. The execution waits while the channel
+// holds buffer events, so they must be received. It must be called before
+// Start.
+func (ex *Execution) Events(buffer int) <-chan Event {
+	events := make(chan Event, buffer)
+	ex.AddObserver(ObserverFunc(func(e Event) {
+		events <- e
+		if e.Type == EventExecutionFinished {
+			close(events)
+		}
+	}))
+	return events
+}
+
+// emit logs an event and sends it to the observers.
+func (ex *Execution) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	ex.logEvent(e)
+	for _, o := range ex.observers {
+		o.OnEvent(e)
+	}
+}
+
+// resolve resolves a variable needed by a node, blocking until its value is
+// available, and reports it to the observers.
+func (ex *Execution) resolve(nodeID string, name string, execStateStack *ExecStateStack) (*ValueWrapper, error) {
+	start := time.Now()
+	val, err := execStateStack.ResolveOrBlock(name)
+	if err == nil {
+		ex.emit(Event{Type: EventVarResolved, Duration: time.Since(start), NodeID: nodeID, Var: name, Value: val})
+	}
+	return val, err
+}
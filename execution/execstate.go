@@ -1,67 +1,26 @@
 package execution
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"rptsec.com/amg/actionstore"
 )
 
-// ValueWrapper holds a value (as well as its type info) that is assigned to a variable.
-type ValueWrapper struct {
-	IsScalar bool
-	// IsJson   bool
-	S string
-	V []string
-}
-
-// WrapStringValue wraps a string into a *ValueWrapper
-func WrapStringValue(s string) *ValueWrapper {
-	return &ValueWrapper{
-		IsScalar: true,
-		S:        s,
-	}
-}
-
-// IterableString returns an array of string
-func (v *ValueWrapper) IterableString() []string {
-	if v.IsScalar {
-		return []string{v.S}
-	}
-	return v.V
-}
-
-// IterableWrappedVal returns an array of *ValueWrapper
-func (v *ValueWrapper) IterableWrappedVal() []*ValueWrapper {
-	if v.IsScalar {
-		return []*ValueWrapper{&ValueWrapper{IsScalar: true, S: v.S}}
-	}
-	r := make([]*ValueWrapper, len(v.V))
-	for i := 0; i < len(v.V); i++ {
-		r[i] = &ValueWrapper{IsScalar: true, S: v.V[i]}
-	}
-	return r
-}
-
-// StringVal gives the string value of the underlying object being held.
-func (v *ValueWrapper) StringVal() string {
-	if v.IsScalar {
-		return v.S
-	}
-	return strings.Join(v.V, ",")
-}
-
-// AsString gives the string value of the underlying object being held.
-func (v *ValueWrapper) AsString() string {
-	return v.StringVal()
-}
-
 // -----------------------------------------------------------------------
 
 // -----------------------------------------------------------------------
 
 type ExecState struct {
+	// mu guards the state, which the nodes running at the same time update
+	mu sync.RWMutex
+	// version is the version of the execution at the last change of the
+	// state. The entries of the state are stamped with the version of their
+	// last change.
 	version        uint64
 	execStartTs    int64
 	execDoneTs     int64
@@ -71,14 +30,25 @@ type ExecState struct {
 	ifResults      map[string]*IfExecState
 	forResults     map[string]*ForExecState
 	exportedValues map[string]*ValueWrapper
-	alertData      map[string]*ValueWrapper
+	exportVersions map[string]uint64
+	// alert is the alert payload as decoded from JSON
+	alert map[string]interface{}
+	// watch is shared with the nested states, and wakes the readers waiting
+	// for values when any of them changes
+	watch *stateWatch
 }
 
 // NewExecState creates new *ExecState
 func NewExecState(initialVarValues map[string]string) *ExecState {
-	initialBagOfVal := make(map[string]*ValueWrapper)
-	for varName, val := range initialVarValues {
-		initialBagOfVal[varName] = &ValueWrapper{IsScalar: true, S: val}
+	return NewExecStateForAlert(AlertFromStrings(initialVarValues))
+}
+
+// NewExecStateForAlert creates a new *ExecState for an alert payload decoded
+// from JSON. Its fields are read with @alert: paths such as
+// @alert:observables[0].value.
+func NewExecStateForAlert(alert map[string]interface{}) *ExecState {
+	if alert == nil {
+		alert = make(map[string]interface{})
 	}
 	return &ExecState{
 		version:        0,
@@ -88,67 +58,130 @@ func NewExecState(initialVarValues map[string]string) *ExecState {
 		ifResults:      make(map[string]*IfExecState),
 		forResults:     make(map[string]*ForExecState),
 		exportedValues: make(map[string]*ValueWrapper),
-		alertData:      initialBagOfVal,
+		exportVersions: make(map[string]uint64),
+		alert:          alert,
+		watch:          newStateWatch(),
 	}
 }
 
+// newNestedExecState creates the *ExecState of a nested block, such as a
+// loop iteration, whose changes wake the readers of parent.
+func newNestedExecState(parent *ExecState) *ExecState {
+	e := NewExecStateForAlert(nil)
+	e.watch = parent.watch
+	return e
+}
+
 // SetDoneWithError is called by a node to mark failure for that track.
 func (e *ExecState) SetDoneWithError(errStr string) {
+	e.mu.Lock()
 	e.ErrStr = errStr
 	e.execDoneTs = time.Now().Unix()
-	e.lastUpdateTs = e.execDoneTs
-	e.version++
+	e.changed()
+	e.mu.Unlock()
+	e.watch.notify()
+}
+
+// changed stamps a change of the state with the next version of the
+// execution, and returns it. It is called with e.mu held.
+func (e *ExecState) changed() uint64 {
+	e.version = e.watch.tick()
+	e.lastUpdateTs = time.Now().Unix()
+	return e.version
+}
+
+// Version returns the version of the execution at the last change of the
+// state, to pass to Execution.Status to get the changes made after it.
+func (e *ExecState) Version() int64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return int64(e.version)
+}
+
+// setExports sets exported values.
+func (e *ExecState) setExports(exports map[string]*ValueWrapper) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	v := e.changed()
+	for k, val := range exports {
+		e.exportedValues[k] = val
+		e.exportVersions[k] = v
+	}
+}
+
+// errNotResolved is returned by ResolveVal for a variable whose value may
+// still be set.
+var errNotResolved = errors.New("not resolved yet")
+
+// ResolutionError is returned for a variable that can never be resolved, eg.
+// a path that is missing from the alert or from the result of a node that is
+// done, or the result of a node that failed.
+type ResolutionError struct {
+	Var    string
+	Reason string
+}
+
+func (e *ResolutionError) Error() string {
+	return fmt.Sprintf("unable to resolve %s: %s", e.Var, e.Reason)
 }
 
 // GetVal returns a value associated with the variable name.
 func (e *ExecState) GetVal(varName string) (*ValueWrapper, bool) {
+	val, err := e.ResolveVal(varName)
+	return val, err == nil
+}
+
+// ResolveVal returns the value of a variable. The error is a
+// *ResolutionError when the variable can never be resolved.
+func (e *ExecState) ResolveVal(varName string) (*ValueWrapper, error) {
 	prefix := varName[0]
 	switch prefix {
 	case '@':
 		// Look in alerts, and enrichment data
 		if strings.HasPrefix(varName, "@alert:") {
 			name := varName[len("@alert")+1:]
-			fmt.Printf("Looking for var: %s in alert data %v\n", name, e.alertData)
-			if val, ok := e.alertData[name]; ok {
-				return val, true
+			val, err := resolvePath(e.alert, name, "the alert")
+			if err != nil {
+				return nil, &ResolutionError{varName, err.Error()}
 			}
-			return nil, false
+			return val, nil
 		}
 		if strings.HasPrefix(varName, "@node:") {
+			e.mu.RLock()
+			defer e.mu.RUnlock()
 			nameWithNodeID := varName[len("@nodeId:")-2:]
-			fmt.Printf("Looking for node value: %s\n", nameWithNodeID)
-			nodeIDAndVarName := strings.Split(nameWithNodeID, "$")
+			nodeIDAndVarName := strings.SplitN(nameWithNodeID, "$", 2)
+			if len(nodeIDAndVarName) != 2 {
+				return nil, &ResolutionError{varName, "expected @node:<id>$<field>"}
+			}
 			nodeID := nodeIDAndVarName[0]
-			varName := nodeIDAndVarName[1]
-			fmt.Printf("NodeID: |%s|, varName: |%s| in %v\n", nodeID, varName, e.actionResults)
+			field := nodeIDAndVarName[1]
 			nodeState, ok := e.actionResults[nodeID]
 			if !ok {
-				return nil, false
-			}
-			fmt.Printf("Node state: %v", nodeState)
-			if !nodeState.done {
-				return nil, false
+				return nil, errNotResolved
 			}
 			if nodeState.errStr != "" {
-				return nil, false
+				return nil, &ResolutionError{varName, fmt.Sprintf("node %s failed", nodeID)}
 			}
-			if varName == "raw" {
-				return &ValueWrapper{IsScalar: true, S: nodeState.actionResult.ResultJSON}, true
+			if !nodeState.done {
+				return nil, errNotResolved
 			}
-			if val, ok := nodeState.actionResult.ResultFieldMap[varName]; ok {
-				return &ValueWrapper{IsScalar: true, S: val}, true
+			val, err := resultValue(nodeState.actionResult, field)
+			if err != nil {
+				return nil, &ResolutionError{varName, fmt.Sprintf("node %s: %s", nodeID, err.Error())}
 			}
-			return nil, false
+			return val, nil
 		}
 
 	case '$':
 		// Look in exported vars
 		varName = varName[1:]
-		fmt.Printf("Looking for var: %s in %v\n", varName, e.exportedValues)
+		e.mu.RLock()
+		defer e.mu.RUnlock()
 		if val, ok := e.exportedValues[varName]; ok {
-			return val, true
+			return val, nil
 		}
-		return nil, false
+		return nil, errNotResolved
 	}
 
 	// varName = varName[1:]
@@ -183,14 +216,56 @@ func (e *ExecState) GetVal(varName string) (*ValueWrapper, bool) {
 	// 	fmt.Println("Request a field value thats not present after action successful completion")
 	// 	return nil, false
 	// }
-	return nil, false
+	return nil, errNotResolved
+}
+
+func isRawPath(field string) bool {
+	return strings.HasPrefix(field, "raw.") || strings.HasPrefix(field, "raw[")
+}
+
+// resultValue returns a field of the result of an action: "raw" is the raw
+// result, "raw.<path>" a path into it, and any other name an output field.
+func resultValue(ar *actionstore.ActionResult, field string) (*ValueWrapper, error) {
+	if field == "raw" {
+		return WrapStringValue(ar.ResultJSON), nil
+	}
+	if isRawPath(field) {
+		path := strings.TrimPrefix(field[len("raw"):], ".")
+		if ar.ResultJSON == "" {
+			return nil, errors.New("the result has no outputJson")
+		}
+		dec := json.NewDecoder(strings.NewReader(ar.ResultJSON))
+		dec.UseNumber()
+		var doc interface{}
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("the result is not JSON: %s", err.Error())
+		}
+		return resolvePath(doc, path, "the result")
+	}
+	if val, ok := ar.ResultFieldMap[field]; ok {
+		return WrapStringValue(val), nil
+	}
+	return nil, fmt.Errorf("the result has no output field %q", field)
+}
+
+// ExportedValues returns a copy of the values exported so far.
+func (e *ExecState) ExportedValues() map[string]*ValueWrapper {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	exports := make(map[string]*ValueWrapper, len(e.exportedValues))
+	for k, v := range e.exportedValues {
+		exports[k] = v
+	}
+	return exports
 }
 
 // NodeResult retrieves result for an executed node.
 func (e *ExecState) NodeResult(nodeID string, fieldName string) (string, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	// fmt.Printf("Action result of the node: %+v", e.actionResults)
 	valW, ok := e.actionResults[nodeID]
-	if ok {
+	if ok && valW.actionResult != nil {
 		return valW.actionResult.ResultFieldMap[fieldName], ok
 	}
 	return "", false
@@ -211,6 +286,7 @@ func (e *ExecState) NodeResult(nodeID string, fieldName string) (string, bool) {
 
 // ForExecState holds data can be sent back to UI regarding execution of action node
 type ForExecState struct {
+	version                     uint64
 	waitingOnInput              bool
 	done                        bool
 	currentIterationNumber      int
@@ -223,6 +299,7 @@ type ForExecState struct {
 
 // Method to denote the start of execution for For Loop.
 func (e *ExecState) startForLoop(fNode *ForNode, waitingOnInput bool) {
+	e.mu.Lock()
 	e.forResults[fNode.Id] = &ForExecState{
 		waitingOnInput:              waitingOnInput,
 		done:                        false,
@@ -230,11 +307,17 @@ func (e *ExecState) startForLoop(fNode *ForNode, waitingOnInput bool) {
 		currentIterationVal:         nil,
 		lastExportedProgressVersion: 0,
 		currentIterationState:       nil,
+		iterationResultMap:          make(map[int]*ExecState),
+		iterationValMap:             make(map[int]*ValueWrapper),
+		version:                     e.changed(),
 	}
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 func (e *ExecState) startForLoopIteration(
 	fNode *ForNode, itNum int, itVal *ValueWrapper, nestedState *ExecState) {
+	e.mu.Lock()
 	var forState *ForExecState = e.forResults[fNode.Id]
 
 	// Freeze and Store previous iteration state.
@@ -247,15 +330,19 @@ func (e *ExecState) startForLoopIteration(
 	forState.currentIterationNumber = itNum
 	forState.currentIterationVal = itVal
 	forState.currentIterationState = nestedState
-
-	// Increase the version so that the next export picks up the changes.
-	forState.currentIterationState.version++
+	forState.version = e.changed()
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 func (e *ExecState) endForLoop(nodeId string) {
+	e.mu.Lock()
 	var forState *ForExecState = e.forResults[nodeId]
 	forState.done = true
+	forState.version = e.changed()
 	// TODO: Export values into ExecState.
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 // ***************** End of FOR-loop related methods **************************
@@ -266,6 +353,7 @@ func (e *ExecState) endForLoop(nodeId string) {
 
 // ActionExecState holds data can be sent back to UI regarding execution of action node
 type ActionExecState struct {
+	version uint64
 	// Waiting on input arg's values to be available
 	waitingOnInput bool
 	// Set when execution is finished
@@ -281,46 +369,63 @@ type ActionExecState struct {
 }
 
 func (e *ExecState) startActionExecution(id string) {
+	e.mu.Lock()
 	actionES := &ActionExecState{
 		waitingOnInput:      true,
 		done:                false,
 		concreteInputParams: nil,
 		actionResult:        nil,
+		version:             e.changed(),
 	}
 	e.actionResults[id] = actionES
 	// fmt.Printf("Starting execution for action: %+s\n", id)
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 // UpdateConcreteParamsForActionExecution is called when the action has resolved an input param.
 // It can be called each time an input param is resolved, or called once when all have been resolved.
 func (e *ExecState) UpdateConcreteParamsForActionExecution(
 	id string, valMap map[string]string, allParamsResolved bool) {
+	e.mu.Lock()
 	actionES := e.actionResults[id]
 	actionES.waitingOnInput = !allParamsResolved
+	actionES.version = e.changed()
 	if actionES.concreteInputParams == nil {
 		actionES.concreteInputParams = make(map[string]string)
 	}
 	for varName, resolvedVal := range valMap {
 		actionES.concreteInputParams[varName] = resolvedVal
 	}
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 func (e *ExecState) updateSuccessResultForAction(
 	id string, result *actionstore.ActionResult, exports map[string]*ValueWrapper) {
+	e.mu.Lock()
 	// fmt.Println("Updating success result for action")
 	actionES := e.actionResults[id]
 	actionES.actionResult = result
 	actionES.done = true
+	actionES.version = e.changed()
 
 	// Use the 'exports' to update the exports at the execState level
 	for k, v := range exports {
 		e.exportedValues[k] = v
+		e.exportVersions[k] = actionES.version
 	}
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 func (e *ExecState) updateErrorResultForAction(id string, errStr string) {
+	e.mu.Lock()
 	actionES := e.actionResults[id]
 	actionES.errStr = errStr
+	actionES.version = e.changed()
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 // ************** End of ACTION execution related methods **********************
@@ -328,6 +433,7 @@ func (e *ExecState) updateErrorResultForAction(id string, errStr string) {
 
 // IfExecState holds data can be sent back to UI regarding execution of action node
 type IfExecState struct {
+	version           uint64
 	waitingOnInput    bool
 	done              bool
 	errStr            string
@@ -337,24 +443,32 @@ type IfExecState struct {
 }
 
 func (e *ExecState) startIfNodeExecution(id string) {
+	e.mu.Lock()
 	e.ifResults[id] = &IfExecState{
-		true, false, "", "", make(map[string]string), false}
-	e.version++
+		e.changed(), true, false, "", "", make(map[string]string), false}
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 func (e *ExecState) updateIfNodeEvaluation(id string, yesPath bool, varValuesUsed map[string]string) {
+	e.mu.Lock()
 	ifState := e.ifResults[id]
+	ifState.waitingOnInput = false
 	ifState.done = true
 	ifState.varValues = varValuesUsed
 	ifState.evaluatedToTrue = yesPath
-
-	e.version++
+	ifState.version = e.changed()
+	e.mu.Unlock()
+	e.watch.notify()
 }
 
 func (e *ExecState) updateIfNodeEvaluationError(id string, errStr string) {
+	e.mu.Lock()
 	ifState := e.ifResults[id]
+	ifState.waitingOnInput = false
 	ifState.done = true
 	ifState.errStr = errStr
-
-	e.version++
+	ifState.version = e.changed()
+	e.mu.Unlock()
+	e.watch.notify()
 }
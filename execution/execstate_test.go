@@ -2,6 +2,7 @@ package execution
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"rptsec.com/amg/actionstore"
@@ -23,3 +24,130 @@ func TestExecState_Basic(t *testing.T) {
 	assert.Equal(val, "50")
 
 }
+
+func TestResolveOrBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	state := NewExecStateForAlert(map[string]interface{}{"srcIp": "10.0.0.1"})
+	stack := NewExecStateStack([]*ExecState{state})
+	exports := map[string]string{"score": "reputationScore"}
+
+	// Nothing is expected to produce the values.
+	_, err := stack.ResolveOrBlock("$score")
+	assert.EqualError(err, "unable to resolve $score: no node that exports it has run")
+	_, err = stack.ResolveOrBlock("@node:vt$reputationScore")
+	assert.EqualError(err, "unable to resolve @node:vt$reputationScore: node vt has not run")
+
+	// A reader wakes up when the node it waits for is done.
+	state.watch.expect("vt", exports)
+	type result struct {
+		val *ValueWrapper
+		err error
+	}
+	results := make(chan result, 2)
+	for _, name := range []string{"$score", "@node:vt$reputationScore"} {
+		go func(name string) {
+			val, err := stack.ResolveOrBlock(name)
+			results <- result{val, err}
+		}(name)
+	}
+	state.startActionExecution("vt")
+	ar := &actionstore.ActionResult{ResultFieldMap: map[string]string{"reputationScore": "50"}}
+	stack.ExportUp(map[string]*ValueWrapper{"score": WrapStringValue("50")})
+	state.updateSuccessResultForAction("vt", ar, nil)
+	state.watch.settle("vt", exports)
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if assert.Nil(r.err) {
+			assert.Equal("50", r.val.StringVal())
+		}
+	}
+
+	// And as soon as the node can not produce the value any more.
+	state.watch.expect("whois", nil)
+	go func() {
+		_, err := stack.ResolveOrBlock("@node:whois$owner")
+		results <- result{nil, err}
+	}()
+	state.startActionExecution("whois")
+	state.updateErrorResultForAction("whois", "timeout")
+	state.watch.settle("whois", nil)
+	r := <-results
+	assert.EqualError(r.err, "unable to resolve @node:whois$owner: node whois failed")
+}
+
+func TestStatusSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	ex := NewExecutionForAlert(&Playbook{}, nil, actionstore.NewActionStoreFromScenarios(nil))
+	state := ex.execState
+	state.startActionExecution("a")
+	state.startActionExecution("b")
+	first := ex.Status(0)
+	assert.Equal(int64(2), first.Version())
+	assert.Equal(2, len(first.actionResults))
+
+	ar := &actionstore.ActionResult{ResultFieldMap: map[string]string{"score": "50"}}
+	state.updateSuccessResultForAction("a", ar, map[string]*ValueWrapper{"score": WrapStringValue("50")})
+
+	// The snapshot is not changed by the execution.
+	assert.False(first.actionResults["a"].done)
+	assert.Empty(first.ExportedValues())
+
+	// Only what changed since the last snapshot is returned.
+	next := ex.Status(first.Version())
+	assert.Equal(int64(3), next.Version())
+	assert.Equal(1, len(next.actionResults))
+	score, ok := next.NodeResult("a", "score")
+	assert.True(ok)
+	assert.Equal("50", score)
+	assert.Equal("50", next.ExportedValues()["score"].StringVal())
+	state.updateSuccessResultForAction("a", &actionstore.ActionResult{}, nil)
+	score, _ = next.NodeResult("a", "score")
+	assert.Equal("50", score)
+	assert.Empty(ex.Status(ex.Status(0).Version()).actionResults)
+
+	// Snapshots can be taken while the nodes run.
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: a
+  urn: urn:lookup
+  exports: {score: score}
+- id: b
+  urn: urn:lookup
+- id: c
+  urn: urn:lookup
+  params: {ip: "$score"}
+`))
+	assert.Nil(err)
+	as := actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{
+		{ActionUrn: "urn:lookup", ExecutionDurationSecs: 1, Scenarios: []actionstore.MockScenario{{
+			ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"score": "7"}},
+		}}},
+	})
+	as.SimulateLatency(5 * time.Millisecond)
+	ex = NewExecutionForAlert(p, nil, as)
+	ex.SetMaxParallel(2)
+	done := make(chan struct{})
+	go func() {
+		ex.Start()
+		close(done)
+	}()
+	seen := make(map[string]bool)
+	var version int64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		s := ex.Status(version)
+		for id, a := range s.actionResults {
+			if a.done {
+				seen[id] = true
+			}
+		}
+		version = s.Version()
+	}
+	assert.Nil(ex.Err())
+	assert.Equal(map[string]bool{"a": true, "b": true, "c": true}, seen)
+}
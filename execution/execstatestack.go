@@ -1,7 +1,5 @@
 package execution
 
-import "time"
-
 type ExecStateStack struct {
 	execStates []*ExecState
 }
@@ -17,41 +15,74 @@ func NewExecStateStack(execStates []*ExecState) *ExecStateStack {
 
 // NewNestedStack adds a new *ExecState and returns a new *ExecStateStack
 func (st *ExecStateStack) NewNestedStack() *ExecStateStack {
-	newStates := st.execStates
-	newStates[len(newStates)+1] = NewExecState(nil)
+	return st.nestedStackWith(newNestedExecState(st.Top()))
+}
+
+// nestedStackWith returns a new *ExecStateStack with nested on top.
+func (st *ExecStateStack) nestedStackWith(nested *ExecState) *ExecStateStack {
+	newStates := make([]*ExecState, len(st.execStates), len(st.execStates)+1)
+	copy(newStates, st.execStates)
+	newStates = append(newStates, nested)
 	return &ExecStateStack{execStates: newStates}
 }
 
 // GetValue gets a value if present, else returns immediately
 func (st *ExecStateStack) GetValue(name string) (*ValueWrapper, bool) {
+	val, err := st.resolve(name)
+	return val, err == nil
+}
+
+// resolve looks for a value from the top of the stack down. The error is a
+// *ResolutionError if no state has the value and one of them never will.
+func (st *ExecStateStack) resolve(name string) (*ValueWrapper, error) {
+	var resErr error = errNotResolved
 	for i := len(st.execStates) - 1; i >= 0; i-- {
 		execState := st.execStates[i]
-		val, present := execState.GetVal(name)
-		if present {
-			return val, true
+		val, err := execState.ResolveVal(name)
+		if err == nil {
+			return val, nil
+		}
+		if _, ok := err.(*ResolutionError); ok && resErr == errNotResolved {
+			resErr = err
 		}
 	}
-	return nil, false
+	return nil, resErr
 }
 
 // GetValueOrBlock blocks the caller until value is available
-func (st *ExecStateStack) GetValueOrBlock(name string, timeoutSecs int) (*ValueWrapper, bool) {
-	for totalWaitSeconds := 0; totalWaitSeconds <= timeoutSecs; totalWaitSeconds += 2 {
-		if val, present := st.GetValue(name); present {
-			return val, present
+func (st *ExecStateStack) GetValueOrBlock(name string) (*ValueWrapper, bool) {
+	val, err := st.ResolveOrBlock(name)
+	return val, err == nil
+}
+
+// ResolveOrBlock blocks the caller until value is available. It wakes up on
+// every change of the states, and returns a *ResolutionError as soon as the
+// value can never be resolved, including when no node expected to run may
+// produce it.
+func (st *ExecStateStack) ResolveOrBlock(name string) (*ValueWrapper, error) {
+	w := st.Top().watch
+	for {
+		// The values of the nodes are written before they settle, so a
+		// node that settles between the checks leaves its value to resolve.
+		changed := w.next()
+		reason := w.unproducible(name)
+		val, err := st.resolve(name)
+		if err != errNotResolved {
+			return val, err
 		}
-		time.Sleep(2 * time.Millisecond)
+		if reason != "" {
+			return nil, &ResolutionError{name, reason}
+		}
+		<-changed
 	}
-	return nil, false
 }
 
 // ExportUp exports a var-value pair to upper levels
 func (st *ExecStateStack) ExportUp(exports map[string]*ValueWrapper) {
 	for _, execSt := range st.execStates {
-		for varName, varValue := range exports {
-			execSt.exportedValues[varName] = varValue
-		}
+		execSt.setExports(exports)
 	}
+	st.Top().watch.notify()
 }
 
 // Top returns the topmost *ExecState in the stack
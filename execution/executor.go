@@ -1,15 +1,21 @@
 package execution
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/logging"
 )
 
 // Execution represents an instance of playbook execution
 type Execution struct {
+	id                    string
 	startNode             Node
 	as                    *actionstore.ActionStore
 	execState             *ExecState
@@ -18,66 +24,210 @@ type Execution struct {
 	err                   bool
 	errStr                string
 	totalActionExecutions int
+	// maxParallel is the number of actions that may run at the same time,
+	// with the nodes run one after the other when it is at most 1
+	maxParallel int
+	// slots holds a value for every action running when maxParallel > 1
+	slots chan struct{}
+	// mu guards the fields the nodes running at the same time update
+	mu          sync.Mutex
+	running     int
+	peakRunning int
+	observers   []Observer
+	logger      logging.Logger
+	// stopped is set by Stop
+	stopped int32
+	// checkpointFile is where the checkpoint is written, see SetCheckpointFile
+	checkpointFile string
 }
 
+// executionCount numbers the executions for their ids.
+var executionCount int64
+
 // NewExecution creates an instance of Execution
 func NewExecution(p *Playbook, initialVarValues map[string]string, mockScenarioFile string) *Execution {
 	as := actionstore.NewActionStore(mockScenarioFile)
 	if as == nil {
-		_, _ = fmt.Println("error in creating ActionStore instance")
 		return nil
 	}
-	return &Execution{p.FirstNode, as, NewExecState(initialVarValues), 0, 0, false, "", 0}
+	return NewExecutionWithActionStore(p, initialVarValues, as)
+}
+
+// NewExecutionWithActionStore creates an instance of Execution that runs its
+// actions against an already built *actionstore.ActionStore
+func NewExecutionWithActionStore(
+	p *Playbook, initialVarValues map[string]string, as *actionstore.ActionStore) *Execution {
+	return NewExecutionForAlert(p, AlertFromStrings(initialVarValues), as)
+}
+
+// NewExecutionForAlert creates an instance of Execution for an alert payload
+// decoded from JSON, that runs its actions against as
+func NewExecutionForAlert(p *Playbook, alert map[string]interface{}, as *actionstore.ActionStore) *Execution {
+	return &Execution{
+		id:        strconv.FormatInt(atomic.AddInt64(&executionCount, 1), 10),
+		startNode: p.FirstNode,
+		as:        as,
+		execState: NewExecStateForAlert(alert),
+		logger:    logging.Default(),
+	}
+}
+
+// ID returns the id of the execution, which its messages are logged with.
+func (ex *Execution) ID() string {
+	return ex.id
+}
+
+// SetLogger sets the logger of the messages of the execution, which is
+// logging.Default() when it is created. It must be called before Start.
+func (ex *Execution) SetLogger(l logging.Logger) {
+	ex.logger = l
+}
+
+// SetMaxParallel makes the execution run the nodes that do not depend on each
+// other at the same time, with up to n actions running at once. A node
+// depends on the nodes before it whose results or exported vars it reads,
+// and on those that read or write what it writes. With n <= 1, the default,
+// the nodes run one after the other. It must be called before Start.
+func (ex *Execution) SetMaxParallel(n int) {
+	ex.maxParallel = n
+	ex.slots = nil
+	if n > 1 {
+		ex.slots = make(chan struct{}, n)
+	}
+}
+
+// PeakConcurrency returns the largest number of actions that ran at the same
+// time.
+func (ex *Execution) PeakConcurrency() int {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return ex.peakRunning
 }
 
 // Start the execution
 func (ex *Execution) Start() {
-	// Print the urns of the action nodes.
-	ex.startTs = time.Now().Unix()
+	start := time.Now()
+	ex.startTs = start.Unix()
+	ex.emit(Event{Type: EventExecutionStarted, Time: start})
+	flushCheckpoints := ex.writeCheckpoints()
 	stack := []*ExecState{ex.execState}
 	execStateStack := NewExecStateStack(stack)
-	ex.executeSeriallyFrom(ex.startNode, execStateStack)
+	if !ex.executeSeriallyFrom(ex.startNode, execStateStack) {
+		ex.err = true
+		if ex.errStr == "" {
+			ex.errStr = "Execution stopped due to a failed node"
+		}
+	}
+	ex.doneTs = time.Now().Unix()
+	flushCheckpoints()
+	finished := Event{Type: EventExecutionFinished, Duration: time.Since(start)}
+	if ex.err {
+		finished.Error = ex.errStr
+	}
+	ex.emit(finished)
+}
+
+// Stop makes the execution stop before it runs any other node. The nodes
+// already running are left to finish, after which Start returns with the
+// execution failed.
+func (ex *Execution) Stop() {
+	atomic.StoreInt32(&ex.stopped, 1)
+}
+
+// Err returns the error that stopped the execution, if any.
+func (ex *Execution) Err() error {
+	if !ex.err {
+		return nil
+	}
+	return errors.New(ex.errStr)
+}
+
+// setNodeError records the error of a failed node. The first node to fail
+// stops the execution, so its error is kept.
+func (ex *Execution) setNodeError(nodeID string, errStr string) {
+	ex.emit(Event{Type: EventNodeFailed, NodeID: nodeID, Error: errStr})
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.errStr == "" {
+		ex.errStr = fmt.Sprintf("node %s: %s", nodeID, errStr)
+	}
 }
 
 // executeSeriallyFrom executes Node n and all nodes that follow it serially
 // It will block if a node needs to wait for a trigger or input
 func (ex *Execution) executeSeriallyFrom(n Node, execStateStack *ExecStateStack) bool {
+	if ex.maxParallel > 1 {
+		return ex.executeConcurrentlyFrom(n, execStateStack)
+	}
 	for currNode := n; currNode != nil; currNode = currNode.Next() {
-		switch currNode.NodeType() {
-		case ActionNodeT:
-			ex.totalActionExecutions++
-			var ac *ActionNode
-			ac = currNode.(*ActionNode)
-			fmt.Printf("Count# %d Action node urn: %s with params\n +%+v \n",
-				ex.totalActionExecutions, ac.urn, ac.inputParams)
-			if ex.executeAction(ac, execStateStack) == false {
-				return false
-			}
+		if !ex.executeNode(currNode, execStateStack) {
+			return false
+		}
+	}
+	return true // Reaching here means that n was passed a nil
+}
 
-		case IfNodeT:
-			var ifNode = currNode.(*IfNode)
-			if ex.executeIfBlock(ifNode, execStateStack) == false {
-				return false
-			}
+// executeNode executes a single node, along with the nodes nested in it.
+func (ex *Execution) executeNode(n Node, execStateStack *ExecStateStack) bool {
+	if atomic.LoadInt32(&ex.stopped) != 0 {
+		ex.mu.Lock()
+		if ex.errStr == "" {
+			ex.errStr = "execution stopped"
+		}
+		ex.mu.Unlock()
+		return false
+	}
+	switch n.NodeType() {
+	case ActionNodeT:
+		var ac *ActionNode
+		ac = n.(*ActionNode)
+		// A resumed execution does not run the actions that are done again.
+		if execStateStack.Top().actionDone(ac.Id) {
+			return true
+		}
+		ex.mu.Lock()
+		ex.totalActionExecutions++
+		ex.mu.Unlock()
+		ex.emit(Event{Type: EventNodeStarted, NodeID: ac.Id, NodeType: ActionNodeT, Urn: ac.urn})
+		return ex.executeAction(ac, execStateStack)
 
-		case ForNodeT:
-			var forNode = currNode.(*ForNode)
-			if ex.executeForLoop(forNode, execStateStack) == false {
-				return false
-			}
+	case IfNodeT:
+		var ifNode = n.(*IfNode)
+		if yesPath, ok := execStateStack.Top().ifEvaluated(ifNode.Id); ok {
+			return ex.executeBranch(ifNode, yesPath, execStateStack)
 		}
+		ex.emit(Event{Type: EventNodeStarted, NodeID: ifNode.Id, NodeType: IfNodeT})
+		return ex.executeIfBlock(ifNode, execStateStack)
+
+	case ForNodeT:
+		var forNode = n.(*ForNode)
+		ex.emit(Event{Type: EventNodeStarted, NodeID: forNode.Id, NodeType: ForNodeT})
+		return ex.executeForLoop(forNode, execStateStack)
 	}
-	return true // Reaching here means that n was passed a nil
+	return true
 }
 
 func (ex *Execution) executeIfBlock(ifNode *IfNode, execStateStack *ExecStateStack) bool {
+	start := time.Now()
 	execState := execStateStack.Top()
 	execState.startIfNodeExecution(ifNode.Id)
 	c := NewCondition(ifNode.condition)
 	// Resolve the list of variables needed to evaluating the if condition
 	varValuesUsed := make(map[string]string)
+	// unresolved holds why the optional vars left without a value can never
+	// be resolved
+	unresolved := make(map[string]error)
 	for _, varName := range c.UnknownVarsList() {
-		valW, _ := execStateStack.GetValueOrBlock(varName, 100)
+		valW, err := ex.resolve(ifNode.Id, varName, execStateStack)
+		if err != nil && c.Optional(varName) {
+			unresolved[varName] = err
+			continue
+		}
+		if err != nil {
+			execState.updateIfNodeEvaluationError(ifNode.Id, err.Error())
+			ex.setNodeError(ifNode.Id, err.Error())
+			return false
+		}
 		c.SetVarValue(varName, valW)
 		varValuesUsed[varName] = valW.AsString()
 	}
@@ -85,11 +235,22 @@ func (ex *Execution) executeIfBlock(ifNode *IfNode, execStateStack *ExecStateSta
 	yesPath, success := c.Evaluate()
 	// Update the if node state
 	if !success {
-		execState.updateIfNodeEvaluationError(ifNode.Id, "Evaluation failed")
+		errStr := "Evaluation failed"
+		if err := c.Err(); err != nil {
+			errStr = fmt.Sprintf("Evaluation failed: %s", unresolvedCause(err, unresolved).Error())
+		}
+		execState.updateIfNodeEvaluationError(ifNode.Id, errStr)
+		ex.setNodeError(ifNode.Id, errStr)
 		return false
 	}
 	execState.updateIfNodeEvaluation(ifNode.Id, yesPath, varValuesUsed)
-	// Continue to execute the yesPath or noPath
+	ex.emit(Event{Type: EventIfEvaluated, Duration: time.Since(start), NodeID: ifNode.Id, NodeType: IfNodeT,
+		Condition: ifNode.condition, Values: varValuesUsed, Branch: yesPath})
+	return ex.executeBranch(ifNode, yesPath, execStateStack)
+}
+
+// executeBranch executes the yesPath or noPath of an if node.
+func (ex *Execution) executeBranch(ifNode *IfNode, yesPath bool, execStateStack *ExecStateStack) bool {
 	var ret bool = true
 	if yesPath {
 		var yNode Node = ifNode.YesPathFirstNode
@@ -104,88 +265,230 @@ func (ex *Execution) executeIfBlock(ifNode *IfNode, execStateStack *ExecStateSta
 
 func (ex *Execution) executeAction(n *ActionNode, execStateStack *ExecStateStack) bool {
 	topExecState := execStateStack.Top()
+	// The node may produce its results and exports until it returns.
+	topExecState.watch.expect(n.Id, n.exportResultAs)
+	defer topExecState.watch.settle(n.Id, n.exportResultAs)
 	topExecState.startActionExecution(n.Id)
 
 	var inputParamsConcrete map[string]string = make(map[string]string)
 	for paramName, val := range n.inputParams {
+		if IsTemplate(val) {
+			rendered, err := ex.renderTemplate(n.Id, val, execStateStack)
+			if _, ok := err.(*ResolutionError); ok && n.optionalParams[paramName] {
+				continue
+			}
+			if err != nil {
+				topExecState.updateErrorResultForAction(n.Id, err.Error())
+				ex.setNodeError(n.Id, err.Error())
+				return false
+			}
+			inputParamsConcrete[paramName] = rendered
+			continue
+		}
 		if !strings.HasPrefix(val, "@") && !strings.HasPrefix(val, "$") {
 			inputParamsConcrete[paramName] = val
 			continue
 		}
-		concreteVal, present := execStateStack.GetValueOrBlock(val, 1000)
-		if !present {
-			topExecState.updateErrorResultForAction(n.Id, "Timed out waiting for dependency")
+		concreteVal, err := ex.resolve(n.Id, val, execStateStack)
+		if err != nil && n.optionalParams[paramName] {
+			continue
+		}
+		if err != nil {
+			topExecState.updateErrorResultForAction(n.Id, err.Error())
+			ex.setNodeError(n.Id, err.Error())
 			return false
 		}
 		inputParamsConcrete[paramName] = concreteVal.StringVal()
 	}
 
 	topExecState.UpdateConcreteParamsForActionExecution(n.Id, inputParamsConcrete, true)
+	ex.acquireSlot()
+	requested := time.Now()
+	ex.emit(Event{Type: EventActionRequest, Time: requested, NodeID: n.Id, NodeType: ActionNodeT,
+		Urn: n.urn, Params: inputParamsConcrete})
 	ar, err := ex.as.ExecuteAction(n.urn, inputParamsConcrete)
+	ex.releaseSlot()
+	if err == nil && ar.ErrStr != "" {
+		err = errors.New(ar.ErrStr)
+	}
 	if err != nil {
 		topExecState.updateErrorResultForAction(n.Id, err.Error())
+		ex.setNodeError(n.Id, err.Error())
 		return false
 	}
 
 	// fmt.Printf("Action result after execution %+v", ar)
 	// Compute the exportAs values.
-	exports := ex.evaluateExportsForAction(n.exportResultAs, ar)
+	exports, err := ex.evaluateExportsForAction(n, ar, execStateStack)
+	if err != nil {
+		topExecState.updateErrorResultForAction(n.Id, err.Error())
+		ex.setNodeError(n.Id, err.Error())
+		return false
+	}
 	execStateStack.ExportUp(exports)
 
 	topExecState.updateSuccessResultForAction(n.Id, ar, exports)
+	ex.emit(Event{Type: EventActionResult, Duration: time.Since(requested), NodeID: n.Id, NodeType: ActionNodeT,
+		Urn: n.urn, Result: ar, Exports: exports})
 	// TODO: Above, exports is added twice to the top stack. Fix it.
 	return true
 }
 
+// renderTemplate resolves the variables interpolated in a template and
+// renders it. Variables with a default are left out if they can never be
+// resolved.
+func (ex *Execution) renderTemplate(nodeID string, text string, execStateStack *ExecStateStack) (string, error) {
+	t, err := ParseTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	values := make(map[string]*ValueWrapper)
+	unresolved := make(map[string]error)
+	for _, ref := range t.Refs() {
+		val, err := ex.resolve(nodeID, ref, execStateStack)
+		if err != nil {
+			if !t.Optional(ref) {
+				return "", err
+			}
+			unresolved[ref] = err
+			continue
+		}
+		values[ref] = val
+	}
+	s, err := t.Render(values)
+	return s, unresolvedCause(err, unresolved)
+}
+
+// unresolvedCause returns why an optional variable that an expression needed
+// after all can never be resolved, rather than the error of the expression.
+func unresolvedCause(err error, unresolved map[string]error) error {
+	if missing, ok := err.(*missingValueError); ok && unresolved[missing.name] != nil {
+		return unresolved[missing.name]
+	}
+	return err
+}
+
+// evaluateExportsForAction computes the exported values of an action. An
+// export is "result" for the raw result, "raw.<path>" for a path into it, the
+// name of an output field, or a template, in which the action refers to its
+// own result as @node:<id>$<field>. Output fields missing from the result are
+// not exported, but a path that is missing is an error.
 func (ex *Execution) evaluateExportsForAction(
-	toExport map[string]string, ar *actionstore.ActionResult) map[string]*ValueWrapper {
+	n *ActionNode, ar *actionstore.ActionResult, execStateStack *ExecStateStack) (map[string]*ValueWrapper, error) {
 	var exports map[string]*ValueWrapper = make(map[string]*ValueWrapper)
-	for exportedName, expr := range toExport {
+	for _, exportedName := range sortedKeys(n.exportResultAs) {
+		expr := n.exportResultAs[exportedName]
+		if IsTemplate(expr) {
+			val, err := ex.evaluateExportTemplate(n.Id, expr, ar, execStateStack)
+			if err != nil {
+				return nil, fmt.Errorf("unable to export %s: %s", exportedName, err.Error())
+			}
+			exports[exportedName] = val
+			continue
+		}
 		if expr == "result" {
-			exports[exportedName] = WrapStringValue(ar.ResultJSON)
+			expr = "raw"
+		}
+		val, err := resultValue(ar, expr)
+		if err != nil {
+			if !isRawPath(expr) {
+				continue
+			}
+			return nil, fmt.Errorf("unable to export %s: %s", exportedName, err.Error())
+		}
+		exports[exportedName] = val
+	}
+	return exports, nil
+}
+
+// evaluateExportTemplate evaluates an export template, taking the refs to
+// the node itself from its result.
+func (ex *Execution) evaluateExportTemplate(nodeID string, text string,
+	ar *actionstore.ActionResult, execStateStack *ExecStateStack) (*ValueWrapper, error) {
+	t, err := ParseTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	self := "@node:" + nodeID + "$"
+	values := make(map[string]*ValueWrapper)
+	unresolved := make(map[string]error)
+	for _, ref := range t.Refs() {
+		var val *ValueWrapper
+		if strings.HasPrefix(ref, self) {
+			val, err = resultValue(ar, strings.TrimPrefix(ref, self))
 		} else {
-			if val, ok := ar.ResultFieldMap[expr]; ok {
-				exports[exportedName] = WrapStringValue(val)
+			val, err = ex.resolve(nodeID, ref, execStateStack)
+		}
+		if err != nil {
+			if !t.Optional(ref) {
+				return nil, err
 			}
+			unresolved[ref] = err
+			continue
 		}
+		values[ref] = val
 	}
-	return exports
+	val, err := t.Eval(values)
+	return val, unresolvedCause(err, unresolved)
 }
 
 // DONE
 func (ex *Execution) executeForLoop(n *ForNode, executeStateStack *ExecStateStack) bool {
 	// ExecState that is on top of the stack
 	topState := executeStateStack.Top()
+	// A resumed execution continues the iterations it started.
+	done, started := topState.loopProgress(n.Id)
+	if done {
+		return true
+	}
 	topState.startForLoop(n, true /* waiting on input */)
 
 	// Get the var on which the loop will iterate
 	iterableVar := n.IterateOnVar
 	// Block on the var to be available
-	val, present := executeStateStack.GetValueOrBlock(iterableVar, 120 /* timeoutSecs */)
-	// Error on timeout if var is not available
-	if !present {
-		topState.SetDoneWithError("Timed out waiting on input dependencies")
+	val, err := ex.resolve(n.Id, iterableVar, executeStateStack)
+	// Error if var can never be available
+	if err != nil {
+		topState.SetDoneWithError(err.Error())
 		return false
 	}
 
 	iterableVal := val.IterableWrappedVal()
 	loopCount := len(iterableVal)
 	var firstNode Node = n.FirstLoopNode
+	// Iterations are numbered from 1.
 	for i := 1; i <= loopCount; i++ {
-		val := iterableVal[i]
-		nestedState := NewExecState(nil)
-		topState.startForLoopIteration(n, i, val, nestedState)
+		val := iterableVal[i-1]
+		var newStackForLoop *ExecStateStack
+		if st, ok := started[i]; ok {
+			newStackForLoop = executeStateStack.nestedStackWith(st)
+		} else {
+			newStackForLoop = executeStateStack.NewNestedStack()
+		}
+		topState.startForLoopIteration(n, i, val, newStackForLoop.Top())
 
-		newStackForLoop := executeStateStack.NewNestedStack()
-		ex.executeSeriallyFrom(firstNode, newStackForLoop)
-		// TODO: check for error from executeSeriallyFrom()
+		// A failed iteration stops the loop, which is left not done.
+		if !ex.executeSeriallyFrom(firstNode, newStackForLoop) {
+			return false
+		}
 	}
 
 	topState.endForLoop(n.Id)
 	return true
 }
 
+// Status returns a snapshot of the state of the execution, holding the nodes
+// and exported vars that changed after lastConsumedVersion, or all of them
+// when it is 0. The snapshot is not changed by the execution. Pass its
+// Version to the next call to get the changes made since.
 func (ex *Execution) Status(lastConsumedVersion int64) *ExecState {
-	copy := *ex.execState
-	return &copy
+	if lastConsumedVersion < 0 {
+		lastConsumedVersion = 0
+	}
+	// Changes made while the snapshot is taken may be in it as well, and
+	// are in the next one again.
+	version := ex.execState.watch.current()
+	s := ex.execState.snapshot(uint64(lastConsumedVersion))
+	s.version = version
+	return s
 }
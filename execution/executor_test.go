@@ -1,9 +1,15 @@
 package execution
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/logging"
 )
 
 func TestBasic(t *testing.T) {
@@ -83,3 +89,414 @@ func TestBasic(t *testing.T) {
 	assert.True(ok)
 	assert.Equal(ifYesAc2Score, "90")
 }
+
+func TestRawResultPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: vt
+  urn: urn:vt
+  params:
+    ip: "@alert:srcIp"
+  exports:
+    malicious: raw.data.attributes.last_analysis_stats.malicious
+- id: check
+  type: if
+  condition: "@node:vt$raw.data.attributes.last_analysis_stats.malicious > 3"
+  onTrue:
+    - id: block
+      urn: urn:block
+      params:
+        owner: "@node:vt$raw.data.attributes.owners[0]"
+`))
+	assert.Nil(err)
+	mocks := []actionstore.ActionMockScenario{
+		{ActionUrn: "urn:vt", Scenarios: []actionstore.MockScenario{{
+			Input: map[string]string{"ip": "*"},
+			ActionResult: actionstore.ActionResult{
+				ResultJSON: `{"data": {"attributes": {"last_analysis_stats": {"malicious": 5}, "owners": ["acme"]}}}`,
+			},
+		}}},
+		{ActionUrn: "urn:block", Scenarios: []actionstore.MockScenario{{
+			Input:        map[string]string{"owner": "acme"},
+			ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"blocked": "true"}},
+		}}},
+	}
+	as := actionstore.NewActionStoreFromScenarios(mocks)
+	ex := NewExecutionWithActionStore(p, map[string]string{"srcIp": "10.0.0.1"}, as)
+	ex.Start()
+	assert.Nil(ex.Err())
+	assert.Equal("5", ex.execState.ExportedValues()["malicious"].StringVal())
+	assert.Equal(NumberValue, ex.execState.ExportedValues()["malicious"].Kind)
+	blocked, ok := ex.execState.NodeResult("block", "blocked")
+	assert.True(ok)
+	assert.Equal("true", blocked)
+
+	// A path missing from the result fails at once with the reason.
+	p, err = NewPlaybookFromYaml([]byte(`
+- id: vt
+  urn: urn:vt
+  params:
+    ip: "@alert:srcIp"
+- id: check
+  type: if
+  condition: "@node:vt$raw.data.attributes.reputation > 3"
+`))
+	assert.Nil(err)
+	ex = NewExecutionWithActionStore(p, map[string]string{"srcIp": "10.0.0.1"},
+		actionstore.NewActionStoreFromScenarios(mocks))
+	ex.Start()
+	if assert.NotNil(ex.Err()) {
+		assert.Equal(`node check: unable to resolve @node:vt$raw.data.attributes.reputation: `+
+			`node vt: data.attributes has no field "reputation"`, ex.Err().Error())
+	}
+}
+
+func TestTemplateParams(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: notify
+  urn: urn:notify
+  params:
+    text: "Suspicious login from ${@alert:srcIp} by ${@alert:user | lower | default(\"unknown\")}"
+  exports:
+    status: status
+- id: check
+  type: if
+  condition: "${$status | upper} == SENT"
+`))
+	assert.Nil(err)
+	as := actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{
+		{ActionUrn: "urn:notify", Scenarios: []actionstore.MockScenario{{
+			Input:        map[string]string{"text": "*"},
+			ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"status": "sent"}},
+		}}},
+	})
+	ex := NewExecutionWithActionStore(p, map[string]string{"srcIp": "10.0.0.1"}, as)
+	ex.Start()
+	assert.Nil(ex.Err())
+	assert.Equal("Suspicious login from 10.0.0.1 by unknown", as.Calls()[0].Params["text"])
+	assert.True(ex.execState.ifResults["check"].evaluatedToTrue)
+}
+
+func TestTemplateExports(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: fetch
+  urn: urn:fetch
+  params:
+    url: "@alert:url"
+  exports:
+    domain: "${domainOf(@node:fetch$raw.final_url)}"
+    redirects: "${len(@node:fetch$raw.hops)}"
+    summary: "${@alert:user} reached ${@node:fetch$raw.final_url | domainOf}"
+- id: check
+  type: if
+  condition: "$redirects > 1 and $domain != example.com"
+`))
+	assert.Nil(err)
+	as := actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{
+		{ActionUrn: "urn:fetch", Scenarios: []actionstore.MockScenario{{
+			Input: map[string]string{"url": "*"},
+			ActionResult: actionstore.ActionResult{
+				ResultJSON: `{"final_url": "https://Evil.example.net/x", "hops": ["a", "b"]}`,
+			},
+		}}},
+	})
+	ex := NewExecutionWithActionStore(p, map[string]string{"url": "http://example.com", "user": "bob"}, as)
+	ex.Start()
+	assert.Nil(ex.Err())
+	exported := ex.execState.ExportedValues()
+	assert.Equal("evil.example.net", exported["domain"].StringVal())
+	assert.Equal(NumberValue, exported["redirects"].Kind)
+	assert.Equal("bob reached evil.example.net", exported["summary"].StringVal())
+	assert.True(ex.execState.ifResults["check"].evaluatedToTrue)
+
+	// Optional params are written back in their long form.
+	nodes, err := NewNodesFromYaml([]byte(`
+- id: lookup
+  urn: urn:lookup
+  params: {ip: "@alert:srcIp", user: {value: "@alert:user", optional: true}}
+`))
+	assert.Nil(err)
+	assert.Equal(map[string]bool{"user": true}, nodes[0].OptionalParams)
+	d, err := yaml.Marshal(nodes)
+	assert.Nil(err)
+	assert.Equal(`- id: lookup
+  urn: urn:lookup
+  params:
+    ip: '@alert:srcIp'
+    user:
+      value: '@alert:user'
+      optional: true
+`, string(d))
+}
+
+func TestOptionalValues(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: lookup
+  urn: urn:lookup
+  params:
+    ip: "@alert:srcIp"
+    user:
+      value: "@alert:user.name"
+      optional: true
+    note:
+      value: "seen from ${@alert:host}"
+      optional: true
+- id: check
+  type: if
+  condition: "exists(@alert:user.name) or (@alert:score ?? 0) > 50"
+`))
+	assert.Nil(err)
+	as := actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{
+		{ActionUrn: "urn:lookup", Scenarios: []actionstore.MockScenario{{
+			Input:        map[string]string{"ip": "*"},
+			ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"found": "true"}},
+		}}},
+	})
+	start := time.Now()
+	ex := NewExecutionForAlert(p, map[string]interface{}{"srcIp": "10.0.0.1", "score": 70}, as)
+	ex.Start()
+	assert.Nil(ex.Err())
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(map[string]string{"ip": "10.0.0.1"}, as.Calls()[0].Params)
+	assert.True(ex.execState.ifResults["check"].evaluatedToTrue)
+
+}
+
+func TestConcurrentExecution(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: a
+  urn: urn:lookup
+  params: {ip: "@alert:srcIp"}
+- id: b
+  urn: urn:lookup
+  params: {ip: "@alert:dstIp"}
+  exports: {dstScore: score}
+- id: c
+  urn: urn:lookup
+  params: {ip: "@node:a$score", other: "$dstScore"}
+  exports: {dstScore: score}
+- id: d
+  urn: urn:lookup
+  params: {ip: "@alert:host"}
+- id: check
+  type: if
+  condition: "$dstScore == 7"
+  onTrue:
+    - id: e
+      urn: urn:lookup
+      params: {ip: "@node:d$score"}
+`))
+	assert.Nil(err)
+	mocks := []actionstore.ActionMockScenario{
+		{ActionUrn: "urn:lookup", ExecutionDurationSecs: 1, Scenarios: []actionstore.MockScenario{{
+			Input:        map[string]string{"ip": "*"},
+			ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"score": "7"}},
+		}}},
+	}
+	run := func(maxParallel int) (*Execution, *actionstore.ActionStore) {
+		as := actionstore.NewActionStoreFromScenarios(mocks)
+		as.SimulateLatency(20 * time.Millisecond)
+		ex := NewExecutionWithActionStore(p,
+			map[string]string{"srcIp": "10.0.0.1", "dstIp": "10.0.0.2", "host": "10.0.0.3"}, as)
+		ex.SetMaxParallel(maxParallel)
+		ex.Start()
+		return ex, as
+	}
+
+	// a, b and d run together, and c once a and b are done.
+	ex, as := run(4)
+	assert.Nil(ex.Err())
+	assert.Equal(3, ex.PeakConcurrency())
+	assert.True(ex.execState.ifResults["check"].evaluatedToTrue)
+	calls := as.Calls()
+	assert.Equal(5, len(calls))
+	assert.Equal(map[string]string{"ip": "7", "other": "7"}, calls[3].Params)
+	_, ok := ex.execState.NodeResult("e", "score")
+	assert.True(ok)
+
+	ex, _ = run(2)
+	assert.Nil(ex.Err())
+	assert.Equal(2, ex.PeakConcurrency())
+	ex, _ = run(0)
+	assert.Nil(ex.Err())
+	assert.Equal(1, ex.PeakConcurrency())
+
+	// No node starts once one has failed.
+	p, err = NewPlaybookFromYaml([]byte(`
+- id: a
+  urn: urn:missing
+- id: b
+  urn: urn:lookup
+  params: {ip: "@node:a$score"}
+`))
+	assert.Nil(err)
+	ex, as = run(4)
+	assert.EqualError(ex.Err(), "node a: No scenarios found in mock data")
+	assert.Equal(1, len(as.Calls()))
+}
+
+func TestStop(t *testing.T) {
+	assert := assert.New(t)
+
+	ac1 := &ActionNode{
+		GenericExecutionNode: GenericExecutionNode{"ac1", ActionNodeT, nil},
+		urn:                  "urn:lookup",
+		inputParams:          map[string]string{"ip": "@alert:srcIp"},
+	}
+	as := actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{
+		{ActionUrn: "urn:lookup", Scenarios: []actionstore.MockScenario{{Input: map[string]string{"ip": "*"}}}},
+	})
+	ex := NewExecutionWithActionStore(&Playbook{ac1}, map[string]string{"srcIp": "10.0.0.1"}, as)
+	ex.Stop()
+	ex.Start()
+	assert.EqualError(ex.Err(), "execution stopped")
+	assert.Equal(0, len(as.Calls()))
+}
+
+func TestDependencies(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes, err := NewNodesFromYaml([]byte(`
+- id: a
+  urn: u
+  params: {ip: "@alert:srcIp"}
+  exports: {score: score}
+- id: b
+  urn: u
+  params: {text: "${@alert:user}"}
+- id: c
+  urn: u
+  params: {text: "score ${$score}"}
+- id: d
+  urn: u
+  exports: {score: score}
+- id: e
+  type: if
+  condition: "@alert:x == 1"
+  onTrue:
+    - id: f
+      urn: u
+      params: {ip: "@node:b$ip"}
+`))
+	assert.Nil(err)
+	var linked []Node
+	first, err := ConvertToLinkedNodes(nodes)
+	assert.Nil(err)
+	for n := first; n != nil; n = n.Next() {
+		linked = append(linked, n)
+	}
+	// c reads what a writes, d overwrites what a writes and c reads, and
+	// the branch of e reads b.
+	assert.Equal([][]int{nil, nil, {0}, {0, 2}, {1}}, dependencies(linked))
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: vt
+  urn: urn:vt
+  params: {ip: "@alert:srcIp"}
+  exports: {score: score}
+- id: check
+  type: if
+  condition: "$score > 5"
+  onTrue:
+    - id: block
+      urn: urn:block
+`))
+	assert.Nil(err)
+	as := actionstore.NewActionStoreFromScenarios([]actionstore.ActionMockScenario{
+		{ActionUrn: "urn:vt", Scenarios: []actionstore.MockScenario{{
+			Input:        map[string]string{"ip": "*"},
+			ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"score": "7"}},
+		}}},
+	})
+	ex := NewExecutionWithActionStore(p, map[string]string{"srcIp": "10.0.0.1"}, as)
+	var types []EventType
+	ex.AddObserver(ObserverFunc(func(e Event) { types = append(types, e.Type) }))
+	events := ex.Events(0)
+	go ex.Start()
+
+	var received []Event
+	for e := range events {
+		assert.False(e.Time.IsZero())
+		received = append(received, e)
+	}
+	assert.Equal([]EventType{
+		EventExecutionStarted,
+		EventNodeStarted, EventVarResolved, EventActionRequest, EventActionResult,
+		EventNodeStarted, EventVarResolved, EventIfEvaluated,
+		EventNodeStarted, EventActionRequest, EventNodeFailed,
+		EventExecutionFinished,
+	}, types)
+	assert.Equal(len(types), len(received))
+
+	assert.Equal("@alert:srcIp", received[2].Var)
+	assert.Equal("10.0.0.1", received[2].Value.StringVal())
+	assert.Equal(map[string]string{"ip": "10.0.0.1"}, received[3].Params)
+	assert.Equal("7", received[4].Exports["score"].StringVal())
+	assert.Equal("check", received[7].NodeID)
+	assert.Equal(map[string]string{"$score": "7"}, received[7].Values)
+	assert.True(received[7].Branch)
+	assert.Equal("urn:block", received[9].Urn)
+	assert.Equal("block", received[10].NodeID)
+	assert.Equal("No scenarios found in mock data", received[10].Error)
+	assert.Equal("node block: No scenarios found in mock data", received[11].Error)
+	assert.True(received[11].Duration > 0)
+
+	// The onFalse branch is told apart from a missing field.
+	j, err := json.Marshal(Event{Type: EventIfEvaluated, NodeID: "check", Branch: false})
+	assert.Nil(err)
+	assert.Contains(string(j), `"branch":false`)
+	var decoded Event
+	assert.Nil(json.Unmarshal(j, &decoded))
+	assert.Equal(EventIfEvaluated, decoded.Type)
+	j, err = json.Marshal(Event{Type: EventNodeStarted, NodeID: "check"})
+	assert.Nil(err)
+	assert.NotContains(string(j), "branch")
+}
+
+// recordingLogger keeps the messages logged to it.
+type recordingLogger struct {
+	messages []string
+}
+
+func (r *recordingLogger) Log(level logging.Level, msg string, fields []logging.Field) {
+	s := level.String() + " " + msg
+	for _, f := range fields {
+		s += fmt.Sprintf(" %s=%v", f.Key, f.Value)
+	}
+	r.messages = append(r.messages, s)
+}
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := NewPlaybookFromYaml([]byte(`
+- id: vt
+  urn: urn:vt
+  params: {ip: 10.0.0.1}
+`))
+	assert.Nil(err)
+	ex := NewExecutionWithActionStore(p, nil, actionstore.NewActionStoreFromScenarios(nil))
+	logger := &recordingLogger{}
+	ex.SetLogger(logger)
+	ex.Start()
+	id := ex.ID()
+	assert.Equal(5, len(logger.messages))
+	assert.Equal("info execution started execution="+id, logger.messages[0])
+	assert.Equal("debug node started execution="+id+" node=vt urn=urn:vt type=ActionNode", logger.messages[1])
+	assert.Equal("debug calling action execution="+id+" node=vt urn=urn:vt params=map[ip:10.0.0.1]", logger.messages[2])
+	assert.Equal("warn node failed execution="+id+" node=vt error=No scenarios found in mock data", logger.messages[3])
+	assert.Contains(logger.messages[4], "warn execution failed execution="+id+" duration=")
+}
@@ -0,0 +1,698 @@
+package execution
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The condition language, from the lowest precedence to the highest:
+//
+//	or, ||            logical or
+//	and, &&           logical and
+//	not, !            logical not
+//	== != > >= < <=   comparisons, see CompareValues
+//	inCidr matches contains startsWith endsWith in
+//	                  infix forms of the functions of the same name
+//	??                `a ?? b` is a, or b when a is null or has no value
+//	primary           a literal, a variable, a ${...} template, a list
+//	                  [a, b], a function call f(a, b), exists(a) or an
+//	                  expression in parentheses
+//
+// Literals are numbers, strings in single or double quotes, true, false and
+// null. Any other bare word is a string, so `@alert:zone == internal` compares
+// with the string "internal". Inside quotes, a backslash only escapes the
+// quote, so regexes are written as is: `matches "^\d+$"`.
+//
+// exists(a) is true when a has a value that is not null. The variables only
+// used on the left of ?? or in exists are optional: they are not waited for
+// once they can never be resolved, such as a field missing from the alert.
+
+// comparisonOperators are the classic binary comparisons
+var comparisonOperators = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+// infixFunctions can be written between their two arguments
+var infixFunctions = map[string]bool{
+	"inCidr": true, "matches": true, "contains": true, "startsWith": true, "endsWith": true, "in": true,
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokVar
+	tokTemplate
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// tokenize splits an expression into tokens.
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(s[i:], "${"):
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed ${ at %d", i)
+			}
+			tokens = append(tokens, token{tokTemplate, s[i : end+1], i})
+			i = end + 1
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) && s[j+1] == c {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unclosed string at %d", i)
+			}
+			tokens = append(tokens, token{tokString, b.String(), i})
+			i = j + 1
+		case c == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{tokLBracket, "[", i})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{tokRBracket, "]", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case strings.ContainsRune("=!<>&|?", rune(c)):
+			op := ""
+			for _, candidate := range []string{"==", "!=", ">=", "<=", "&&", "||", "??", ">", "<", "!"} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		case c == '@' || c == '$':
+			end := varEnd(s, i)
+			tokens = append(tokens, token{tokVar, s[i:end], i})
+			i = end
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r()[],=!<>&|?\"'", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, token{tokWord, s[i:j], i})
+			i = j
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(s)}), nil
+}
+
+// varEnd returns the end of the variable starting at i. Brackets of paths,
+// as in @alert:observables["a b"], are part of the variable.
+func varEnd(s string, i int) int {
+	depth := 0
+	for ; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '[':
+			depth++
+		case c == ']':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case (c == '"' || c == '\'') && depth > 0:
+			if end := strings.IndexByte(s[i+1:], c); end >= 0 {
+				i += end + 1
+			}
+		case depth == 0 && strings.ContainsRune(" \t\n\r(),=!<>&|?", rune(c)):
+			return i
+		}
+	}
+	return i
+}
+
+// expr is a node of a parsed condition.
+type expr interface {
+	eval(values map[string]*ValueWrapper) (*ValueWrapper, error)
+}
+
+type literalExpr struct{ val *ValueWrapper }
+
+type varExpr struct{ name string }
+
+type templateExpr struct{ t *Template }
+
+type listExpr struct{ items []expr }
+
+type callExpr struct {
+	name string
+	fn   *function
+	args []expr
+}
+
+type notExpr struct{ x expr }
+
+type coalesceExpr struct{ lhs, rhs expr }
+
+type existsExpr struct{ x expr }
+
+// missingValueError is returned when a variable of an expression has no
+// value.
+type missingValueError struct{ name string }
+
+func (e *missingValueError) Error() string {
+	return fmt.Sprintf("%s has no value", e.name)
+}
+
+func isMissingValue(err error) bool {
+	_, ok := err.(*missingValueError)
+	return ok
+}
+
+type logicalExpr struct {
+	op       string
+	lhs, rhs expr
+}
+
+type compareExpr struct {
+	op       string
+	lhs, rhs expr
+	// lhsText and rhsText are the operands as written
+	lhsText, rhsText string
+	// opPos is the offset of the operator in the source
+	opPos int
+}
+
+func (e *literalExpr) eval(map[string]*ValueWrapper) (*ValueWrapper, error) {
+	return e.val, nil
+}
+
+func (e *varExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	if v := values[e.name]; v != nil {
+		return v, nil
+	}
+	return nil, &missingValueError{e.name}
+}
+
+func (e *templateExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	s, err := e.t.Render(values)
+	if err != nil {
+		return nil, err
+	}
+	return WrapStringValue(s), nil
+}
+
+func (e *listExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	list := make([]interface{}, len(e.items))
+	for i, item := range e.items {
+		v, err := item.eval(values)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v.Interface()
+	}
+	return WrapValue(list), nil
+}
+
+func (e *callExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	args := make([]*ValueWrapper, len(e.args))
+	for i, a := range e.args {
+		v, err := a.eval(values)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	return e.fn.invoke(args)
+}
+
+func (e *coalesceExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	v, err := e.lhs.eval(values)
+	if (err == nil && v.Kind != NullValue) || (err != nil && !isMissingValue(err)) {
+		return v, err
+	}
+	return e.rhs.eval(values)
+}
+
+func (e *existsExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	v, err := e.x.eval(values)
+	if err != nil && !isMissingValue(err) {
+		return nil, err
+	}
+	return WrapValue(err == nil && v.Kind != NullValue), nil
+}
+
+func (e *notExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	b, err := evalBool(e.x, values, "not")
+	if err != nil {
+		return nil, err
+	}
+	return WrapValue(!b), nil
+}
+
+func (e *logicalExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	lhs, err := evalBool(e.lhs, values, e.op)
+	if err != nil {
+		return nil, err
+	}
+	// The right hand side is not evaluated if the left one decides.
+	if (e.op == "and" && !lhs) || (e.op == "or" && lhs) {
+		return WrapValue(lhs), nil
+	}
+	rhs, err := evalBool(e.rhs, values, e.op)
+	if err != nil {
+		return nil, err
+	}
+	return WrapValue(rhs), nil
+}
+
+func (e *compareExpr) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	lhs, err := e.lhs.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := e.rhs.eval(values)
+	if err != nil {
+		return nil, err
+	}
+	result, err := CompareValues(lhs, e.op, rhs)
+	if err != nil {
+		return nil, err
+	}
+	return WrapValue(result), nil
+}
+
+func evalBool(e expr, values map[string]*ValueWrapper, op string) (bool, error) {
+	v, err := e.eval(values)
+	if err != nil {
+		return false, err
+	}
+	// Strings such as the output fields of actions are booleans when they
+	// are true or false.
+	b, ok := v.Bool()
+	if !ok {
+		return false, fmt.Errorf("%s applies to booleans, not %s %s", op, v.Kind, v.StringVal())
+	}
+	return b, nil
+}
+
+// parser is a recursive descent parser over the tokens of an expression.
+type parser struct {
+	src    string
+	tokens []token
+	pos    int
+	// vars are the variables in the order they appear
+	vars []string
+}
+
+// parseExpr parses a condition expression.
+func parseExpr(src string) (expr, *parser, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &parser{src: src, tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, p, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return e, p, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// isKeyword tells whether the next token is one of the words or operators.
+func (p *parser) isKeyword(words ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokWord && t.kind != tokOp {
+		return "", false
+	}
+	for _, w := range words {
+		if t.text == w {
+			return w, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) parseOr() (expr, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.isKeyword("or", "||"); !ok {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &logicalExpr{"or", lhs, rhs}
+	}
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	lhs, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.isKeyword("and", "&&"); !ok {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &logicalExpr{"and", lhs, rhs}
+	}
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if _, ok := p.isKeyword("not", "!"); ok {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	start := p.peek().pos
+	lhs, err := p.parseCoalesce()
+	if err != nil {
+		return nil, err
+	}
+	lhsText := strings.TrimSpace(p.src[start:p.peek().pos])
+
+	t := p.peek()
+	op := ""
+	switch {
+	case t.kind == tokOp && isComparison(t.text):
+		op = t.text
+	case t.kind == tokWord && infixFunctions[t.text]:
+		op = t.text
+	default:
+		return lhs, nil
+	}
+	p.next()
+	start = p.peek().pos
+	rhs, err := p.parseCoalesce()
+	if err != nil {
+		return nil, err
+	}
+	rhsText := strings.TrimSpace(p.src[start:p.peek().pos])
+	if isComparison(op) {
+		return &compareExpr{op, lhs, rhs, lhsText, rhsText, t.pos}, nil
+	}
+	call, err := p.call(op, []expr{lhs, rhs}, t.pos)
+	if err != nil {
+		return nil, err
+	}
+	return &infixExpr{callExpr: call, lhsText: lhsText, rhsText: rhsText, opPos: t.pos}, nil
+}
+
+// parseCoalesce parses `a ?? b ?? c`.
+func (p *parser) parseCoalesce() (expr, error) {
+	lhs, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokOp || t.text != "??" {
+		return lhs, nil
+	}
+	p.next()
+	rhs, err := p.parseCoalesce()
+	if err != nil {
+		return nil, err
+	}
+	return &coalesceExpr{lhs, rhs}, nil
+}
+
+// infixExpr is a function written between its arguments, eg. `ip inCidr net`.
+type infixExpr struct {
+	*callExpr
+	lhsText, rhsText string
+	opPos            int
+}
+
+func isComparison(op string) bool {
+	for _, c := range comparisonOperators {
+		if op == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return &literalExpr{WrapStringValue(t.text)}, nil
+	case tokVar:
+		p.addVar(t.text)
+		return &varExpr{t.text}, nil
+	case tokTemplate:
+		tmpl, err := ParseTemplate(t.text)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range tmpl.Refs() {
+			p.addVar(ref)
+		}
+		return &templateExpr{tmpl}, nil
+	case tokLParen:
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at %d", t.pos)
+		}
+		return e, nil
+	case tokLBracket:
+		list := &listExpr{}
+		if p.peek().kind == tokRBracket {
+			p.next()
+			return list, nil
+		}
+		for {
+			item, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+			switch t := p.next(); t.kind {
+			case tokComma:
+			case tokRBracket:
+				return list, nil
+			default:
+				return nil, fmt.Errorf("expected , or ] at %d", t.pos)
+			}
+		}
+	case tokWord:
+		if t.text == "exists" && p.peek().kind == tokLParen {
+			p.next()
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if next := p.next(); next.kind != tokRParen {
+				return nil, fmt.Errorf("exists takes 1 argument, expected ) at %d", next.pos)
+			}
+			return &existsExpr{x}, nil
+		}
+		if p.peek().kind == tokLParen {
+			p.next()
+			var args []expr
+			if p.peek().kind == tokRParen {
+				p.next()
+				return p.call(t.text, args, t.pos)
+			}
+			for {
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				switch next := p.next(); next.kind {
+				case tokComma:
+				case tokRParen:
+					return p.call(t.text, args, t.pos)
+				default:
+					return nil, fmt.Errorf("expected , or ) at %d", next.pos)
+				}
+			}
+		}
+		if infixFunctions[t.text] || t.text == "and" || t.text == "or" || t.text == "not" {
+			return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+		}
+		return &literalExpr{ParseLiteral(t.text)}, nil
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+// call checks that the function exists and that the arguments fit its
+// signature, as far as their kinds are known before evaluation.
+func (p *parser) call(name string, args []expr, pos int) (*callExpr, error) {
+	kinds := make([]ValueKind, len(args))
+	lits := make([]*ValueWrapper, len(args))
+	for i, a := range args {
+		kinds[i] = staticKind(a)
+		if l, ok := a.(*literalExpr); ok {
+			lits[i] = l.val
+		}
+	}
+	fn, err := checkCall(name, kinds, lits)
+	if err != nil {
+		if _, ok := lookupFunction(name); !ok {
+			return nil, fmt.Errorf("%s at %d", err.Error(), pos)
+		}
+		return nil, err
+	}
+	return &callExpr{name, fn, args}, nil
+}
+
+// staticKind returns the kind an expression evaluates to, or AnyValue when
+// it is only known once its variables are.
+func staticKind(e expr) ValueKind {
+	switch e := e.(type) {
+	case *literalExpr:
+		return e.val.Kind
+	case *templateExpr:
+		return StringValue
+	case *listExpr:
+		return ListValue
+	case *callExpr:
+		return e.fn.Result
+	case *infixExpr:
+		return e.fn.Result
+	case *notExpr, *logicalExpr, *compareExpr, *existsExpr:
+		return BoolValue
+	}
+	return AnyValue
+}
+
+// requiredVars adds to required the variables that must have a value for e
+// to be evaluated. The others are optional: those on the left of ??, in
+// exists, and on the right of and and or, which may not be evaluated.
+func requiredVars(e expr, required map[string]bool) {
+	switch e := e.(type) {
+	case *varExpr:
+		required[e.name] = true
+	case *templateExpr:
+		for _, ref := range e.t.Refs() {
+			if !e.t.Optional(ref) {
+				required[ref] = true
+			}
+		}
+	case *listExpr:
+		for _, item := range e.items {
+			requiredVars(item, required)
+		}
+	case *callExpr:
+		for _, arg := range e.args {
+			requiredVars(arg, required)
+		}
+	case *infixExpr:
+		requiredVars(e.callExpr, required)
+	case *notExpr:
+		requiredVars(e.x, required)
+	case *logicalExpr:
+		requiredVars(e.lhs, required)
+	case *compareExpr:
+		requiredVars(e.lhs, required)
+		requiredVars(e.rhs, required)
+	case *coalesceExpr:
+		requiredVars(e.rhs, required)
+	}
+}
+
+// walkExpr calls fn for e and then for each of its subexpressions.
+func walkExpr(e expr, fn func(expr)) {
+	if e == nil {
+		return
+	}
+	fn(e)
+	switch e := e.(type) {
+	case *listExpr:
+		for _, item := range e.items {
+			walkExpr(item, fn)
+		}
+	case *callExpr:
+		for _, arg := range e.args {
+			walkExpr(arg, fn)
+		}
+	case *infixExpr:
+		for _, arg := range e.args {
+			walkExpr(arg, fn)
+		}
+	case *notExpr:
+		walkExpr(e.x, fn)
+	case *existsExpr:
+		walkExpr(e.x, fn)
+	case *logicalExpr:
+		walkExpr(e.lhs, fn)
+		walkExpr(e.rhs, fn)
+	case *compareExpr:
+		walkExpr(e.lhs, fn)
+		walkExpr(e.rhs, fn)
+	case *coalesceExpr:
+		walkExpr(e.lhs, fn)
+		walkExpr(e.rhs, fn)
+	}
+}
+
+func (p *parser) addVar(name string) {
+	for _, v := range p.vars {
+		if v == name {
+			return
+		}
+	}
+	p.vars = append(p.vars, name)
+}
@@ -0,0 +1,416 @@
+package execution
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Function is the implementation of an expression function. It is called
+// with arguments that match its Signature.
+type Function func(args []*ValueWrapper) (*ValueWrapper, error)
+
+// AnyValue is a parameter or result of a function that can be of any kind.
+const AnyValue ValueKind = "any"
+
+// Signature describes the kinds of the parameters and result of a function.
+// A string parameter accepts numbers and booleans, as their text, and a
+// number or boolean parameter accepts strings that hold one.
+type Signature struct {
+	Params []ValueKind `json:"params"`
+	// Variadic functions take the last parameter any number of times
+	Variadic bool      `json:"variadic,omitempty"`
+	Result   ValueKind `json:"result"`
+}
+
+// FunctionInfo describes a registered function.
+type FunctionInfo struct {
+	Name string `json:"name"`
+	Signature
+	Doc     string `json:"doc,omitempty"`
+	Builtin bool   `json:"builtin,omitempty"`
+}
+
+// function is a function of the condition language.
+type function struct {
+	FunctionInfo
+	call Function
+}
+
+func (f *function) minArgs() int {
+	if f.Variadic {
+		return len(f.Params) - 1
+	}
+	return len(f.Params)
+}
+
+// param returns the kind of the i-th argument.
+func (f *function) param(i int) ValueKind {
+	if i >= len(f.Params) {
+		return f.Params[len(f.Params)-1]
+	}
+	return f.Params[i]
+}
+
+// registry holds the functions usable in conditions and templates, by name
+var registry = struct {
+	sync.RWMutex
+	funcs map[string]*function
+}{funcs: make(map[string]*function)}
+
+var functionName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// RegisterFunction makes a function usable in conditions, templates and
+// exports, eg. to check an address against an asset inventory:
+//
+//	execution.RegisterFunction("isServer",
+//		execution.Signature{Params: []execution.ValueKind{execution.StringValue}, Result: execution.BoolValue},
+//		"whether the IP belongs to a server in the inventory", inventory.isServer)
+//
+// Calls are checked against the signature when a playbook is validated and
+// before the function is called. A name can only be registered once.
+func RegisterFunction(name string, sig Signature, doc string, fn Function) error {
+	if !functionName.MatchString(name) || isKeywordName(name) {
+		return fmt.Errorf("invalid function name %q", name)
+	}
+	if sig.Variadic && len(sig.Params) == 0 {
+		return fmt.Errorf("variadic function %s has no parameter to repeat", name)
+	}
+	for _, k := range append(append([]ValueKind{}, sig.Params...), sig.Result) {
+		if !validKind(k) {
+			return fmt.Errorf("function %s: unknown kind %q", name, k)
+		}
+	}
+	if fn == nil {
+		return fmt.Errorf("function %s has no implementation", name)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.funcs[name]; ok {
+		return fmt.Errorf("function %s is already registered", name)
+	}
+	registry.funcs[name] = &function{FunctionInfo{name, sig, doc, false}, fn}
+	return nil
+}
+
+// Functions lists the registered functions, built-in ones included, sorted
+// by name.
+func Functions() []FunctionInfo {
+	registry.RLock()
+	defer registry.RUnlock()
+	infos := make([]FunctionInfo, 0, len(registry.funcs))
+	for _, f := range registry.funcs {
+		infos = append(infos, f.FunctionInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func lookupFunction(name string) (*function, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	f, ok := registry.funcs[name]
+	return f, ok
+}
+
+func isKeywordName(name string) bool {
+	switch name {
+	case "and", "or", "not", "true", "false", "null", "exists":
+		return true
+	}
+	return false
+}
+
+func validKind(k ValueKind) bool {
+	switch k {
+	case AnyValue, NullValue, StringValue, NumberValue, BoolValue, ListValue, MapValue:
+		return true
+	}
+	return false
+}
+
+// accepts tells whether a parameter of kind param takes an argument of kind
+// arg. lit is the argument when its value is known.
+func accepts(param ValueKind, arg ValueKind, lit *ValueWrapper) bool {
+	if param == AnyValue || arg == AnyValue || param == arg {
+		return true
+	}
+	switch param {
+	case StringValue:
+		return arg == NumberValue || arg == BoolValue
+	case NumberValue:
+		if arg != StringValue {
+			return false
+		}
+		if lit == nil {
+			return true
+		}
+		_, ok := lit.Number()
+		return ok
+	case BoolValue:
+		if arg != StringValue {
+			return false
+		}
+		if lit == nil {
+			return true
+		}
+		_, ok := lit.Bool()
+		return ok
+	}
+	return false
+}
+
+// checkCall checks the number and kinds of the arguments of a call. lits
+// holds the arguments whose value is known, and nil for the others.
+func checkCall(name string, kinds []ValueKind, lits []*ValueWrapper) (*function, error) {
+	fn, ok := lookupFunction(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	if len(kinds) < fn.minArgs() || (!fn.Variadic && len(kinds) > len(fn.Params)) {
+		want := fmt.Sprintf("%d", fn.minArgs())
+		if fn.Variadic {
+			want = fmt.Sprintf("at least %d", fn.minArgs())
+		}
+		return nil, fmt.Errorf("%s takes %s arguments, got %d", name, want, len(kinds))
+	}
+	for i, k := range kinds {
+		if !accepts(fn.param(i), k, lits[i]) {
+			got := string(k)
+			if lits[i] != nil {
+				got = fmt.Sprintf("%s %s", k, lits[i].StringVal())
+			}
+			return nil, fmt.Errorf("argument %d of %s must be a %s, got %s", i+1, name, fn.param(i), got)
+		}
+	}
+	return fn, nil
+}
+
+// invoke checks the arguments and calls the function.
+func (f *function) invoke(args []*ValueWrapper) (*ValueWrapper, error) {
+	kinds := make([]ValueKind, len(args))
+	for i, a := range args {
+		kinds[i] = a.Kind
+	}
+	if _, err := checkCall(f.Name, kinds, args); err != nil {
+		return nil, err
+	}
+	v, err := f.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", f.Name, err.Error())
+	}
+	if v == nil {
+		v = WrapValue(nil)
+	}
+	if f.Result != AnyValue && v.Kind != f.Result && v.Kind != NullValue {
+		return nil, fmt.Errorf("%s returned %s %s instead of a %s", f.Name, v.Kind, v.StringVal(), f.Result)
+	}
+	return v, nil
+}
+
+func registerBuiltin(name string, params []ValueKind, result ValueKind, doc string, fn Function) {
+	registry.funcs[name] = &function{FunctionInfo{name, Signature{Params: params, Result: result}, doc, true}, fn}
+}
+
+func init() {
+	str, boolean, any := StringValue, BoolValue, AnyValue
+	registerBuiltin("inCidr", []ValueKind{str, any}, boolean,
+		"whether the IP is in the network, or in any network of a list", fnInCidr)
+	registerBuiltin("isPrivateIp", []ValueKind{str}, boolean,
+		"whether the IP is in an RFC1918 network or an IPv6 unique local address", fnIsPrivateIP)
+	registerBuiltin("matches", []ValueKind{str, str}, boolean,
+		"whether the string matches the regular expression", fnMatches)
+	registerBuiltin("contains", []ValueKind{any, any}, boolean,
+		"whether the string contains the substring, or the list the element", fnContains)
+	registerBuiltin("startsWith", []ValueKind{str, str}, boolean,
+		"whether the string starts with the prefix", stringPredicate(strings.HasPrefix))
+	registerBuiltin("endsWith", []ValueKind{str, str}, boolean,
+		"whether the string ends with the suffix", stringPredicate(strings.HasSuffix))
+	registerBuiltin("in", []ValueKind{any, ListValue}, boolean,
+		"whether the value equals an element of the list", fnIn)
+	registerBuiltin("len", []ValueKind{any}, NumberValue,
+		"the length of a string, list or object", fnLen)
+	registerBuiltin("lower", []ValueKind{str}, str,
+		"the string in lower case", stringFunction(strings.ToLower))
+	registerBuiltin("upper", []ValueKind{str}, str,
+		"the string in upper case", stringFunction(strings.ToUpper))
+	registerBuiltin("trim", []ValueKind{str}, str,
+		"the string without leading and trailing spaces", stringFunction(strings.TrimSpace))
+	registerBuiltin("domainOf", []ValueKind{str}, str,
+		"the lower case host name of a URL", stringFunction(domainOf))
+	registerBuiltin("tld", []ValueKind{str}, str,
+		"the top level domain of a URL or domain name", stringFunction(tld))
+	registerBuiltin("hashType", []ValueKind{str}, str,
+		"md5, sha1, sha256 or sha512 for a hex hash of that length, else an empty string", stringFunction(hashType))
+	registerBuiltin("isHash", []ValueKind{str}, boolean,
+		"whether the string is a hex md5, sha1, sha256 or sha512 hash", fnIsHash)
+}
+
+// privateNetworks are the RFC1918 networks and IPv6 unique local addresses
+var privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func parseIP(v *ValueWrapper) (net.IP, error) {
+	ip := net.ParseIP(strings.TrimSpace(v.StringVal()))
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", v.StringVal())
+	}
+	return ip, nil
+}
+
+// fnInCidr tells whether an IP is in a network, or in any of a list of
+// networks.
+func fnInCidr(args []*ValueWrapper) (*ValueWrapper, error) {
+	ip, err := parseIP(args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range args[1].IterableString() {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR", cidr)
+		}
+		if n.Contains(ip) {
+			return WrapValue(true), nil
+		}
+	}
+	return WrapValue(false), nil
+}
+
+func fnIsPrivateIP(args []*ValueWrapper) (*ValueWrapper, error) {
+	ip, err := parseIP(args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return WrapValue(true), nil
+		}
+	}
+	return WrapValue(false), nil
+}
+
+// regexps caches the compiled regexes of matches
+var regexps sync.Map
+
+func fnMatches(args []*ValueWrapper) (*ValueWrapper, error) {
+	pattern := args[1].StringVal()
+	re, ok := regexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %s", pattern, err.Error())
+		}
+		re, _ = regexps.LoadOrStore(pattern, compiled)
+	}
+	return WrapValue(re.(*regexp.Regexp).MatchString(args[0].StringVal())), nil
+}
+
+// fnContains tells whether a string contains a substring, or a list an
+// element.
+func fnContains(args []*ValueWrapper) (*ValueWrapper, error) {
+	if args[0].Kind == ListValue {
+		return fnIn([]*ValueWrapper{args[1], args[0]})
+	}
+	return WrapValue(strings.Contains(args[0].StringVal(), args[1].StringVal())), nil
+}
+
+// fnIn tells whether a value equals an element of a list.
+func fnIn(args []*ValueWrapper) (*ValueWrapper, error) {
+	for _, e := range args[1].IterableWrappedVal() {
+		if equal, err := CompareValues(args[0], "==", e); err == nil && equal {
+			return WrapValue(true), nil
+		}
+	}
+	return WrapValue(false), nil
+}
+
+// fnLen is the number of characters of a string, elements of a list or
+// fields of a map.
+func fnLen(args []*ValueWrapper) (*ValueWrapper, error) {
+	switch v := args[0]; v.Kind {
+	case ListValue, MapValue:
+		return WrapValue(len(v.IterableWrappedVal())), nil
+	case NullValue:
+		return WrapValue(0), nil
+	default:
+		return WrapValue(utf8.RuneCountInString(v.StringVal())), nil
+	}
+}
+
+func fnIsHash(args []*ValueWrapper) (*ValueWrapper, error) {
+	return WrapValue(hashType(args[0].StringVal()) != ""), nil
+}
+
+func stringFunction(f func(string) string) func([]*ValueWrapper) (*ValueWrapper, error) {
+	return func(args []*ValueWrapper) (*ValueWrapper, error) {
+		return WrapStringValue(f(args[0].StringVal())), nil
+	}
+}
+
+func stringPredicate(f func(string, string) bool) func([]*ValueWrapper) (*ValueWrapper, error) {
+	return func(args []*ValueWrapper) (*ValueWrapper, error) {
+		return WrapValue(f(args[0].StringVal(), args[1].StringVal())), nil
+	}
+}
+
+// domainOf returns the lower case host name of a URL, which may be given
+// without its scheme, eg. "example.com/login".
+func domainOf(s string) string {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// tld returns the last label of the domain of a URL or domain name.
+func tld(s string) string {
+	domain := domainOf(s)
+	if net.ParseIP(domain) != nil {
+		return ""
+	}
+	return domain[strings.LastIndexByte(domain, '.')+1:]
+}
+
+// hashType guesses the algorithm of a hex encoded hash from its length: md5,
+// sha1, sha256 or sha512. It is empty if s is not a hex hash.
+func hashType(s string) string {
+	s = strings.TrimSpace(s)
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return ""
+		}
+	}
+	switch len(s) {
+	case 32:
+		return "md5"
+	case 40:
+		return "sha1"
+	case 64:
+		return "sha256"
+	case 128:
+		return "sha512"
+	}
+	return ""
+}
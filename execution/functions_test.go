@@ -0,0 +1,139 @@
+package execution
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainFunctions(t *testing.T) {
+	assert := assert.New(t)
+
+	for in, expected := range map[string][2]string{
+		"https://Login.Example.com:8443/a?b=c": {"login.example.com", "com"},
+		"example.org/login":                    {"example.org", "org"},
+		"mail.example.co.uk.":                  {"mail.example.co.uk", "uk"},
+		"http://10.0.0.1/x":                    {"10.0.0.1", ""},
+		"localhost":                            {"localhost", "localhost"},
+	} {
+		assert.Equal(expected[0], domainOf(in), in)
+		assert.Equal(expected[1], tld(in), in)
+	}
+}
+
+func TestHashType(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("md5", hashType("D41D8CD98F00B204E9800998ECF8427E"))
+	assert.Equal("sha1", hashType(strings.Repeat("a", 40)))
+	assert.Equal("sha256", hashType(strings.Repeat("0", 64)))
+	assert.Equal("sha512", hashType(strings.Repeat("f", 128)))
+	assert.Equal("", hashType(strings.Repeat("g", 32)))
+	assert.Equal("", hashType("abc"))
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	assert := assert.New(t)
+
+	for ip, expected := range map[string]bool{
+		"10.1.2.3": true, "172.31.255.255": true, "172.32.0.1": false,
+		"192.168.0.1": true, "8.8.8.8": false, "fd00::1": true, "2001:db8::1": false,
+	} {
+		v, err := fnIsPrivateIP([]*ValueWrapper{WrapStringValue(ip)})
+		assert.Nil(err, ip)
+		assert.Equal(expected, v.Interface(), ip)
+	}
+	_, err := fnIsPrivateIP([]*ValueWrapper{WrapStringValue("example.com")})
+	assert.NotNil(err)
+}
+
+func TestRegisterFunction(t *testing.T) {
+	assert := assert.New(t)
+
+	defer unregisterFunctions("isServer", "joinAll")
+	servers := map[string]bool{"10.0.0.5": true}
+	isServer := func(args []*ValueWrapper) (*ValueWrapper, error) {
+		return WrapValue(servers[args[0].StringVal()]), nil
+	}
+	assert.Nil(RegisterFunction("isServer",
+		Signature{Params: []ValueKind{StringValue}, Result: BoolValue}, "whether the IP is a server", isServer))
+	assert.Nil(RegisterFunction("joinAll",
+		Signature{Params: []ValueKind{StringValue, StringValue}, Variadic: true, Result: StringValue}, "",
+		func(args []*ValueWrapper) (*ValueWrapper, error) {
+			var parts []string
+			for _, a := range args[1:] {
+				parts = append(parts, a.StringVal())
+			}
+			return WrapStringValue(strings.Join(parts, args[0].StringVal())), nil
+		}))
+
+	assert.EqualError(RegisterFunction("isServer", Signature{Result: BoolValue}, "", isServer),
+		"function isServer is already registered")
+	assert.EqualError(RegisterFunction("inCidr", Signature{Result: BoolValue}, "", isServer),
+		"function inCidr is already registered")
+	assert.EqualError(RegisterFunction("not", Signature{Result: BoolValue}, "", isServer),
+		`invalid function name "not"`)
+	assert.EqualError(RegisterFunction("is-server", Signature{Result: BoolValue}, "", isServer),
+		`invalid function name "is-server"`)
+	assert.EqualError(RegisterFunction("f", Signature{Result: "text"}, "", isServer),
+		`function f: unknown kind "text"`)
+	assert.EqualError(RegisterFunction("f", Signature{Variadic: true, Result: BoolValue}, "", isServer),
+		"variadic function f has no parameter to repeat")
+
+	var found *FunctionInfo
+	for _, f := range Functions() {
+		if f.Name == "isServer" {
+			info := f
+			found = &info
+		}
+	}
+	if assert.NotNil(found) {
+		assert.Equal([]ValueKind{StringValue}, found.Params)
+		assert.Equal(BoolValue, found.Result)
+		assert.False(found.Builtin)
+	}
+
+	c := NewCondition("isServer(@alert:dstIp) and not isServer(@alert:srcIp)")
+	assert.Nil(c.Err())
+	c.SetVarValue("@alert:srcIp", WrapStringValue("192.168.1.1"))
+	c.SetVarValue("@alert:dstIp", WrapStringValue("10.0.0.5"))
+	result, ok := c.Evaluate()
+	assert.True(ok)
+	assert.True(result)
+
+	tmpl, err := ParseTemplate(`${joinAll("-", "a", 1, true)} ${joinAll(",")}`)
+	assert.Nil(err)
+	s, err := tmpl.Render(nil)
+	assert.Nil(err)
+	assert.Equal("a-1-true ", s)
+
+	// Calls are checked against the signature when the playbook is validated.
+	var messages []string
+	for _, p := range Validate([]byte(`
+- id: lookup
+  urn: urn:lookup
+  params:
+    ip: "${isServer(@alert:srcIp, 1)}"
+  exports:
+    server: "${@node:lookup$host | isServer | in(1)}"
+- id: check
+  type: if
+  condition: "isServer([@alert:srcIp])"
+`)) {
+		messages = append(messages, p.String())
+	}
+	assert.Equal([]string{
+		`node lookup: param ip: isServer takes 1 arguments, got 2 in "${isServer(@alert:srcIp, 1)}"`,
+		`node lookup: export server: argument 2 of in must be a list, got number 1 in "${@node:lookup$host | isServer | in(1)}"`,
+		`node check: condition "isServer([@alert:srcIp])": argument 1 of isServer must be a string, got list`,
+	}, messages)
+}
+
+func unregisterFunctions(names ...string) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, name := range names {
+		delete(registry.funcs, name)
+	}
+}
@@ -0,0 +1,54 @@
+package execution
+
+import "rptsec.com/amg/logging"
+
+// logEvent logs an event with the id of the execution and the fields that
+// apply to it. The steps of the nodes are logged at debug level, the start
+// and end of the execution at info level, and failures at warn level.
+func (ex *Execution) logEvent(e Event) {
+	level := logging.DebugLevel
+	var msg string
+	fields := []logging.Field{logging.F("execution", ex.id)}
+	if e.NodeID != "" {
+		fields = append(fields, logging.F("node", e.NodeID))
+	}
+	if e.Urn != "" {
+		fields = append(fields, logging.F("urn", e.Urn))
+	}
+	switch e.Type {
+	case EventExecutionStarted:
+		level, msg = logging.InfoLevel, "execution started"
+	case EventExecutionFinished:
+		level, msg = logging.InfoLevel, "execution finished"
+		if e.Error != "" {
+			level, msg = logging.WarnLevel, "execution failed"
+		}
+	case EventNodeStarted:
+		msg = "node started"
+		fields = append(fields, logging.F("type", string(e.NodeType)))
+	case EventVarResolved:
+		msg = "resolved variable"
+		fields = append(fields, logging.F("var", e.Var), logging.F("value", e.Value))
+	case EventActionRequest:
+		msg = "calling action"
+		fields = append(fields, logging.F("params", e.Params))
+	case EventActionResult:
+		msg = "action done"
+		if len(e.Exports) > 0 {
+			fields = append(fields, logging.F("exports", e.Exports))
+		}
+	case EventIfEvaluated:
+		msg = "evaluated condition"
+		fields = append(fields, logging.F("condition", e.Condition), logging.F("values", e.Values),
+			logging.F("branch", e.Branch))
+	case EventNodeFailed:
+		level, msg = logging.WarnLevel, "node failed"
+	}
+	if e.Duration > 0 {
+		fields = append(fields, logging.F("duration", e.Duration))
+	}
+	if e.Error != "" {
+		fields = append(fields, logging.F("error", e.Error))
+	}
+	ex.logger.Log(level, msg, fields)
+}
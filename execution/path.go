@@ -0,0 +1,265 @@
+package execution
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pathStep is one step of a path into a JSON document: a field of an object,
+// an index into an array, or a wildcard over all the elements or fields.
+type pathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parsePath parses a path such as "user.email", "observables[0].value",
+// "observables[*].value", "user.*" or `labels["app.kubernetes.io/name"]`.
+// A negative index counts from the end of the array.
+func parsePath(path string) ([]pathStep, error) {
+	var steps []pathStep
+	i := 0
+	expectKey := true
+	for i < len(path) {
+		switch c := path[i]; {
+		case c == '.':
+			if expectKey {
+				return nil, fmt.Errorf("empty field in path %q", path)
+			}
+			expectKey = true
+			i++
+		case c == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in path %q", path)
+			}
+			inner := strings.TrimSpace(path[i+1 : i+end])
+			switch {
+			case inner == "*":
+				steps = append(steps, pathStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, pathStep{key: inner[1 : len(inner)-1]})
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index [%s] in path %q", inner, path)
+				}
+				steps = append(steps, pathStep{index: n, isIndex: true})
+			}
+			expectKey = false
+			i += end + 1
+		default:
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			key := path[i : i+end]
+			if key == "*" {
+				steps = append(steps, pathStep{wildcard: true})
+			} else {
+				steps = append(steps, pathStep{key: key})
+			}
+			expectKey = false
+			i += end
+		}
+	}
+	if expectKey {
+		return nil, fmt.Errorf("path %q ends without a field", path)
+	}
+	return steps, nil
+}
+
+// LookupPath resolves a path into a JSON document, as decoded by
+// encoding/json into interface{} values. A path without wildcards resolves to
+// the value it points at; a path with wildcards resolves to the list of the
+// values it matches. A field holding the whole path, eg. "user.email", is
+// preferred over the nested field.
+func LookupPath(doc interface{}, path string) (*ValueWrapper, bool) {
+	v, err := ResolvePath(doc, path)
+	return v, err == nil
+}
+
+// ResolvePath is LookupPath with an error telling where the path could not
+// be followed.
+func ResolvePath(doc interface{}, path string) (*ValueWrapper, error) {
+	return resolvePath(doc, path, "the document")
+}
+
+// resolvePath resolves a path into doc, which is called root in errors.
+func resolvePath(doc interface{}, path string, root string) (*ValueWrapper, error) {
+	if m, ok := doc.(map[string]interface{}); ok {
+		if v, ok := m[path]; ok {
+			return WrapValue(v), nil
+		}
+	}
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{doc}
+	multi := false
+	for i, step := range steps {
+		next := lookupStep(values, step)
+		if len(next) == 0 && !multi && !step.wildcard {
+			return nil, missingStepError(values[0], root, steps[:i], step)
+		}
+		multi = multi || step.wildcard
+		values = next
+	}
+	if multi {
+		list := make([]interface{}, len(values))
+		copy(list, values)
+		return WrapValue(list), nil
+	}
+	return WrapValue(values[0]), nil
+}
+
+// lookupStep applies a step to each value.
+func lookupStep(values []interface{}, step pathStep) []interface{} {
+	var next []interface{}
+	for _, v := range values {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			if step.wildcard {
+				keys := make([]string, 0, len(node))
+				for k := range node {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					next = append(next, node[k])
+				}
+			} else if f, ok := node[step.key]; ok && !step.isIndex {
+				next = append(next, f)
+			}
+		case []interface{}:
+			switch {
+			case step.wildcard:
+				next = append(next, node...)
+			case step.isIndex:
+				i := step.index
+				if i < 0 {
+					i += len(node)
+				}
+				if i >= 0 && i < len(node) {
+					next = append(next, node[i])
+				}
+			}
+		}
+	}
+	return next
+}
+
+// missingStepError explains why step could not be taken from v, which was
+// reached with the steps before it.
+func missingStepError(v interface{}, root string, before []pathStep, step pathStep) error {
+	at := root
+	if len(before) > 0 {
+		at = formatPath(before)
+	}
+	kind := WrapValue(v).Kind
+	switch {
+	case step.isIndex && kind == ListValue:
+		return fmt.Errorf("%s has %d elements, no index %d", at, len(v.([]interface{})), step.index)
+	case step.isIndex:
+		return fmt.Errorf("%s is a %s, not a list", at, kind)
+	case kind == MapValue:
+		return fmt.Errorf("%s has no field %q", at, step.key)
+	}
+	return fmt.Errorf("%s is a %s, not an object", at, kind)
+}
+
+// formatPath writes steps back as a path.
+func formatPath(steps []pathStep) string {
+	var b strings.Builder
+	for i, step := range steps {
+		switch {
+		case step.wildcard:
+			b.WriteString("[*]")
+		case step.isIndex:
+			fmt.Fprintf(&b, "[%d]", step.index)
+		case strings.ContainsAny(step.key, ".[]"):
+			fmt.Fprintf(&b, "[%q]", step.key)
+		default:
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(step.key)
+		}
+	}
+	return b.String()
+}
+
+// SetPath sets the value at a path of fields and indexes in doc, creating
+// the objects and arrays on the way. Wildcards are not allowed.
+func SetPath(doc map[string]interface{}, path string, val interface{}) error {
+	steps, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	if steps[0].isIndex || steps[0].wildcard {
+		return fmt.Errorf("path %q does not start with a field", path)
+	}
+	var parent interface{} = doc
+	for i, step := range steps {
+		if step.wildcard || (step.isIndex && step.index < 0) {
+			return fmt.Errorf("path %q can not be set", path)
+		}
+		last := i == len(steps)-1
+		var child interface{}
+		if !last {
+			if steps[i+1].isIndex {
+				child = []interface{}{}
+			} else {
+				child = map[string]interface{}{}
+			}
+		}
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if step.isIndex {
+				return fmt.Errorf("path %q indexes an object", path)
+			}
+			if last {
+				p[step.key] = val
+				return nil
+			}
+			if existing, ok := p[step.key]; ok {
+				child = existing
+			}
+			if list, ok := child.([]interface{}); ok && steps[i+1].isIndex {
+				// Lists grow in place, so they are stored back after the next step.
+				child = growList(list, steps[i+1].index)
+			}
+			p[step.key] = child
+		case []interface{}:
+			if !step.isIndex {
+				return fmt.Errorf("path %q has a field of an array", path)
+			}
+			if last {
+				p[step.index] = val
+				return nil
+			}
+			if existing := p[step.index]; existing != nil {
+				child = existing
+			}
+			if list, ok := child.([]interface{}); ok && steps[i+1].isIndex {
+				child = growList(list, steps[i+1].index)
+			}
+			p[step.index] = child
+		default:
+			return fmt.Errorf("path %q goes through a value that is not an object or array", path)
+		}
+		parent = child
+	}
+	return nil
+}
+
+func growList(list []interface{}, index int) []interface{} {
+	for len(list) <= index {
+		list = append(list, nil)
+	}
+	return list
+}
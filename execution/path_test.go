@@ -0,0 +1,130 @@
+package execution
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupPath(t *testing.T) {
+	assert := assert.New(t)
+
+	alert, err := ParseAlert([]byte(`{
+		"user": {"email": "a@example.com", "admin": true},
+		"severity": 7,
+		"observables": [
+			{"type": "ip", "value": "10.0.0.1"},
+			{"type": "domain", "value": "example.com"}
+		],
+		"labels": {"app.kubernetes.io/name": "api"},
+		"src.ip": "192.168.0.1",
+		"note": null
+	}`))
+	assert.Nil(err)
+
+	for path, want := range map[string]string{
+		"user.email":                       "a@example.com",
+		"user.admin":                       "true",
+		"severity":                         "7",
+		"observables[0].value":             "10.0.0.1",
+		"observables[-1].type":             "domain",
+		`labels["app.kubernetes.io/name"]`: "api",
+		"src.ip":                           "192.168.0.1",
+		"note":                             "",
+	} {
+		v, ok := LookupPath(alert, path)
+		if assert.True(ok, path) {
+			assert.True(v.IsScalar(), path)
+			assert.Equal(want, v.StringVal(), path)
+		}
+	}
+
+	v, ok := LookupPath(alert, "user")
+	assert.True(ok)
+	assert.Equal(MapValue, v.Kind)
+	assert.Equal(`{"admin":true,"email":"a@example.com"}`, v.StringVal())
+
+	v, ok = LookupPath(alert, "observables[*].value")
+	assert.True(ok)
+	assert.Equal(ListValue, v.Kind)
+	assert.Equal([]string{"10.0.0.1", "example.com"}, v.IterableString())
+
+	v, ok = LookupPath(alert, "observables")
+	assert.True(ok)
+	assert.Len(v.IterableWrappedVal(), 2)
+
+	v, ok = LookupPath(alert, "user.*")
+	assert.True(ok)
+	assert.Equal([]string{"true", "a@example.com"}, v.IterableString())
+
+	for _, path := range []string{"user.name", "observables[2].value", "severity.level", "user..email", "observables[x]"} {
+		_, ok := LookupPath(alert, path)
+		assert.False(ok, path)
+	}
+}
+
+func TestResolvePathErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	alert, err := ParseAlert([]byte(`{"user": {"email": "a@example.com"}, "observables": [{"value": "x"}]}`))
+	assert.Nil(err)
+	for path, msg := range map[string]string{
+		"host":                 `the document has no field "host"`,
+		"user.name":            `user has no field "name"`,
+		"user.email.domain":    `user.email is a string, not an object`,
+		"observables[3].value": `observables has 1 elements, no index 3`,
+		"user[0]":              `user is a map, not a list`,
+		"user..email":          `empty field in path "user..email"`,
+	} {
+		_, err := ResolvePath(alert, path)
+		if assert.NotNil(err, path) {
+			assert.Equal(msg, err.Error(), path)
+		}
+	}
+
+	exSt := NewExecStateForAlert(alert)
+	_, err = exSt.ResolveVal("@alert:user.name")
+	if assert.IsType(&ResolutionError{}, err) {
+		assert.Equal(`unable to resolve @alert:user.name: user has no field "name"`, err.Error())
+	}
+	_, err = exSt.ResolveVal("$score")
+	assert.Equal(errNotResolved, err)
+}
+
+func TestSetPath(t *testing.T) {
+	assert := assert.New(t)
+
+	alert := map[string]interface{}{}
+	assert.Nil(SetPath(alert, "user.email", "a@example.com"))
+	assert.Nil(SetPath(alert, "observables[1].value", "example.com"))
+	assert.Nil(SetPath(alert, "observables[0].value", "10.0.0.1"))
+
+	v, ok := LookupPath(alert, "user.email")
+	assert.True(ok)
+	assert.Equal("a@example.com", v.StringVal())
+	v, ok = LookupPath(alert, "observables[*].value")
+	assert.True(ok)
+	assert.Equal([]string{"10.0.0.1", "example.com"}, v.IterableString())
+
+	assert.NotNil(SetPath(alert, "observables[*].value", "x"))
+	assert.NotNil(SetPath(alert, "[0]", "x"))
+	assert.NotNil(SetPath(alert, "user.email.domain", "x"))
+}
+
+func TestExecStateNestedAlert(t *testing.T) {
+	assert := assert.New(t)
+
+	alert, err := ParseAlert([]byte(`{"observables": [{"value": "10.0.0.1"}]}`))
+	assert.Nil(err)
+	exSt := NewExecStateForAlert(alert)
+	v, ok := exSt.GetVal("@alert:observables[0].value")
+	assert.True(ok)
+	assert.Equal("10.0.0.1", v.StringVal())
+	_, ok = exSt.GetVal("@alert:observables[1].value")
+	assert.False(ok)
+
+	_, err = ParseAlert([]byte(`[1, 2]`))
+	assert.NotNil(err)
+	_, err = ParseAlert([]byte(`null`))
+	assert.NotNil(err)
+}
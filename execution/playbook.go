@@ -3,11 +3,22 @@ package execution
 import (
 	"fmt"
 	"strconv"
+	"sync/atomic"
 
 	"gopkg.in/yaml.v2" // https://github.com/go-yaml/yaml
 )
 
-var count int = 1
+// count is the last generated node id. It is shared by all the playbooks
+// built in the process, which may be built concurrently.
+var count int64 = 0
+
+// States reported for a node in the result tree built by UpdateWithResultStatus
+const (
+	StateDone                 = "Done"
+	StateFailed               = "Failed"
+	StateNotYetStarted        = "Not-Yet-Started"
+	StateWaitingVarResolution = "Waiting-Var-Resolution"
+)
 
 // type N struct {
 // 	// Common fields
@@ -31,8 +42,11 @@ type N struct {
 	Unresolved     []string          `yaml:"varsUnresolved,omitempty" json:"varsUnresolved,omitempty"`
 	ResolvedValues map[string]string `yaml:"varsResolvedValues,omitempty" json:"varsResolvedValues,omitempty"`
 	// Result for Action node
-	Urn                 string            `yaml:",omitempty" json:",omitempty"`
-	Params              map[string]string `yaml:",omitempty" json:",omitempty"`
+	Urn    string            `yaml:",omitempty" json:",omitempty"`
+	Params map[string]string `yaml:"-" json:",omitempty"`
+	// OptionalParams are the params left out of the call when their value
+	// can never be resolved, written as {value: <value>, optional: true}
+	OptionalParams      map[string]bool   `yaml:"-" json:"optionalParams,omitempty"`
 	ConcreteInputParams map[string]string `yaml:"concreteParams,omitempty" json:"concreteParams,omitempty"`
 	ResultFields        map[string]string `yaml:"resultFields,omitempty" json:"resultFields,omitempty"`
 	RawResult           string            `yaml:"resultRaw,omitempty" json:"resultRaw,omitempty"`
@@ -43,6 +57,86 @@ type N struct {
 	OnTrue               []N    `yaml:"onTrue,flow,omitempty" json:"onTrue,flow,omitempty"`
 	OnFalse              []N    `yaml:"onFalse,omitempty,flow" json:"onFalse,omitempty,flow"`
 	OnCondition          []N    `yaml:"onCondition,omitempty,flow" json:"onCondition,omitempty,flow"`
+	// Coverage of the node over a set of test runs
+	Coverage        string   `yaml:"coverage,omitempty" json:"coverage,omitempty"`
+	UntakenBranches []string `yaml:"untakenBranches,omitempty" json:"untakenBranches,omitempty"`
+
+	idGenerated bool
+}
+
+// GeneratedID reports whether the id of the node was generated by
+// ConvertToLinkedNodes rather than set in the playbook.
+func (n *N) GeneratedID() bool {
+	return n.idGenerated
+}
+
+// nodeFields are the fields of N, without its yaml methods.
+type nodeFields N
+
+// nodeYaml is the yaml layout of N, in which a param is its value or a
+// param.
+type nodeYaml struct {
+	nodeFields `yaml:",inline"`
+	Params     map[string]param `yaml:"params,omitempty"`
+}
+
+// param is an action param written as {value: <value>, optional: true}.
+type param struct {
+	Value    string `yaml:"value"`
+	Optional bool   `yaml:"optional,omitempty"`
+}
+
+// paramFields are the fields of param, without its yaml methods.
+type paramFields param
+
+// UnmarshalYAML reads the params of the node, which are written as their
+// value or as a param.
+func (n *N) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var y nodeYaml
+	if err := unmarshal(&y); err != nil {
+		return err
+	}
+	*n = N(y.nodeFields)
+	for name, p := range y.Params {
+		if n.Params == nil {
+			n.Params = make(map[string]string, len(y.Params))
+		}
+		n.Params[name] = p.Value
+		if p.Optional {
+			if n.OptionalParams == nil {
+				n.OptionalParams = make(map[string]bool)
+			}
+			n.OptionalParams[name] = true
+		}
+	}
+	return nil
+}
+
+// MarshalYAML writes the optional params of the node as a param, and the
+// others as their value.
+func (n N) MarshalYAML() (interface{}, error) {
+	y := nodeYaml{nodeFields: nodeFields(n)}
+	for name, val := range n.Params {
+		if y.Params == nil {
+			y.Params = make(map[string]param, len(n.Params))
+		}
+		y.Params[name] = param{val, n.OptionalParams[name]}
+	}
+	return y, nil
+}
+
+func (p *param) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&p.Value); err == nil {
+		return nil
+	}
+	return unmarshal((*paramFields)(p))
+}
+
+func (p param) MarshalYAML() (interface{}, error) {
+	if !p.Optional {
+		return p.Value, nil
+	}
+	return paramFields(p), nil
 }
 
 // Playbook represents a playbook tree that can be executed
@@ -52,15 +146,24 @@ type Playbook struct {
 
 // NewPlaybookFromYaml returns a new *Playbook from yaml string
 func NewPlaybookFromYaml(yamlData []byte) (*Playbook, error) {
-	var nodes []N = make([]N, 0, 10)
-	err := yaml.Unmarshal(yamlData, &nodes)
+	nodes, err := NewNodesFromYaml(yamlData)
 	if err != nil {
-		fmt.Printf("Error in unmarshalling: %s\n", err.Error())
-		return nil, nil
+		return nil, err
+	}
+	first, err := ConvertToLinkedNodes(nodes)
+	if err != nil {
+		return nil, err
 	}
-	// fmt.Printf("\n%v\n", nodes)
+	return &Playbook{FirstNode: first}, nil
+}
 
-	return &Playbook{FirstNode: ConvertToLinkedNodes(nodes)}, nil
+// NewNodesFromYaml parses the yaml representation of a playbook into a list of N
+func NewNodesFromYaml(yamlData []byte) ([]N, error) {
+	var nodes []N = make([]N, 0, 10)
+	if err := yaml.Unmarshal(yamlData, &nodes); err != nil {
+		return nil, fmt.Errorf("error in unmarshalling playbook: %s", err.Error())
+	}
+	return nodes, nil
 }
 
 func UpdateWithResultStatus(nodes *[]N, state *ExecState) {
@@ -76,11 +179,16 @@ func UpdateWithResultStatus(nodes *[]N, state *ExecState) {
 		case "execute":
 			st, ok := state.actionResults[nodeID]
 			if !ok {
-				ns[i].State = "Not-Yet-Started"
+				ns[i].State = StateNotYetStarted
+				break
+			}
+			if st.errStr != "" {
+				ns[i].State = StateFailed
+				ns[i].Err = st.errStr
 				break
 			}
 			if st.done {
-				ns[i].State = "Done"
+				ns[i].State = StateDone
 				if st.actionResult.ResultJSON != "" {
 					ns[i].RawResult = st.actionResult.ResultJSON
 				} else {
@@ -88,27 +196,30 @@ func UpdateWithResultStatus(nodes *[]N, state *ExecState) {
 				}
 			}
 			if st.waitingOnInput {
-				ns[i].State = "Waiting-Var-Resolution"
+				ns[i].State = StateWaitingVarResolution
 			}
 
 		case "if":
+			// Nodes on both paths are updated so that the path not taken
+			// reports its nodes as not started.
+			UpdateWithResultStatus(&(ns[i].OnTrue), state)
+			UpdateWithResultStatus(&(ns[i].OnFalse), state)
 			stIf, ok := state.ifResults[nodeID]
 			if !ok {
-				ns[i].State = "Not-Yet-Started"
+				ns[i].State = StateNotYetStarted
+				break
+			}
+			if stIf.errStr != "" {
+				ns[i].State = StateFailed
+				ns[i].Err = stIf.errStr
 				break
 			}
 			if stIf.done {
-				ns[i].State = "Done"
+				ns[i].State = StateDone
 				ns[i].ConditionEvaluatedTo = stIf.evaluatedToTrue
 			}
 			if stIf.waitingOnInput {
-				ns[i].State = "Waiting-Var-Resolution"
-			}
-			fmt.Printf("Type inside on True %T\n", ns[i].OnTrue)
-			if stIf.evaluatedToTrue {
-				UpdateWithResultStatus(&(ns[i].OnTrue), state)
-			} else {
-				UpdateWithResultStatus(&(ns[i].OnFalse), state)
+				ns[i].State = StateWaitingVarResolution
 			}
 
 		}
@@ -116,41 +227,64 @@ func UpdateWithResultStatus(nodes *[]N, state *ExecState) {
 
 }
 
-func ConvertToLinkedNodes(nodes []N) Node {
+// ConvertToLinkedNodes builds the executable node tree from nodes. Defaults
+// for type and id are written back into nodes so that the same slice can later
+// be annotated with UpdateWithResultStatus. It returns an error for the nodes
+// whose type can not be executed, after giving every node its defaults.
+func ConvertToLinkedNodes(nodes []N) (Node, error) {
 	if nodes == nil {
-		return nil
+		return nil, nil
 	}
 
 	var firstNode Node = nil
 	var prevNode Node = nil
-	for _, n := range nodes {
+	var firstErr error
+	for i := range nodes {
+		n := &nodes[i]
 		if n.NodeType == "" {
 			n.NodeType = "execute"
 		}
 		if n.ID == "" {
-			n.ID = strconv.Itoa(count)
-			count++
+			n.ID = strconv.FormatInt(atomic.AddInt64(&count, 1), 10)
+			n.idGenerated = true
 		}
 		var currNode Node = nil
+		var err error
 		switch n.NodeType {
 		case "execute":
 			currNode = &ActionNode{
 				GenericExecutionNode: GenericExecutionNode{n.ID, ActionNodeT, nil},
 				urn:                  n.Urn,
 				inputParams:          n.Params,
+				optionalParams:       n.OptionalParams,
 				exportResultAs:       n.Exports,
 			}
 
 		case "if":
-			currNode = &IfNode{
+			ifNode := &IfNode{
 				GenericExecutionNode: GenericExecutionNode{n.ID, IfNodeT, nil},
 				condition:            n.Condition,
-				YesPathFirstNode:     ConvertToLinkedNodes(n.OnTrue),
-				NoPathFirstNode:      ConvertToLinkedNodes(n.OnFalse),
 			}
+			var yesErr, noErr error
+			ifNode.YesPathFirstNode, yesErr = ConvertToLinkedNodes(n.OnTrue)
+			ifNode.NoPathFirstNode, noErr = ConvertToLinkedNodes(n.OnFalse)
+			if err = yesErr; err == nil {
+				err = noErr
+			}
+			currNode = ifNode
 
 		case "for":
-			// Under development.
+			// The yaml of for nodes is under development.
+			err = fmt.Errorf("node %s: for nodes are not supported yet", n.ID)
+
+		default:
+			err = fmt.Errorf("node %s: unknown node type %q", n.ID, n.NodeType)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if currNode == nil {
+			continue
 		}
 
 		if prevNode == nil {
@@ -161,5 +295,5 @@ func ConvertToLinkedNodes(nodes []N) Node {
 		prevNode = currNode
 	}
 
-	return firstNode
+	return firstNode, firstErr
 }
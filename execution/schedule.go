@@ -0,0 +1,181 @@
+package execution
+
+import (
+	"strings"
+	"sync"
+)
+
+// access lists the variables a node reads and writes, as "@node:<id>" for
+// the results of a node and "$<name>" for an exported var, including those
+// of the nodes nested in it.
+type access struct {
+	reads  map[string]bool
+	writes map[string]bool
+	// barrier is set for nodes whose accesses are not known, which run
+	// after the nodes before them and before the nodes after them
+	barrier bool
+}
+
+func newAccess() *access {
+	return &access{reads: make(map[string]bool), writes: make(map[string]bool)}
+}
+
+// read records a variable the node reads. Alert fields are never written so
+// they are left out.
+func (a *access) read(ref string) {
+	switch {
+	case strings.HasPrefix(ref, "@node:"):
+		a.reads["@node:"+strings.SplitN(strings.TrimPrefix(ref, "@node:"), "$", 2)[0]] = true
+	case strings.HasPrefix(ref, "$"):
+		a.reads[ref] = true
+	}
+}
+
+func (a *access) add(b *access) {
+	for ref := range b.reads {
+		a.reads[ref] = true
+	}
+	for ref := range b.writes {
+		a.writes[ref] = true
+	}
+	a.barrier = a.barrier || b.barrier
+}
+
+// conflicts reports whether two nodes must run in their order: one of them
+// writes a variable the other reads or writes.
+func (a *access) conflicts(b *access) bool {
+	if a.barrier || b.barrier {
+		return true
+	}
+	for ref := range a.writes {
+		if b.reads[ref] || b.writes[ref] {
+			return true
+		}
+	}
+	for ref := range b.writes {
+		if a.reads[ref] {
+			return true
+		}
+	}
+	return false
+}
+
+// accessOf returns the variables read and written by n and the nodes nested
+// in it.
+func accessOf(n Node) *access {
+	a := newAccess()
+	switch n := n.(type) {
+	case *ActionNode:
+		for _, val := range n.inputParams {
+			for _, ref := range ParamRefs(val) {
+				a.read(ref)
+			}
+		}
+		self := "@node:" + n.Id + "$"
+		for name, expr := range n.exportResultAs {
+			a.writes["$"+name] = true
+			if IsTemplate(expr) {
+				for _, ref := range ParamRefs(expr) {
+					if !strings.HasPrefix(ref, self) {
+						a.read(ref)
+					}
+				}
+			}
+		}
+		a.writes["@node:"+n.Id] = true
+	case *IfNode:
+		for _, ref := range NewCondition(n.condition).UnknownVarsList() {
+			a.read(ref)
+		}
+		for _, first := range []Node{n.YesPathFirstNode, n.NoPathFirstNode} {
+			for cur := first; cur != nil; cur = cur.Next() {
+				a.add(accessOf(cur))
+			}
+		}
+	default:
+		a.barrier = true
+	}
+	return a
+}
+
+// dependencies returns, for each node of a sequence, the earlier nodes it
+// has to wait for.
+func dependencies(nodes []Node) [][]int {
+	accesses := make([]*access, len(nodes))
+	deps := make([][]int, len(nodes))
+	for j, n := range nodes {
+		accesses[j] = accessOf(n)
+		for i := 0; i < j; i++ {
+			if accesses[i].conflicts(accesses[j]) {
+				deps[j] = append(deps[j], i)
+			}
+		}
+	}
+	return deps
+}
+
+// executeConcurrentlyFrom executes Node n and all nodes that follow it,
+// starting each node as soon as the earlier nodes it depends on are done.
+// Once a node fails no other node is started, and it returns false after the
+// running ones are done.
+func (ex *Execution) executeConcurrentlyFrom(n Node, execStateStack *ExecStateStack) bool {
+	var nodes []Node
+	for currNode := n; currNode != nil; currNode = currNode.Next() {
+		nodes = append(nodes, currNode)
+	}
+	deps := dependencies(nodes)
+	done := make([]chan struct{}, len(nodes))
+	for i := range nodes {
+		done[i] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	failed := false
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+			for _, d := range deps[i] {
+				<-done[d]
+			}
+			mu.Lock()
+			stop := failed
+			mu.Unlock()
+			if stop {
+				return
+			}
+			if !ex.executeNode(nodes[i], execStateStack) {
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return !failed
+}
+
+// acquireSlot blocks until fewer than the maximum number of actions run, and
+// counts the action as running.
+func (ex *Execution) acquireSlot() {
+	if ex.slots != nil {
+		ex.slots <- struct{}{}
+	}
+	ex.mu.Lock()
+	ex.running++
+	if ex.running > ex.peakRunning {
+		ex.peakRunning = ex.running
+	}
+	ex.mu.Unlock()
+}
+
+func (ex *Execution) releaseSlot() {
+	ex.mu.Lock()
+	ex.running--
+	ex.mu.Unlock()
+	if ex.slots != nil {
+		<-ex.slots
+	}
+}
@@ -0,0 +1,92 @@
+package execution
+
+// snapshot returns a deep copy of the state that holds the nodes and exported
+// vars changed after version since, or all of them when since is 0. Values
+// and the alert are shared, as they are never changed once set.
+func (e *ExecState) snapshot(since uint64) *ExecState {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	s := &ExecState{
+		version:        e.version,
+		execStartTs:    e.execStartTs,
+		execDoneTs:     e.execDoneTs,
+		ErrStr:         e.ErrStr,
+		lastUpdateTs:   e.lastUpdateTs,
+		actionResults:  make(map[string]*ActionExecState),
+		ifResults:      make(map[string]*IfExecState),
+		forResults:     make(map[string]*ForExecState),
+		exportedValues: make(map[string]*ValueWrapper),
+		exportVersions: make(map[string]uint64),
+		alert:          e.alert,
+	}
+	for id, a := range e.actionResults {
+		if a.version > since {
+			s.actionResults[id] = a.snapshot()
+		}
+	}
+	for id, i := range e.ifResults {
+		if i.version > since {
+			c := *i
+			c.varValues = copyStrings(i.varValues)
+			s.ifResults[id] = &c
+		}
+	}
+	for id, f := range e.forResults {
+		if c := f.snapshot(since); c != nil {
+			s.forResults[id] = c
+		}
+	}
+	for name, v := range e.exportVersions {
+		if v > since {
+			s.exportedValues[name] = e.exportedValues[name]
+			s.exportVersions[name] = v
+		}
+	}
+	return s
+}
+
+func (a *ActionExecState) snapshot() *ActionExecState {
+	c := *a
+	c.concreteInputParams = copyStrings(a.concreteInputParams)
+	c.usedValues = copyStrings(a.usedValues)
+	if a.actionResult != nil {
+		ar := *a.actionResult
+		ar.ResultFieldMap = copyStrings(a.actionResult.ResultFieldMap)
+		c.actionResult = &ar
+	}
+	return &c
+}
+
+// snapshot returns a copy of the loop with the changes of its iterations
+// made after version since, or nil if neither the loop nor its iterations
+// changed.
+func (f *ForExecState) snapshot(since uint64) *ForExecState {
+	c := *f
+	changed := f.version > since
+	if f.currentIterationState != nil {
+		c.currentIterationState = f.currentIterationState.snapshot(since)
+		changed = changed || c.currentIterationState.version > since
+	}
+	c.iterationResultMap = make(map[int]*ExecState)
+	c.iterationValMap = make(map[int]*ValueWrapper)
+	for i, st := range f.iterationResultMap {
+		c.iterationResultMap[i] = st.snapshot(since)
+		c.iterationValMap[i] = f.iterationValMap[i]
+		changed = changed || c.iterationResultMap[i].version > since
+	}
+	if !changed {
+		return nil
+	}
+	return &c
+}
+
+func copyStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
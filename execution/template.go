@@ -0,0 +1,367 @@
+package execution
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Template is a string with interpolated values, such as
+// "Suspicious login from ${@alert:srcIp}". An interpolation holds an
+// expression, usually a variable, followed by filters:
+//
+//	${@alert:user.name | lower | default("n/a")}
+//	${domainOf(@alert:url)}
+//
+// A filter is json, default or a function, which is given the value as its
+// first argument: `${@alert:url | matches("^https")}` is
+// `${matches(@alert:url, "^https")}`. Null values pass through functions
+// untouched, for default to replace them. "$${" is written as a literal "${".
+type Template struct {
+	text  string
+	parts []templatePart
+}
+
+// templatePart is literal text, or an interpolation when head is set.
+type templatePart struct {
+	text string
+	head expr
+	vars []string
+	// required are the vars that must have a value, see requiredVars
+	required map[string]bool
+	filters  []templateFilter
+}
+
+type templateFilter struct {
+	name string
+	args []*ValueWrapper
+	fn   *function
+}
+
+// templateFilters maps the filters that are not functions to their number
+// of arguments
+var templateFilters = map[string]int{
+	"json":    0,
+	"default": 1,
+}
+
+// IsTemplate tells whether s has interpolations or escapes.
+func IsTemplate(s string) bool {
+	return strings.Contains(s, "${")
+}
+
+// ParseTemplate parses a string with ${...} interpolations.
+func ParseTemplate(s string) (*Template, error) {
+	t := &Template{text: s}
+	var text strings.Builder
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "$${"):
+			text.WriteString("${")
+			i += 3
+		case strings.HasPrefix(s[i:], "${"):
+			end := closingBrace(s, i+2)
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed ${ in %q", s)
+			}
+			part, err := parseInterpolation(s[i+2 : end])
+			if err != nil {
+				return nil, fmt.Errorf("%s in %q", err.Error(), s)
+			}
+			if text.Len() > 0 {
+				t.parts = append(t.parts, templatePart{text: text.String()})
+				text.Reset()
+			}
+			t.parts = append(t.parts, part)
+			i = end + 1
+		default:
+			text.WriteByte(s[i])
+			i++
+		}
+	}
+	if text.Len() > 0 {
+		t.parts = append(t.parts, templatePart{text: text.String()})
+	}
+	return t, nil
+}
+
+// closingBrace returns the index of the } closing an interpolation that
+// starts at i, skipping quoted strings.
+func closingBrace(s string, i int) int {
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\'':
+			end := strings.IndexByte(s[i+1:], s[i])
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+		case '}':
+			return i
+		}
+	}
+	return -1
+}
+
+func parseInterpolation(src string) (templatePart, error) {
+	var part templatePart
+	segments := splitFilters(src)
+	head := strings.TrimSpace(segments[0])
+	if head == "" {
+		return part, fmt.Errorf("empty ${}")
+	}
+	e, p, err := parseExpr(head)
+	if err != nil {
+		return part, err
+	}
+	part.head, part.vars = e, p.vars
+	part.required = make(map[string]bool)
+	requiredVars(e, part.required)
+	kind := staticKind(e)
+	for _, seg := range segments[1:] {
+		f, err := parseFilter(strings.TrimSpace(seg), kind)
+		if err != nil {
+			return part, err
+		}
+		part.filters = append(part.filters, f)
+		kind = f.resultKind(kind)
+	}
+	return part, nil
+}
+
+// parseFilter parses a filter applied to a value of kind in.
+func parseFilter(s string, in ValueKind) (templateFilter, error) {
+	f := templateFilter{name: s}
+	if open := strings.IndexByte(s, '('); open >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return f, fmt.Errorf("filter %s is missing a )", s)
+		}
+		f.name = strings.TrimSpace(s[:open])
+		if inner := strings.TrimSpace(s[open+1 : len(s)-1]); inner != "" {
+			for _, arg := range splitOutsideQuotes(inner, ',') {
+				f.args = append(f.args, ParseLiteral(strings.TrimSpace(arg)))
+			}
+		}
+	}
+	if arity, ok := templateFilters[f.name]; ok {
+		if len(f.args) != arity {
+			return f, fmt.Errorf("filter %s takes %d arguments, got %d", f.name, arity, len(f.args))
+		}
+		return f, nil
+	}
+	fn, ok := lookupFunction(f.name)
+	if !ok {
+		return f, fmt.Errorf("unknown filter %q", f.name)
+	}
+	if n := len(f.args) + 1; n < fn.minArgs() || (!fn.Variadic && n > len(fn.Params)) {
+		return f, fmt.Errorf("filter %s takes %d arguments, got %d", f.name, fn.minArgs()-1, len(f.args))
+	}
+	kinds := []ValueKind{in}
+	lits := []*ValueWrapper{nil}
+	for _, a := range f.args {
+		kinds = append(kinds, a.Kind)
+		lits = append(lits, a)
+	}
+	if _, err := checkCall(f.name, kinds, lits); err != nil {
+		return f, err
+	}
+	f.fn = fn
+	return f, nil
+}
+
+func (f templateFilter) resultKind(in ValueKind) ValueKind {
+	switch {
+	case f.fn != nil:
+		return f.fn.Result
+	case f.name == "json":
+		return StringValue
+	case f.name == "default" && f.args[0].Kind == in:
+		return in
+	}
+	return AnyValue
+}
+
+// splitFilters splits an interpolation on the | before each filter, leaving
+// the || of the expression alone.
+func splitFilters(s string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '|' && i+1 < len(s) && s[i+1] == '|':
+			i++
+		case c == '|':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitOutsideQuotes splits s on sep, except inside quoted strings.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// String returns the template as written.
+func (t *Template) String() string {
+	return t.text
+}
+
+// Refs returns the variables interpolated in the template.
+func (t *Template) Refs() []string {
+	var refs []string
+	seen := make(map[string]bool)
+	for _, p := range t.parts {
+		for _, ref := range p.vars {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// Optional tells whether a variable may be missing, because every
+// interpolation of it has a default or guards it, as in ${@alert:user ?? "-"}.
+func (t *Template) Optional(ref string) bool {
+	found := false
+	for _, p := range t.parts {
+		if !p.uses(ref) {
+			continue
+		}
+		found = true
+		if p.required[ref] && !p.hasDefault() {
+			return false
+		}
+	}
+	return found
+}
+
+func (p *templatePart) uses(ref string) bool {
+	for _, v := range p.vars {
+		if v == ref {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *templatePart) hasDefault() bool {
+	for _, f := range p.filters {
+		if f.name == "default" {
+			return true
+		}
+	}
+	return false
+}
+
+// Render interpolates the values of the variables. An interpolation that
+// needs a variable without a value renders as null, which the default filter
+// replaces.
+func (t *Template) Render(values map[string]*ValueWrapper) (string, error) {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.head == nil {
+			b.WriteString(p.text)
+			continue
+		}
+		val, err := p.eval(values)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(val.StringVal())
+	}
+	return b.String(), nil
+}
+
+// Eval is Render, except that a template made of a single interpolation, such
+// as "${len(@node:lookup$raw.hits)}", keeps the kind of its value.
+func (t *Template) Eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	if len(t.parts) == 1 && t.parts[0].head != nil {
+		return t.parts[0].eval(values)
+	}
+	s, err := t.Render(values)
+	if err != nil {
+		return nil, err
+	}
+	return WrapStringValue(s), nil
+}
+
+func (p *templatePart) eval(values map[string]*ValueWrapper) (*ValueWrapper, error) {
+	val, err := p.head.eval(values)
+	if err != nil {
+		if !isMissingValue(err) || !p.hasDefault() {
+			return nil, err
+		}
+		val = WrapValue(nil)
+	}
+	for _, f := range p.filters {
+		if val, err = f.apply(val); err != nil {
+			return nil, err
+		}
+	}
+	return val, nil
+}
+
+func (f templateFilter) apply(v *ValueWrapper) (*ValueWrapper, error) {
+	switch {
+	case f.fn != nil:
+		if v.Kind == NullValue {
+			return v, nil
+		}
+		return f.fn.invoke(append([]*ValueWrapper{v}, f.args...))
+	case f.name == "json":
+		d, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return WrapStringValue(string(d)), nil
+	case f.name == "default":
+		if v.Kind == NullValue || (v.Kind == StringValue && v.StringVal() == "") {
+			return f.args[0], nil
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unknown filter %q", f.name)
+}
+
+// ParamRefs returns the variables a param value depends on: the value
+// itself when it is a variable, or the variables interpolated in it.
+func ParamRefs(val string) []string {
+	if IsTemplate(val) {
+		t, err := ParseTemplate(val)
+		if err != nil {
+			return nil
+		}
+		return t.Refs()
+	}
+	if isResolutionNeeded(val) {
+		return []string{val}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package execution
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateRender(t *testing.T) {
+	assert := assert.New(t)
+
+	values := map[string]*ValueWrapper{
+		"@alert:srcIp": WrapStringValue("10.0.0.1"),
+		"@alert:user":  WrapStringValue(" Alice "),
+		"@alert:tags":  WrapValue([]interface{}{"a", "b"}),
+		"@alert:url":   WrapStringValue("https://Example.com/login"),
+		"$score":       WrapValue(50.5),
+	}
+	for text, expected := range map[string]string{
+		"Suspicious login from ${@alert:srcIp}":  "Suspicious login from 10.0.0.1",
+		"${@alert:user | trim | lower}":          "alice",
+		"${ @alert:user|upper }":                 " ALICE ",
+		"score ${$score}":                        "score 50.5",
+		"${@alert:tags | json}":                  `["a","b"]`,
+		"${@alert:user | json}":                  `" Alice "`,
+		`${@alert:host | default("n/a")}`:        "n/a",
+		`${@alert:host | default('a|b}')}`:       "a|b}",
+		"${@alert:host | default(0)}":            "0",
+		"cost: $${price} ${$score}":              "cost: ${price} 50.5",
+		`${"literal" | upper}`:                   "LITERAL",
+		"${@alert:srcIp}:${@alert:srcIp}":        "10.0.0.1:10.0.0.1",
+		"${domainOf(@alert:url)}":                "example.com",
+		`${@alert:url | startsWith("https")}`:    "true",
+		"${len(@alert:tags) > 1 || $score > 99}": "true",
+		`${@alert:host | upper | default("-")}`:  "-",
+		`${@alert:host ?? @alert:srcIp}`:         "10.0.0.1",
+	} {
+		tmpl, err := ParseTemplate(text)
+		if !assert.Nil(err, text) {
+			continue
+		}
+		s, err := tmpl.Render(values)
+		assert.Nil(err, text)
+		assert.Equal(expected, s, text)
+	}
+
+	tmpl, err := ParseTemplate(`${@alert:srcIp} ${@alert:host | default("-")} ${$x} ${$x | default("")}`)
+	assert.Nil(err)
+	assert.Equal([]string{"@alert:srcIp", "@alert:host", "$x"}, tmpl.Refs())
+	assert.True(tmpl.Optional("@alert:host"))
+	assert.False(tmpl.Optional("$x"))
+	assert.False(tmpl.Optional("@alert:srcIp"))
+	_, err = tmpl.Render(map[string]*ValueWrapper{})
+	assert.NotNil(err)
+
+	// Variables guarded by ?? or exists are optional.
+	tmpl, err = ParseTemplate(`${@alert:host ?? "-"} ${@alert:host | lower}`)
+	assert.Nil(err)
+	assert.False(tmpl.Optional("@alert:host"))
+	tmpl, err = ParseTemplate(`${@alert:host ?? "-"} ${exists(@alert:host)}`)
+	assert.Nil(err)
+	assert.True(tmpl.Optional("@alert:host"))
+	s, err := tmpl.Render(nil)
+	assert.Nil(err)
+	assert.Equal("- false", s)
+
+	// A single interpolation keeps the kind of its value.
+	tmpl, err = ParseTemplate("${len(@alert:tags)}")
+	assert.Nil(err)
+	v, err := tmpl.Eval(values)
+	assert.Nil(err)
+	assert.Equal(NumberValue, v.Kind)
+	assert.Equal("2", v.StringVal())
+}
+
+func TestTemplateParseErrors(t *testing.T) {
+	assert := assert.New(t)
+	for text, msg := range map[string]string{
+		"${@alert:srcIp":              "unclosed ${",
+		"${}":                         "empty ${}",
+		"${@alert:srcIp | shout}":     `unknown filter "shout"`,
+		"${@alert:srcIp | default}":   "filter default takes 1 arguments, got 0",
+		"${@alert:srcIp | lower(1)}":  "filter lower takes 0 arguments, got 1",
+		`${@alert:srcIp | default("}`: "unclosed ${",
+		"${@alert:srcIp | inCidr}":    "filter inCidr takes 1 arguments, got 0",
+		`${@alert:srcIp | in("a")}`:   "argument 2 of in must be a list, got string a",
+		"${shout(@alert:srcIp)}":      "unknown function shout",
+	} {
+		_, err := ParseTemplate(text)
+		if assert.NotNil(err, text) {
+			assert.Contains(err.Error(), msg, text)
+		}
+	}
+	assert.Equal([]string{"@alert:a", "$b"}, ParamRefs("${@alert:a} and ${$b}"))
+	assert.Equal([]string{"$b"}, ParamRefs("$b"))
+	assert.Nil(ParamRefs("plain"))
+}
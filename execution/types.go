@@ -43,6 +43,8 @@ type ActionNode struct {
 	urn                 string
 	inputParams         map[string]string
 	concreteInputParams map[string]string
+	// optionalParams are left out of the call when they can never be resolved
+	optionalParams map[string]bool
 	// varName -> expression(result)
 	//	or simply, varName -> [result | result.fieldName ]
 	exportResultAs map[string]string
@@ -0,0 +1,210 @@
+package execution
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Problem is an error found in a playbook without executing it.
+type Problem struct {
+	// Node is the id of the node with the problem, empty for the whole playbook
+	Node    string `json:"node,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Node == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("node %s: %s", p.Node, p.Message)
+}
+
+// Validate checks the yaml representation of a playbook for:
+//   - fields and node types that the engine does not know
+//   - duplicate node ids
+//   - action nodes without urn and if nodes without a parseable condition,
+//     including unknown functions and wrong numbers of arguments
+//   - ${...} interpolations that do not parse
+//   - references to nodes or exported vars that do not run before the node on
+//     every path, which would leave the node waiting forever
+func Validate(yamlData []byte) []Problem {
+	var nodes []N
+	if strictErr := yaml.UnmarshalStrict(yamlData, &nodes); strictErr != nil {
+		var problems []Problem
+		nodes, err := NewNodesFromYaml(yamlData)
+		if err != nil {
+			return []Problem{{Message: err.Error()}}
+		}
+		// The playbook parses, so the strict errors are about unknown fields.
+		for _, line := range strings.Split(strictErr.Error(), "\n") {
+			line = yamlTypeNames.Replace(strings.TrimSpace(line))
+			if line != "" && !strings.HasPrefix(line, "yaml: unmarshal errors:") {
+				problems = append(problems, Problem{Message: line})
+			}
+		}
+		return append(problems, validateNodes(nodes)...)
+	}
+	return validateNodes(nodes)
+}
+
+// yamlTypeNames maps the types that the yaml of a node is decoded into to
+// the types of the playbook, for error messages.
+var yamlTypeNames = strings.NewReplacer(
+	"type execution.nodeYaml", "type execution.N",
+	"type execution.paramFields", "type execution.param")
+
+func validateNodes(nodes []N) []Problem {
+	v := &validator{ids: make(map[string]int), exports: make(map[string]bool)}
+	v.collect(nodes)
+	for _, id := range sortedKeys(v.ids) {
+		if v.ids[id] > 1 {
+			v.add(id, fmt.Sprintf("id is used by %d nodes", v.ids[id]))
+		}
+	}
+	v.walk(nodes, map[string]bool{})
+	return v.problems
+}
+
+type validator struct {
+	// ids counts the nodes with each id, exports are all exported var names
+	ids      map[string]int
+	exports  map[string]bool
+	problems []Problem
+}
+
+func (v *validator) add(node string, msg string) {
+	v.problems = append(v.problems, Problem{Node: node, Message: msg})
+}
+
+func (v *validator) collect(nodes []N) {
+	for _, n := range nodes {
+		if n.ID != "" {
+			v.ids[n.ID]++
+		}
+		for name := range n.Exports {
+			v.exports["$"+name] = true
+		}
+		v.collect(n.OnTrue)
+		v.collect(n.OnFalse)
+	}
+}
+
+// walk checks the nodes in execution order. visible holds the node ids and
+// exported vars that are set on every path leading to the current node.
+func (v *validator) walk(nodes []N, visible map[string]bool) {
+	for i := range nodes {
+		n := &nodes[i]
+		name := n.ID
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		switch n.NodeType {
+		case "", "execute":
+			if n.Urn == "" {
+				v.add(name, "action node has no urn")
+			}
+			for _, param := range sortedKeys(n.Params) {
+				val := n.Params[param]
+				if IsTemplate(val) {
+					if _, err := ParseTemplate(val); err != nil {
+						v.add(name, fmt.Sprintf("param %s: %s", param, err.Error()))
+					}
+				}
+				for _, ref := range ParamRefs(val) {
+					v.checkRef(name, ref, visible)
+				}
+			}
+			for _, exported := range sortedKeys(n.Exports) {
+				val := n.Exports[exported]
+				if !IsTemplate(val) {
+					continue
+				}
+				t, err := ParseTemplate(val)
+				if err != nil {
+					v.add(name, fmt.Sprintf("export %s: %s", exported, err.Error()))
+					continue
+				}
+				for _, ref := range t.Refs() {
+					if n.ID == "" || !strings.HasPrefix(ref, "@node:"+n.ID+"$") {
+						v.checkRef(name, ref, visible)
+					}
+				}
+			}
+		case "if":
+			c := NewCondition(n.Condition)
+			if n.Condition == "" {
+				v.add(name, "if node has no condition")
+			} else if err := c.Err(); err != nil {
+				v.add(name, fmt.Sprintf("condition %q: %s", n.Condition, err.Error()))
+			} else if !c.isPredicate() {
+				v.add(name, fmt.Sprintf("condition %q has no comparison operator", n.Condition))
+			}
+			for _, ref := range c.UnknownVarsList() {
+				v.checkRef(name, ref, visible)
+			}
+			v.walk(n.OnTrue, copyVisible(visible))
+			v.walk(n.OnFalse, copyVisible(visible))
+		case "for":
+			v.add(name, "for nodes are not supported yet")
+		default:
+			v.add(name, fmt.Sprintf("unknown node type %q", n.NodeType))
+		}
+		if n.ID != "" {
+			visible[n.ID] = true
+		}
+		for exported := range n.Exports {
+			visible["$"+exported] = true
+		}
+	}
+}
+
+func (v *validator) checkRef(node string, ref string, visible map[string]bool) {
+	switch {
+	case strings.HasPrefix(ref, "@node:"):
+		id := strings.SplitN(strings.TrimPrefix(ref, "@node:"), "$", 2)[0]
+		if visible[id] {
+			return
+		}
+		if v.ids[id] == 0 {
+			v.add(node, fmt.Sprintf("%s refers to node %s which is not defined", ref, id))
+		} else {
+			v.add(node, fmt.Sprintf("%s refers to node %s which does not run before it on every path", ref, id))
+		}
+	case strings.HasPrefix(ref, "$"):
+		if visible[ref] {
+			return
+		}
+		if !v.exports[ref] {
+			v.add(node, fmt.Sprintf("%s is not exported by any node", ref))
+		} else {
+			v.add(node, fmt.Sprintf("%s is not exported before it on every path", ref))
+		}
+	}
+}
+
+func copyVisible(visible map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(visible))
+	for k, val := range visible {
+		c[k] = val
+	}
+	return c
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]int:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
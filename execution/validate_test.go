@@ -0,0 +1,122 @@
+package execution
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook := `
+- id: ac1
+  urn: www.vt.com/soar-services/v1/checkIpReputation
+  params:
+    ipv4Addr: "@alert:srcIp"
+  exports:
+    score: reputationScore
+- id: if2
+  type: if
+  condition: "$score == 50"
+  onTrue:
+    - id: ac3
+      urn: www.rptsec.com/sms/v1/getDomainForIp
+      params: {ipv4Addr: "@alert:srcIp"}
+  onFalse:
+    - id: ac1
+      params: {domainName: "@node:ac3$domainName"}
+- id: if4
+  type: if
+  condition: "$missing"
+  onTrue:
+    - type: loop
+      urn: x
+      params: {ip: "@node:nowhere$ip"}
+  onFoo: []
+`
+	var messages []string
+	for _, p := range Validate([]byte(playbook)) {
+		messages = append(messages, p.String())
+	}
+	assert.Equal([]string{
+		"line 25: field onFoo not found in type execution.N",
+		"node ac1: id is used by 2 nodes",
+		"node ac1: action node has no urn",
+		"node ac1: @node:ac3$domainName refers to node ac3 which does not run before it on every path",
+		"node if4: $missing is not exported by any node",
+		"node #1: unknown node type \"loop\"",
+	}, messages)
+}
+
+func TestValidateValidPlaybook(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Empty(Validate([]byte(`
+- id: ac1
+  urn: u
+  params: {ip: "@alert:srcIp"}
+- type: if
+  condition: "@node:ac1$score >= 10"
+  onTrue:
+    - urn: u
+      params: {ip: "@node:ac1$ip"}
+- type: if
+  condition: "@node:ac1$isKnownBad"
+`)))
+	problems := Validate([]byte(`
+- id: check
+  type: if
+  condition: high
+`))
+	if assert.Equal(1, len(problems)) {
+		assert.Equal(`node check: condition "high" has no comparison operator`, problems[0].String())
+	}
+	problems = Validate([]byte("- id: [unclosed"))
+	assert.Equal(1, len(problems))
+	assert.Contains(problems[0].Message, "error in unmarshalling playbook")
+}
+
+func TestConvertRejectsUnknownTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	for typ, msg := range map[string]string{
+		"exec": `node b: unknown node type "exec"`,
+		"for":  "node b: for nodes are not supported yet",
+	} {
+		_, err := NewPlaybookFromYaml([]byte(`
+- id: a
+  urn: u
+- id: cond
+  type: if
+  condition: "1 == 1"
+  onTrue:
+    - id: b
+      type: ` + typ + `
+`))
+		assert.EqualError(err, msg, typ)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	var messages []string
+	for _, p := range Validate([]byte(`
+- id: notify
+  urn: urn:notify
+  params:
+    text: "Login from ${@alert:srcIp | shout}"
+    to: "${$user}@example.com"
+- id: check
+  type: if
+  condition: "${@node:notify$status | lower} == ${@alert:expected"
+`)) {
+		messages = append(messages, p.String())
+	}
+	assert.Equal([]string{
+		`node notify: param text: unknown filter "shout" in "Login from ${@alert:srcIp | shout}"`,
+		"node notify: $user is not exported by any node",
+		`node check: condition "${@node:notify$status | lower} == ${@alert:expected": unclosed ${ at 34`,
+	}, messages)
+}
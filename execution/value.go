@@ -0,0 +1,330 @@
+package execution
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValueKind is the type of a value held by a *ValueWrapper.
+type ValueKind string
+
+// Kinds of values, as in JSON
+const (
+	NullValue   ValueKind = "null"
+	StringValue ValueKind = "string"
+	NumberValue ValueKind = "number"
+	BoolValue   ValueKind = "bool"
+	ListValue   ValueKind = "list"
+	MapValue    ValueKind = "map"
+)
+
+// ValueWrapper holds a value (as well as its type info) that is assigned to a variable.
+// The value is held as decoded from JSON: nil, a string, a json.Number, a
+// bool, a []interface{} or a map[string]interface{}.
+type ValueWrapper struct {
+	Kind ValueKind
+	v    interface{}
+}
+
+// WrapStringValue wraps a string into a *ValueWrapper
+func WrapStringValue(s string) *ValueWrapper {
+	return &ValueWrapper{Kind: StringValue, v: s}
+}
+
+// WrapValue wraps a value decoded from JSON into a *ValueWrapper. Go numbers
+// and slices or maps of other types are converted to their JSON form.
+func WrapValue(v interface{}) *ValueWrapper {
+	switch t := v.(type) {
+	case nil:
+		return &ValueWrapper{Kind: NullValue}
+	case string:
+		return WrapStringValue(t)
+	case json.Number:
+		return &ValueWrapper{Kind: NumberValue, v: t}
+	case bool:
+		return &ValueWrapper{Kind: BoolValue, v: t}
+	case float64:
+		return &ValueWrapper{Kind: NumberValue, v: json.Number(strconv.FormatFloat(t, 'f', -1, 64))}
+	case int:
+		return &ValueWrapper{Kind: NumberValue, v: json.Number(strconv.Itoa(t))}
+	case int64:
+		return &ValueWrapper{Kind: NumberValue, v: json.Number(strconv.FormatInt(t, 10))}
+	case []interface{}:
+		return &ValueWrapper{Kind: ListValue, v: t}
+	case map[string]interface{}:
+		return &ValueWrapper{Kind: MapValue, v: t}
+	case *ValueWrapper:
+		return t
+	}
+	// Other types go through their JSON encoding.
+	d, err := json.Marshal(v)
+	if err != nil {
+		return WrapStringValue(fmt.Sprintf("%v", v))
+	}
+	dec := json.NewDecoder(bytes.NewReader(d))
+	dec.UseNumber()
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		return WrapStringValue(string(d))
+	}
+	return WrapValue(decoded)
+}
+
+// ParseLiteral gives the value of a literal in a playbook, eg. the right hand
+// side of a condition. true, false and null are the JSON constants, numbers
+// are numbers and text in single or double quotes is a string. Anything else
+// is taken as an unquoted string.
+func ParseLiteral(s string) *ValueWrapper {
+	switch s {
+	case "true":
+		return &ValueWrapper{Kind: BoolValue, v: true}
+	case "false":
+		return &ValueWrapper{Kind: BoolValue, v: false}
+	case "null":
+		return &ValueWrapper{Kind: NullValue}
+	}
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return WrapStringValue(s[1 : len(s)-1])
+	}
+	if isNumber(s) {
+		return &ValueWrapper{Kind: NumberValue, v: json.Number(s)}
+	}
+	return WrapStringValue(s)
+}
+
+// IsScalar tells whether the value is not a list or a map
+func (v *ValueWrapper) IsScalar() bool {
+	return v.Kind != ListValue && v.Kind != MapValue
+}
+
+// Interface returns the value as decoded from JSON
+func (v *ValueWrapper) Interface() interface{} {
+	return v.v
+}
+
+// MarshalJSON encodes the value as JSON, keeping its type
+func (v *ValueWrapper) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.v)
+}
+
+// IterableString returns an array of string
+func (v *ValueWrapper) IterableString() []string {
+	vals := v.IterableWrappedVal()
+	r := make([]string, len(vals))
+	for i, val := range vals {
+		r[i] = val.StringVal()
+	}
+	return r
+}
+
+// IterableWrappedVal returns an array of *ValueWrapper. A list gives its
+// elements, a map its values in the order of the keys, null nothing and
+// any other value itself.
+func (v *ValueWrapper) IterableWrappedVal() []*ValueWrapper {
+	switch v.Kind {
+	case NullValue:
+		return []*ValueWrapper{}
+	case ListValue:
+		list := v.v.([]interface{})
+		r := make([]*ValueWrapper, len(list))
+		for i, e := range list {
+			r[i] = WrapValue(e)
+		}
+		return r
+	case MapValue:
+		m := v.v.(map[string]interface{})
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		r := make([]*ValueWrapper, len(keys))
+		for i, k := range keys {
+			r[i] = WrapValue(m[k])
+		}
+		return r
+	}
+	return []*ValueWrapper{v}
+}
+
+// StringVal gives the string value of the underlying object being held.
+// Numbers give their literal, null an empty string, and lists and maps
+// their compact JSON.
+func (v *ValueWrapper) StringVal() string {
+	switch t := v.v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	d, err := json.Marshal(v.v)
+	if err != nil {
+		return fmt.Sprintf("%v", v.v)
+	}
+	return string(d)
+}
+
+// AsString gives the string value of the underlying object being held.
+func (v *ValueWrapper) AsString() string {
+	return v.StringVal()
+}
+
+// Number gives the value as an exact decimal. Strings holding a number are
+// numbers too.
+func (v *ValueWrapper) Number() (*big.Rat, bool) {
+	var s string
+	switch t := v.v.(type) {
+	case json.Number:
+		s = t.String()
+	case string:
+		s = strings.TrimSpace(t)
+		if !isNumber(s) {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	r, ok := new(big.Rat).SetString(s)
+	return r, ok
+}
+
+// Bool gives the value as a boolean. The strings "true" and "false" are
+// booleans too.
+func (v *ValueWrapper) Bool() (bool, bool) {
+	switch t := v.v.(type) {
+	case bool:
+		return t, true
+	case string:
+		if t == "true" || t == "false" {
+			return t == "true", true
+		}
+	}
+	return false, false
+}
+
+// isNumber tells whether s is a decimal number, such as 50, -3, 50.5 or 1e3.
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		// Out of range numbers are still numbers.
+		if ne, ok := err.(*strconv.NumError); !ok || ne.Err != strconv.ErrRange {
+			return false
+		}
+	}
+	// ParseFloat also takes hex, inf and nan, which are not decimal numbers.
+	for _, c := range strings.ToLower(s) {
+		if !strings.ContainsRune("0123456789+-.e", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// CompareValues applies a comparison operator to two values, coercing them
+// as follows:
+//   - if both are numbers, or strings holding numbers, they are compared as
+//     exact decimals, so 50.5 > 50 and 0.10 == 0.1
+//   - if either is a boolean, the other must be a boolean or the string
+//     "true" or "false", and only == and != apply
+//   - null equals only null, and only == and != apply
+//   - lists and maps are equal when their elements are, and only == and !=
+//     apply
+//   - anything else is compared as strings, with == and != only
+func CompareValues(lhs *ValueWrapper, op string, rhs *ValueWrapper) (bool, error) {
+	if ln, ok := lhs.Number(); ok {
+		if rn, ok := rhs.Number(); ok {
+			c := ln.Cmp(rn)
+			switch op {
+			case "==":
+				return c == 0, nil
+			case "!=":
+				return c != 0, nil
+			case ">":
+				return c > 0, nil
+			case ">=":
+				return c >= 0, nil
+			case "<":
+				return c < 0, nil
+			case "<=":
+				return c <= 0, nil
+			}
+			return false, fmt.Errorf("unknown operator %q", op)
+		}
+	}
+
+	var equal bool
+	switch {
+	case lhs.Kind == BoolValue || rhs.Kind == BoolValue:
+		lb, lok := lhs.Bool()
+		rb, rok := rhs.Bool()
+		if !lok || !rok {
+			return false, fmt.Errorf("can not compare %s %s with %s %s",
+				lhs.Kind, lhs.StringVal(), rhs.Kind, rhs.StringVal())
+		}
+		equal = lb == rb
+	case lhs.Kind == NullValue || rhs.Kind == NullValue:
+		equal = lhs.Kind == rhs.Kind
+	case !lhs.IsScalar() || !rhs.IsScalar():
+		equal = lhs.Kind == rhs.Kind && valuesEqual(lhs.v, rhs.v)
+	default:
+		equal = lhs.StringVal() == rhs.StringVal()
+	}
+	switch op {
+	case "==":
+		return equal, nil
+	case "!=":
+		return !equal, nil
+	}
+	return false, fmt.Errorf("%s does not apply to %s %s and %s %s",
+		op, lhs.Kind, lhs.StringVal(), rhs.Kind, rhs.StringVal())
+}
+
+// valuesEqual compares values decoded from JSON, with numbers compared by
+// value.
+func valuesEqual(a interface{}, b interface{}) bool {
+	switch at := a.(type) {
+	case []interface{}:
+		bt, ok := b.([]interface{})
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for i := range at {
+			if !valuesEqual(at[i], bt[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bt, ok := b.(map[string]interface{})
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k, av := range at {
+			bv, ok := bt[k]
+			if !ok || !valuesEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+	av, bv := WrapValue(a), WrapValue(b)
+	if av.Kind == NumberValue && bv.Kind == NumberValue {
+		an, _ := av.Number()
+		bn, _ := bv.Number()
+		return an != nil && bn != nil && an.Cmp(bn) == 0
+	}
+	return reflect.DeepEqual(av.v, bv.v)
+}
@@ -0,0 +1,70 @@
+package execution
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLiteral(t *testing.T) {
+	assert := assert.New(t)
+	for literal, kind := range map[string]ValueKind{
+		"50": NumberValue, "-3": NumberValue, "50.5": NumberValue, "1e3": NumberValue,
+		"true": BoolValue, "false": BoolValue, "null": NullValue,
+		"abc": StringValue, "'50'": StringValue, `"true"`: StringValue, "0x10": StringValue, "inf": StringValue,
+	} {
+		assert.Equal(kind, ParseLiteral(literal).Kind, literal)
+	}
+	assert.Equal("50", ParseLiteral("'50'").StringVal())
+}
+
+func TestCompareValues(t *testing.T) {
+	assert := assert.New(t)
+
+	list := WrapValue([]interface{}{"a", 1.0})
+	for _, c := range []struct {
+		lhs      *ValueWrapper
+		op       string
+		rhs      *ValueWrapper
+		expected bool
+	}{
+		{ParseLiteral("50.5"), ">", ParseLiteral("50"), true},
+		{WrapStringValue("50.5"), ">", ParseLiteral("50"), true},
+		{ParseLiteral("0.10"), "==", ParseLiteral("0.1"), true},
+		{ParseLiteral("0.30000000000000001"), "==", ParseLiteral("0.3"), false},
+		{WrapValue(9.0), "<=", WrapStringValue("10"), true},
+		{ParseLiteral("true"), "==", WrapStringValue("true"), true},
+		{WrapValue(false), "!=", ParseLiteral("true"), true},
+		{WrapValue(nil), "==", ParseLiteral("null"), true},
+		{WrapStringValue(""), "==", ParseLiteral("null"), false},
+		{list, "==", WrapValue([]interface{}{"a", 1}), true},
+		{list, "!=", WrapValue([]interface{}{"a"}), true},
+		{WrapStringValue("abc"), "==", ParseLiteral("'abc'"), true},
+	} {
+		result, err := CompareValues(c.lhs, c.op, c.rhs)
+		desc := c.lhs.StringVal() + " " + c.op + " " + c.rhs.StringVal()
+		assert.Nil(err, desc)
+		assert.Equal(c.expected, result, desc)
+	}
+
+	for _, c := range [][2]*ValueWrapper{
+		{WrapStringValue("abc"), ParseLiteral("5")},
+		{ParseLiteral("true"), ParseLiteral("false")},
+		{WrapValue(nil), ParseLiteral("5")},
+		{list, list},
+	} {
+		_, err := CompareValues(c[0], ">", c[1])
+		assert.NotNil(err)
+	}
+	_, err := CompareValues(WrapStringValue("yes"), "==", ParseLiteral("true"))
+	assert.NotNil(err)
+}
+
+func TestIterableWrappedVal(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"a", "1", "true"}, WrapValue([]interface{}{"a", 1, true}).IterableString())
+	assert.Equal([]string{"1", "2"}, WrapValue(map[string]interface{}{"y": 2, "x": 1}).IterableString())
+	assert.Equal([]string{"a"}, WrapStringValue("a").IterableString())
+	assert.Len(WrapValue(nil).IterableWrappedVal(), 0)
+}
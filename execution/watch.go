@@ -0,0 +1,111 @@
+package execution
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// stateWatch is shared by the ExecStates of an execution. It wakes the
+// readers waiting for a value whenever a state changes, and keeps track of
+// the nodes expected to run, which are the only ones that may still produce
+// values.
+type stateWatch struct {
+	mu sync.Mutex
+	// changed is closed, and replaced, on every change
+	changed chan struct{}
+	// version counts the changes of the states
+	version uint64
+	// onChange, if set, is called after every change
+	onChange func()
+	// expected counts the runs to come or in progress of each node, and
+	// exporting those of the nodes exporting each var
+	expected  map[string]int
+	exporting map[string]int
+}
+
+func newStateWatch() *stateWatch {
+	return &stateWatch{
+		changed:   make(chan struct{}),
+		expected:  make(map[string]int),
+		exporting: make(map[string]int),
+	}
+}
+
+// next returns a channel that is closed at the next change.
+func (w *stateWatch) next() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.changed
+}
+
+// tick returns the version of a new change.
+func (w *stateWatch) tick() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.version++
+	return w.version
+}
+
+// current returns the version of the last change.
+func (w *stateWatch) current() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.version
+}
+
+// notify wakes the readers waiting for a change.
+func (w *stateWatch) notify() {
+	w.mu.Lock()
+	close(w.changed)
+	w.changed = make(chan struct{})
+	onChange := w.onChange
+	w.mu.Unlock()
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// expect records that a node with these exports is going to run.
+func (w *stateWatch) expect(nodeID string, exports map[string]string) {
+	w.mu.Lock()
+	w.expected[nodeID]++
+	for name := range exports {
+		w.exporting[name]++
+	}
+	w.mu.Unlock()
+	w.notify()
+}
+
+// settle records that a run of a node expected to run is over, because it is
+// done, failed or skipped. Its results must be written before.
+func (w *stateWatch) settle(nodeID string, exports map[string]string) {
+	w.mu.Lock()
+	w.expected[nodeID]--
+	for name := range exports {
+		w.exporting[name]--
+	}
+	w.mu.Unlock()
+	w.notify()
+}
+
+// unproducible returns why no node expected to run can produce the value of
+// a variable, or "" if one may.
+func (w *stateWatch) unproducible(name string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case strings.HasPrefix(name, "@node:"):
+		nodeID := strings.SplitN(strings.TrimPrefix(name, "@node:"), "$", 2)[0]
+		if w.expected[nodeID] == 0 {
+			return fmt.Sprintf("node %s has not run", nodeID)
+		}
+	case strings.HasPrefix(name, "$"):
+		if w.exporting[name[1:]] == 0 {
+			return "no node that exports it has run"
+		}
+	default:
+		return "it is not a variable"
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"rptsec.com/amg/execution"
+)
+
+// runExplain implements `amg explain <playbook>`, which describes in words
+// what the playbook does and the alert fields it reads.
+func runExplain(args []string) int {
+	fs := newFlagSet("explain", "<playbook>")
+	parseArgs(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", fs.Arg(0), err.Error())
+		return exitInvalidPlaybook
+	}
+	nodes, err := execution.NewNodesFromYaml(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	// Nodes that can not be executed are reported with the problems below.
+	execution.ConvertToLinkedNodes(nodes)
+
+	e := &explainer{w: os.Stdout, alertFields: map[string]bool{}}
+	e.collectAlertFields(nodes)
+	fmt.Fprintf(e.w, "Playbook %s\n", fs.Arg(0))
+	if len(e.alertFields) > 0 {
+		var fields []string
+		for f := range e.alertFields {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		fmt.Fprintf(e.w, "Reads alert fields: %s\n", strings.Join(fields, ", "))
+	}
+	fmt.Fprintln(e.w)
+	e.explain(nodes, "", "")
+	if problems := execution.Validate(data); len(problems) > 0 {
+		fmt.Fprintln(e.w)
+		for _, p := range problems {
+			fmt.Fprintf(e.w, "Warning: %s\n", p.String())
+		}
+	}
+	return exitOK
+}
+
+type explainer struct {
+	w           io.Writer
+	alertFields map[string]bool
+}
+
+func (e *explainer) collectAlertFields(nodes []execution.N) {
+	note := func(ref string) {
+		if strings.HasPrefix(ref, "@alert:") {
+			e.alertFields[strings.TrimPrefix(ref, "@alert:")] = true
+		}
+	}
+	for _, n := range nodes {
+		for _, v := range n.Params {
+			for _, ref := range execution.ParamRefs(v) {
+				note(ref)
+			}
+		}
+		for _, v := range execution.NewCondition(n.Condition).UnknownVarsList() {
+			note(v)
+		}
+		e.collectAlertFields(n.OnTrue)
+		e.collectAlertFields(n.OnFalse)
+	}
+}
+
+// explain writes a numbered step for each node, eg. "3.1." for the first node
+// on a path of step 3.
+func (e *explainer) explain(nodes []execution.N, number string, indent string) {
+	for i, n := range nodes {
+		step := fmt.Sprintf("%s%d.", number, i+1)
+		switch n.NodeType {
+		case "if":
+			fmt.Fprintf(e.w, "%s%s %s: if %s\n", indent, step, n.ID, e.condition(n.Condition))
+			fmt.Fprintf(e.w, "%s   then:\n", indent)
+			e.explainBranch(n.OnTrue, step, indent+"     ")
+			fmt.Fprintf(e.w, "%s   otherwise:\n", indent)
+			e.explainBranch(n.OnFalse, step, indent+"     ")
+		default:
+			fmt.Fprintf(e.w, "%s%s %s: call %s\n", indent, step, n.ID, n.Urn)
+			for _, param := range sortedParams(n.Params) {
+				optional := ""
+				if n.OptionalParams[param] {
+					optional = ", left out if it can not be resolved"
+				}
+				fmt.Fprintf(e.w, "%s     with %s = %s%s\n", indent, param, describeRef(n.Params[param]), optional)
+			}
+			for _, name := range sortedParams(n.Exports) {
+				fmt.Fprintf(e.w, "%s     export %s as $%s\n", indent, describeExport(n.Exports[name]), name)
+			}
+		}
+	}
+}
+
+func (e *explainer) explainBranch(nodes []execution.N, number string, indent string) {
+	if len(nodes) == 0 {
+		fmt.Fprintf(e.w, "%sdo nothing\n", indent)
+		return
+	}
+	e.explain(nodes, number, indent)
+}
+
+func (e *explainer) condition(expr string) string {
+	lhs, op, rhs := execution.NewCondition(expr).Operands()
+	if op == "" {
+		return expr
+	}
+	return fmt.Sprintf("%s %s %s", describeRef(lhs), op, describeRef(rhs))
+}
+
+// describeRef describes a param value or condition operand.
+func describeRef(ref string) string {
+	switch {
+	case execution.IsTemplate(ref):
+		return fmt.Sprintf("the text %q", ref)
+	case strings.Contains(ref, "??"):
+		parts := strings.SplitN(ref, "??", 2)
+		return fmt.Sprintf("%s, or %s if it has no value",
+			describeRef(strings.TrimSpace(parts[0])), describeRef(strings.TrimSpace(parts[1])))
+	case strings.HasPrefix(ref, "@alert:"):
+		return "alert field " + strings.TrimPrefix(ref, "@alert:")
+	case strings.HasPrefix(ref, "@node:"):
+		parts := strings.SplitN(strings.TrimPrefix(ref, "@node:"), "$", 2)
+		if len(parts) == 2 {
+			return fmt.Sprintf("%s from the result of %s", parts[1], parts[0])
+		}
+		return "the result of " + parts[0]
+	case strings.HasPrefix(ref, "$"):
+		return "exported var " + ref
+	}
+	return fmt.Sprintf("%q", ref)
+}
+
+func describeExport(expr string) string {
+	if expr == "result" {
+		return "the raw result"
+	}
+	return "result field " + expr
+}
+
+func sortedParams(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+
+	"rptsec.com/amg/execution"
+)
+
+// runFmt implements `amg fmt <playbook>...`, which rewrites playbooks in a
+// consistent layout.
+func runFmt(args []string) int {
+	fs := newFlagSet("fmt", "[flags] <playbook>...")
+	list := fs.Bool("l", false, "List the playbooks whose formatting differs")
+	write := fs.Bool("w", false, "Write the result to the playbook instead of stdout")
+	parseArgs(fs, args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	exitCode := exitOK
+	for _, path := range fs.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", path, err.Error())
+			exitCode = exitInvalidPlaybook
+			continue
+		}
+		formatted, err := formatPlaybook(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			exitCode = exitInvalidPlaybook
+			continue
+		}
+		changed := !bytes.Equal(data, formatted)
+		if *list && changed {
+			fmt.Println(path)
+		}
+		if *write && changed {
+			if err := ioutil.WriteFile(path, formatted, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				exitCode = exitInvalidPlaybook
+			}
+		}
+		if !*list && !*write {
+			os.Stdout.Write(formatted)
+		}
+	}
+	return exitCode
+}
+
+// formatPlaybook re-encodes a playbook with sequences and mappings indented
+// by two spaces and a blank line between nodes. Comments, the order of keys
+// and the quoting of values are kept.
+func formatPlaybook(data []byte) ([]byte, error) {
+	if _, err := execution.NewNodesFromYaml(data); err != nil {
+		return nil, err
+	}
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml3.DocumentNode || len(doc.Content) == 0 {
+		return data, nil
+	}
+	p := &playbookPrinter{}
+	p.comment(doc.HeadComment, "")
+	root := doc.Content[0]
+	p.comment(root.HeadComment, "")
+	switch {
+	case root.Kind == yaml3.SequenceNode && root.Style&yaml3.FlowStyle == 0:
+		p.sequence(root, "")
+	default:
+		if err := p.inline(root, ""); err != nil {
+			return nil, err
+		}
+		p.b.WriteString("\n")
+	}
+	p.comment(root.FootComment, "")
+	p.comment(doc.FootComment, "")
+	return p.b.Bytes(), p.err
+}
+
+// playbookPrinter writes yaml in the layout that the playbooks use.
+type playbookPrinter struct {
+	b   bytes.Buffer
+	err error
+}
+
+func (p *playbookPrinter) comment(c string, indent string) {
+	if c == "" {
+		return
+	}
+	for _, line := range strings.Split(c, "\n") {
+		p.b.WriteString(indent + line + "\n")
+	}
+}
+
+func (p *playbookPrinter) lineComment(n *yaml3.Node) {
+	if n.LineComment != "" {
+		p.b.WriteString(" " + n.LineComment)
+	}
+}
+
+// block reports whether n is written over several lines.
+func block(n *yaml3.Node) bool {
+	return (n.Kind == yaml3.MappingNode || n.Kind == yaml3.SequenceNode) &&
+		n.Style&yaml3.FlowStyle == 0 && len(n.Content) > 0
+}
+
+// sequence writes the items of a block sequence, each starting with "- " at
+// indent. Nodes of the playbook are separated by a blank line.
+func (p *playbookPrinter) sequence(n *yaml3.Node, indent string) {
+	for i, item := range n.Content {
+		if i > 0 && item.Kind == yaml3.MappingNode {
+			p.b.WriteString("\n")
+		}
+		p.comment(item.HeadComment, indent)
+		if item.Kind == yaml3.MappingNode && len(item.Content) > 0 {
+			// yaml.v3 attaches a comment above "- key:" to the key.
+			p.comment(item.Content[0].HeadComment, indent)
+		}
+		p.b.WriteString(indent + "- ")
+		switch {
+		case item.Kind == yaml3.MappingNode && block(item):
+			p.mapping(item, indent+"  ", true)
+		case block(item):
+			p.b.WriteString("\n")
+			p.sequence(item, indent+"  ")
+		default:
+			p.inline(item, indent+"  ")
+			p.lineComment(item)
+			p.b.WriteString("\n")
+		}
+		p.comment(item.FootComment, indent)
+	}
+}
+
+// mapping writes the entries of a block mapping at indent. When first is set
+// the first key follows a "- " already written.
+func (p *playbookPrinter) mapping(n *yaml3.Node, indent string, first bool) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, val := n.Content[i], n.Content[i+1]
+		if !(first && i == 0) {
+			p.comment(key.HeadComment, indent)
+			p.b.WriteString(indent)
+		}
+		p.inline(key, indent)
+		p.b.WriteString(":")
+		switch {
+		case val.Kind == yaml3.MappingNode && block(val):
+			p.lineComment(key)
+			p.b.WriteString("\n")
+			p.comment(val.HeadComment, indent+"  ")
+			p.mapping(val, indent+"  ", false)
+		case block(val):
+			p.lineComment(key)
+			p.b.WriteString("\n")
+			p.comment(val.HeadComment, indent+"  ")
+			p.sequence(val, indent+"  ")
+		default:
+			p.b.WriteString(" ")
+			p.inline(val, indent+"  ")
+			p.lineComment(key)
+			p.lineComment(val)
+			p.b.WriteString("\n")
+		}
+		p.comment(key.FootComment, indent)
+	}
+}
+
+// inline writes a scalar or flow collection as yaml.v3 encodes it. Values
+// spanning several lines, such as literal blocks, continue at indent.
+func (p *playbookPrinter) inline(n *yaml3.Node, indent string) error {
+	c := *n
+	c.HeadComment, c.LineComment, c.FootComment = "", "", ""
+	if c.Kind == yaml3.MappingNode || c.Kind == yaml3.SequenceNode {
+		c.Style |= yaml3.FlowStyle
+	}
+	d, err := yaml3.Marshal(&c)
+	if err != nil {
+		if p.err == nil {
+			p.err = err
+		}
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")
+	p.b.WriteString(lines[0])
+	// The continuation lines are re-indented from the indentation that
+	// yaml.v3 gave them.
+	strip := -1
+	for _, line := range lines[1:] {
+		if trimmed := strings.TrimLeft(line, " "); trimmed != "" {
+			if n := len(line) - len(trimmed); strip < 0 || n < strip {
+				strip = n
+			}
+		}
+	}
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			p.b.WriteString("\n")
+			continue
+		}
+		if strip > 0 {
+			line = line[strip:]
+		}
+		p.b.WriteString("\n" + indent + line)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatPlaybook(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook := `# header
+- id: a   # first
+  urn:  x
+  params: {a: 1, b: "two"}
+  desc: |
+      line one
+      line two
+# before if
+- type: "if"
+  condition: "@node:a$x == 1"
+  onTrue:
+      # inside
+      - urn: y
+  onFalse: []`
+	formatted, err := formatPlaybook([]byte(playbook))
+	assert.Nil(err)
+	assert.Equal(`# header
+- id: a # first
+  urn: x
+  params: {a: 1, b: "two"}
+  desc: |
+    line one
+    line two
+
+# before if
+- type: "if"
+  condition: "@node:a$x == 1"
+  onTrue:
+    # inside
+    - urn: y
+  onFalse: []
+`, string(formatted))
+
+	again, err := formatPlaybook(formatted)
+	assert.Nil(err)
+	assert.Equal(string(formatted), string(again))
+
+	_, err = formatPlaybook([]byte("- id: [unclosed"))
+	assert.NotNil(err)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"rptsec.com/amg/execution"
+)
+
+// runFunctions implements `amg functions`, which lists the functions usable
+// in conditions and templates with their signatures, eg. for editors to
+// complete and check them.
+func runFunctions(args []string) int {
+	fs := newFlagSet("functions", "[flags]")
+	out := addOutputFlags(fs, "text", "text|json|yaml")
+	parseArgs(fs, args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	functions := execution.Functions()
+	w := out.stdout()
+	if *out.format == "text" {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, f := range functions {
+			fmt.Fprintf(tw, "%s\t%s\n", signature(f), f.Doc)
+		}
+		tw.Flush()
+		return exitOK
+	}
+	d, err := out.marshal(functions)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	w.Write(d)
+	return exitOK
+}
+
+// signature formats a function as `name(string, any) bool`.
+func signature(f execution.FunctionInfo) string {
+	params := make([]string, len(f.Params))
+	for i, p := range f.Params {
+		params[i] = string(p)
+	}
+	if f.Variadic {
+		params[len(params)-1] += "..."
+	}
+	return fmt.Sprintf("%s(%s) %s", f.Name, strings.Join(params, ", "), f.Result)
+}
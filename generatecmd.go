@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	y "github.com/ghodss/yaml"
+
+	"rptsec.com/amg/execution"
+	"rptsec.com/amg/testsuite"
+)
+
+// runGenerate implements `amg generate`, which writes a skeleton test suite
+// with a case for every path through the playbook.
+func runGenerate(args []string) int {
+	fs := newFlagSet("generate", "[flags] [<playbook>]")
+	playbookFile := fs.String("playbook", "", "Playbook to generate the test suite for, if not given as an argument")
+	outFile := fs.String("out", "", "File where the suite is written, instead of stdout")
+	parseArgs(fs, args)
+	if fs.NArg() > 1 || (fs.NArg() == 1 && *playbookFile != "") {
+		fs.Usage()
+		return exitUsage
+	}
+	if fs.NArg() == 1 {
+		*playbookFile = fs.Arg(0)
+	}
+	if *playbookFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+
+	yamlData, err := ioutil.ReadFile(*playbookFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", *playbookFile, err.Error())
+		return exitInvalidPlaybook
+	}
+	nodes, err := execution.NewNodesFromYaml(yamlData)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	if _, err := execution.ConvertToLinkedNodes(nodes); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+
+	// The playbook is referred to relative to the suite file.
+	playbookRef := *playbookFile
+	if *outFile != "" {
+		if abs, err := filepath.Abs(*playbookFile); err == nil {
+			if outDir, err := filepath.Abs(filepath.Dir(*outFile)); err == nil {
+				if rel, err := filepath.Rel(outDir, abs); err == nil {
+					playbookRef = rel
+				}
+			}
+		}
+	}
+	suite, generated := testsuite.GenerateSuite(playbookRef, nodes)
+	for _, g := range generated {
+		if g.Infeasible != "" {
+			fmt.Fprintf(os.Stderr, "skipped path %s: %s\n", g.Path.Describe(), g.Infeasible)
+		}
+	}
+
+	d, err := y.Marshal(suite)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+	if *outFile == "" {
+		os.Stdout.Write(d)
+		return exitOK
+	}
+	if err := os.MkdirAll(filepath.Dir(*outFile), 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+	if err := ioutil.WriteFile(*outFile, d, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d cases to %s\n", len(suite.Cases), *outFile)
+	return exitOK
+}
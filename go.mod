@@ -6,4 +6,5 @@ require (
 	github.com/ghodss/yaml v1.0.0
 	github.com/stretchr/testify v1.7.0
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
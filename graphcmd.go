@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"rptsec.com/amg/execution"
+)
+
+// runGraph implements `amg graph <playbook>`, which prints the flow of the
+// playbook as a Graphviz DOT or Mermaid graph.
+func runGraph(args []string) int {
+	fs := newFlagSet("graph", "[flags] <playbook>")
+	format := fs.String("format", "dot", "Format of the graph: dot|mermaid")
+	parseArgs(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *format != "dot" && *format != "mermaid" {
+		fmt.Fprintf(os.Stderr, "unknown graph format: %s\n", *format)
+		return exitUsage
+	}
+
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", fs.Arg(0), err.Error())
+		return exitInvalidPlaybook
+	}
+	nodes, err := execution.NewNodesFromYaml(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+	if _, err := execution.ConvertToLinkedNodes(nodes); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitInvalidPlaybook
+	}
+
+	g := &graph{}
+	tails := g.add(nodes, []graphEdge{{from: "start"}})
+	g.connect(tails, "end")
+	if *format == "mermaid" {
+		g.writeMermaid(os.Stdout)
+	} else {
+		g.writeDot(os.Stdout, fs.Arg(0))
+	}
+	return exitOK
+}
+
+type graphNode struct {
+	id, label string
+	decision  bool
+}
+
+type graphEdge struct {
+	from, to, label string
+}
+
+type graph struct {
+	nodes []graphNode
+	edges []graphEdge
+}
+
+// add adds the nodes in sequence after the open edges in preds, and returns
+// the edges left open after the last node.
+func (g *graph) add(nodes []execution.N, preds []graphEdge) []graphEdge {
+	for i := range nodes {
+		n := &nodes[i]
+		g.connect(preds, n.ID)
+		switch n.NodeType {
+		case "if":
+			g.nodes = append(g.nodes, graphNode{n.ID, n.ID + "\n" + n.Condition, true})
+			preds = append(g.add(n.OnTrue, []graphEdge{{from: n.ID, label: "true"}}),
+				g.add(n.OnFalse, []graphEdge{{from: n.ID, label: "false"}})...)
+		default:
+			g.nodes = append(g.nodes, graphNode{n.ID, n.ID + "\n" + n.Urn, false})
+			preds = []graphEdge{{from: n.ID}}
+		}
+	}
+	return preds
+}
+
+func (g *graph) connect(preds []graphEdge, to string) {
+	for _, e := range preds {
+		e.to = to
+		g.edges = append(g.edges, e)
+	}
+}
+
+func (g *graph) writeDot(w io.Writer, name string) {
+	fmt.Fprintf(w, "digraph %q {\n", name)
+	fmt.Fprintf(w, "  node [shape=box];\n")
+	fmt.Fprintf(w, "  \"start\" [shape=circle];\n  \"end\" [shape=doublecircle];\n")
+	for _, n := range g.nodes {
+		shape := ""
+		if n.decision {
+			shape = "shape=diamond, "
+		}
+		fmt.Fprintf(w, "  %q [%slabel=%q];\n", n.id, shape, n.label)
+	}
+	for _, e := range g.edges {
+		if e.label != "" {
+			fmt.Fprintf(w, "  %q -> %q [label=%q];\n", e.from, e.to, e.label)
+		} else {
+			fmt.Fprintf(w, "  %q -> %q;\n", e.from, e.to)
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func (g *graph) writeMermaid(w io.Writer) {
+	// Mermaid ids can not hold every character that node ids can, and "end" is
+	// a keyword.
+	ids := map[string]string{"start": "start", "end": "stop"}
+	for i, n := range g.nodes {
+		ids[n.id] = fmt.Sprintf("n%d", i+1)
+	}
+	label := func(s string) string {
+		return strings.NewReplacer("\n", "<br/>", `"`, "#quot;").Replace(s)
+	}
+	fmt.Fprintf(w, "flowchart TD\n")
+	fmt.Fprintf(w, "  start((start))\n  stop(((end)))\n")
+	for _, n := range g.nodes {
+		if n.decision {
+			fmt.Fprintf(w, "  %s{\"%s\"}\n", ids[n.id], label(n.label))
+		} else {
+			fmt.Fprintf(w, "  %s[\"%s\"]\n", ids[n.id], label(n.label))
+		}
+	}
+	for _, e := range g.edges {
+		if e.label != "" {
+			fmt.Fprintf(w, "  %s -->|%s| %s\n", ids[e.from], e.label, ids[e.to])
+		} else {
+			fmt.Fprintf(w, "  %s --> %s\n", ids[e.from], ids[e.to])
+		}
+	}
+}
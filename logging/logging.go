@@ -0,0 +1,245 @@
+// Package logging is the structured, leveled logger of the engine. Messages
+// carry fields, such as the execution, node and urn they are about, and are
+// written as text or JSON lines. Programs embedding the engine can send them
+// to their own logging by implementing Logger.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message.
+type Level int
+
+const (
+	// DebugLevel is for the steps of the engine, such as resolved variables
+	DebugLevel Level = iota
+	// InfoLevel is for the start and end of executions
+	InfoLevel
+	// WarnLevel is for failed nodes and executions
+	WarnLevel
+	// ErrorLevel is for errors outside of the playbook, such as unreadable
+	// mock files
+	ErrorLevel
+	// OffLevel logs nothing
+	OffLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > OffLevel {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s: debug, info, warn, error or off.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return OffLevel, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// Format is how messages are written.
+type Format string
+
+const (
+	// TextFormat writes a line of key=value pairs per message
+	TextFormat Format = "text"
+	// JSONFormat writes a JSON object per message
+	JSONFormat Format = "json"
+)
+
+// ParseFormat returns the format named s: text or json.
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case TextFormat, JSONFormat:
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("unknown log format %q, expected text or json", s)
+}
+
+// Field is a key and value attached to a message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field.
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Logger receives the messages of the engine. It must be safe for concurrent
+// use.
+type Logger interface {
+	Log(level Level, msg string, fields []Field)
+}
+
+type nop struct{}
+
+func (nop) Log(Level, string, []Field) {}
+
+// Nop discards every message.
+var Nop Logger = nop{}
+
+// Debug logs a message at DebugLevel.
+func Debug(l Logger, msg string, fields ...Field) {
+	l.Log(DebugLevel, msg, fields)
+}
+
+// Info logs a message at InfoLevel.
+func Info(l Logger, msg string, fields ...Field) {
+	l.Log(InfoLevel, msg, fields)
+}
+
+// Warn logs a message at WarnLevel.
+func Warn(l Logger, msg string, fields ...Field) {
+	l.Log(WarnLevel, msg, fields)
+}
+
+// Error logs a message at ErrorLevel.
+func Error(l Logger, msg string, fields ...Field) {
+	l.Log(ErrorLevel, msg, fields)
+}
+
+type withFields struct {
+	l      Logger
+	fields []Field
+}
+
+// With returns a logger that adds fields to the messages it logs to l,
+// before their own fields.
+func With(l Logger, fields ...Field) Logger {
+	if w, ok := l.(*withFields); ok {
+		return &withFields{w.l, append(append([]Field(nil), w.fields...), fields...)}
+	}
+	return &withFields{l, fields}
+}
+
+func (w *withFields) Log(level Level, msg string, fields []Field) {
+	w.l.Log(level, msg, append(append([]Field(nil), w.fields...), fields...))
+}
+
+type writerLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+	now    func() time.Time
+}
+
+// New returns a logger that writes the messages at level and above to w, one
+// per line.
+func New(w io.Writer, level Level, format Format) Logger {
+	return &writerLogger{w: w, level: level, format: format, now: time.Now}
+}
+
+func (l *writerLogger) Log(level Level, msg string, fields []Field) {
+	if level < l.level || level >= OffLevel {
+		return
+	}
+	var buf bytes.Buffer
+	ts := l.now().UTC().Format(time.RFC3339Nano)
+	if l.format == JSONFormat {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, ts)
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for _, f := range fields {
+			buf.WriteByte(',')
+			writeJSON(&buf, f.Key)
+			buf.WriteByte(':')
+			writeJSON(&buf, f.Value)
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "time=%s level=%s msg=%s", ts, level, quote(msg))
+		for _, f := range fields {
+			fmt.Fprintf(&buf, " %s=%s", f.Key, quote(textValue(f.Value)))
+		}
+		buf.WriteByte('\n')
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// writeJSON writes v as JSON, or as a JSON string of its text when it can not
+// be encoded.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		d, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(d)
+}
+
+// textValue formats a value of the text format. Values that are not strings,
+// errors, Stringers or numbers are written as JSON, without the quotes of a
+// JSON string.
+func textValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case nil, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v)
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	var s string
+	if json.Unmarshal(d, &s) == nil {
+		return s
+	}
+	return string(d)
+}
+
+// quote quotes s if it is empty or holds spaces, quotes or equal signs.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = Nop
+)
+
+// Default returns the logger of the executions that are not given one, which
+// discards every message unless set with SetDefault.
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+// SetDefault sets the logger returned by Default.
+func SetDefault(l Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	l := New(&buf, InfoLevel, TextFormat).(*writerLogger)
+	l.now = func() time.Time { return time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC) }
+	ex := With(l, F("execution", "7"))
+	Debug(ex, "resolved variable", F("var", "$score"))
+	Info(With(ex, F("node", "vt")), "action done", F("params", map[string]string{"ip": "10.0.0.1"}),
+		F("duration", 1500*time.Microsecond))
+	Warn(ex, "node failed", F("error", errors.New("no mock")), F("empty", ""))
+	assert.Equal(`time=2026-01-02T03:04:05Z level=info msg="action done" execution=7 node=vt `+
+		`params="{\"ip\":\"10.0.0.1\"}" duration=1.5ms
+time=2026-01-02T03:04:05Z level=warn msg="node failed" execution=7 error="no mock" empty=""
+`, buf.String())
+
+	buf.Reset()
+	l.format = JSONFormat
+	Error(ex, "failed", F("count", 2), F("values", []string{"a"}))
+	assert.Equal(`{"time":"2026-01-02T03:04:05Z","level":"error","msg":"failed","execution":"7","count":2,"values":["a"]}
+`, buf.String())
+
+	level, err := ParseLevel("DEBUG")
+	assert.Nil(err)
+	assert.Equal(DebugLevel, level)
+	_, err = ParseLevel("loud")
+	assert.EqualError(err, `unknown log level "loud", expected one of debug, info, warn, error, off`)
+	_, err = ParseFormat("xml")
+	assert.NotNil(err)
+}
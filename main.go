@@ -1,78 +1,73 @@
 package main
 
 import (
-	"encoding/json"
-	"flag"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
 	"os"
-
-	y "github.com/ghodss/yaml"
-	// TODO: Use this for yaml parsing. Its a fork of below - "sigs.k8s.io/yaml"
-	"gopkg.in/yaml.v2" // https://github.com/go-yaml/yaml
-
-	"rptsec.com/amg/execution"
+	"strings"
 )
 
-func main() {
-	fmt.Println("My favorite number is", rand.Intn(10))
-	mockScenariosFile := flag.String("mock-scenario-file", "resources/sample-mock-scenario.json", "File with scenarios that Action-Store should mock")
-	playbookFile := flag.String("playbook", "resources/sample-playbook.yaml", "Playbook file that will be executed")
-	alertsDataFile := flag.String("alert-data-file", "resources/sample-alert-data.json", "File that contains the alert data")
-	resultFile := flag.String("result-file", "/tmp/result.yaml", "File where the result will be written")
+// commands maps the name of each subcommand to the function implementing it.
+// The function is given the arguments after the name and returns the exit code.
+var commands = map[string]func([]string) int{
+	"run":       runPlaybook,
+	"validate":  runValidate,
+	"test":      runTests,
+	"graph":     runGraph,
+	"fmt":       runFmt,
+	"explain":   runExplain,
+	"backtest":  runBacktest,
+	"compare":   runCompare,
+	"generate":  runGenerate,
+	"mutate":    runMutate,
+	"property":  runProperty,
+	"functions": runFunctions,
+}
 
-	yamlData, err := ioutil.ReadFile(*playbookFile)
-	if err != nil {
-		fmt.Printf("Error reading %s, Err: %s\n", *playbookFile, err.Error())
-		return
-	}
-	var yamlNodes []execution.N = make([]execution.N, 0, 10)
-	err = yaml.Unmarshal(yamlData, &yamlNodes)
-	if err != nil {
-		fmt.Printf("Error in unmarshalling: %s\n", err.Error())
-		return
-	}
+const usage = `Usage: amg <command> [flags] [arguments]
 
-	e, _ := yaml.Marshal(yamlNodes)
-	fmt.Printf("Nodes into Yaml as-is: \n%s", string(e))
+Commands:
+  run       execute a playbook against mocked actions and print the result
+  validate  check playbooks for errors without executing them
+  test      run test suites
+  graph     print the flow of a playbook as a DOT or Mermaid graph
+  fmt       format playbooks
+  explain   describe what a playbook does
+  backtest  replay a corpus of alerts and report the distribution of outcomes
+  compare   report the alerts whose outcome differs between two playbook versions
+  generate  generate a test suite with a case for every path of a playbook
+  mutate    run test suites against mutants of their playbook
+  property  check invariants of a playbook against generated alerts
+  functions list the functions usable in conditions and templates
 
-	var playbook *execution.Playbook = &execution.Playbook{
-		FirstNode: execution.ConvertToLinkedNodes(yamlNodes)}
-	if playbook == nil {
-		fmt.Printf("Error in building playbook from yaml nodes\n")
-		return
-	}
+Run 'amg <command> -h' for the flags of a command.
 
-	alertsData, err := ioutil.ReadFile(*alertsDataFile)
-	if err != nil {
-		fmt.Printf("Error reading %s, Err: %s\n", *alertsDataFile, err.Error())
-		return
+Exit codes:
+  0  success
+  1  a test, golden comparison, comparison or check failed, or output could
+     not be written
+  2  bad usage
+  3  invalid playbook or input file
+  4  the playbook failed to execute
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(exitUsage)
 	}
-	var initialValues map[string]string
-	if err := json.Unmarshal(alertsData, &initialValues); err != nil {
-		fmt.Printf("Unable to parse the alerts data, Err: %s\n", err.Error())
-		return
+	name := os.Args[1]
+	if name == "-h" || name == "--help" || name == "help" {
+		fmt.Print(usage)
+		os.Exit(exitOK)
 	}
-
-	fmt.Printf("Executing playbook at: %s, for alert data at: %s, with mock scenarios at: %s",
-		*playbookFile, *alertsDataFile, *mockScenariosFile)
-	ex := execution.NewExecution(playbook, initialValues, *mockScenariosFile)
-	ex.Start()
-	es := ex.Status(1)
-	execution.UpdateWithResultStatus(&yamlNodes, es)
-
-	d, err := y.Marshal(yamlNodes)
-	if err != nil {
-		fmt.Printf("Its fatal: %v", err)
+	// Flags without a command run the playbook, as amg did before it had commands.
+	if strings.HasPrefix(name, "-") {
+		os.Exit(runPlaybook(os.Args[1:]))
 	}
-	fmt.Printf("--- t dump:\n%s\n\n", string(d))
-
-	j, err := json.Marshal(yamlNodes)
-	if err == nil {
-		fmt.Printf("\n\n JSON: \n %s", string(j))
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "amg: unknown command %q\n\n%s", name, usage)
+		os.Exit(exitUsage)
 	}
-
-	ioutil.WriteFile(*resultFile, d, os.ModeAppend)
-	fmt.Printf("\nDONE\n")
+	os.Exit(command(os.Args[2:]))
 }
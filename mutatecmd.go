@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"rptsec.com/amg/testsuite"
+)
+
+// runMutate implements `amg mutate <suite-file>...`, which runs each suite
+// against mutants of its playbook and reports the mutants that survived.
+func runMutate(args []string) int {
+	fs := newFlagSet("mutate", "[flags] <suite-file>...")
+	minScore := fs.Float64("min-score", 0, "Fail when the percentage of mutants killed is below this")
+	logs := addLogFlags(fs)
+	parseArgs(fs, args)
+	if !logs.setup() {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	exitCode := exitOK
+	var reports []*testsuite.MutationReport
+	for _, path := range fs.Args() {
+		s, err := testsuite.LoadSuite(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			exitCode = exitInvalidPlaybook
+			continue
+		}
+		r, err := s.Mutate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			exitCode = exitFailure
+			continue
+		}
+		if r.Score() < *minScore {
+			exitCode = exitFailure
+		}
+		reports = append(reports, r)
+	}
+	testsuite.WriteMutationText(os.Stdout, reports)
+	return exitCode
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"rptsec.com/amg/testsuite"
+)
+
+// runProperty implements `amg property <spec-file>...`, which runs each
+// playbook against generated alerts and checks the invariants of the spec.
+func runProperty(args []string) int {
+	fs := newFlagSet("property", "[flags] <spec-file>...")
+	runs := fs.Int("runs", 0, "Number of alerts to generate, overriding the spec")
+	seed := fs.Int64("seed", 0, "Seed of the random generator, overriding the spec")
+	logs := addLogFlags(fs)
+	parseArgs(fs, args)
+	if !logs.setup() {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	exitCode := exitOK
+	var results []*testsuite.PropertyResult
+	for _, path := range fs.Args() {
+		p, err := testsuite.LoadPropertySpec(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			exitCode = exitInvalidPlaybook
+			continue
+		}
+		if *runs > 0 {
+			p.Runs = *runs
+		}
+		if *seed != 0 {
+			p.Seed = *seed
+		}
+		r := p.Check()
+		if !r.Passed() {
+			exitCode = exitFailure
+		}
+		results = append(results, r)
+	}
+	testsuite.WritePropertyText(os.Stdout, results)
+	return exitCode
+}
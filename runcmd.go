@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/batch"
+	"rptsec.com/amg/execution"
+	"rptsec.com/amg/testsuite"
+)
+
+// runPlaybook implements `amg run`, which executes a playbook against mocked
+// actions and prints the playbook annotated with the result of every node.
+// Without an alert data file, the alerts are read from stdin when it is not a
+// terminal, and a JSON record is printed for each of them.
+func runPlaybook(args []string) int {
+	fs := newFlagSet("run", "[flags] [<playbook>]")
+	playbookFile := fs.String("playbook", "", "Playbook file that will be executed, if not given as an argument")
+	mockScenariosFile := fs.String("mock-scenario-file", "", "File with scenarios that Action-Store should mock")
+	alertsDataFile := fs.String("alert-data-file", "", "File that contains the alert data. Without it, alerts are read from stdin as one JSON object per line")
+	concurrency := fs.Int("concurrency", runtime.NumCPU(), "Number of alerts read from stdin that are run at the same time")
+	parallel := fs.Int("parallel", 1, "Number of actions of an alert that are run at the same time, for the nodes that do not depend on each other")
+	latency := fs.Duration("simulate-latency", 0, "Time the mocked actions take per second of their executionDuration")
+	idField := fs.String("alert-id-field", "id", "Alert field reported as the id of an alert read from stdin")
+	resultFile := fs.String("result-file", "", "File where the result is written in the --output format")
+	eventsFile := fs.String("events-file", "", "File where the events of the execution are written, one JSON object per line")
+	checkpointFile := fs.String("checkpoint-file", "", "File where the checkpoint of the execution is written after every change")
+	resumeFile := fs.String("resume", "", "Checkpoint file of an execution to continue, with the alert it holds")
+	goldenFile := fs.String("golden", "", "Golden file that the result is compared against")
+	updateGolden := fs.Bool("update", false, "Rewrite the golden file with the result instead of comparing against it")
+	out := addOutputFlags(fs, "yaml", "yaml|json")
+	logs := addLogFlags(fs)
+	parseArgs(fs, args)
+	if !logs.setup() {
+		return exitUsage
+	}
+
+	if fs.NArg() > 1 || (fs.NArg() == 1 && *playbookFile != "") {
+		fs.Usage()
+		return exitUsage
+	}
+	if fs.NArg() == 1 {
+		*playbookFile = fs.Arg(0)
+	}
+	if *playbookFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+	if _, err := out.marshal(nil); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+
+	playbookData, err := ioutil.ReadFile(*playbookFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", *playbookFile, err.Error())
+		return exitInvalidPlaybook
+	}
+	// An invalid playbook is not run, so that its errors are not reported
+	// as a failed execution.
+	if problems := execution.Validate(playbookData); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *playbookFile, p.String())
+		}
+		return exitInvalidPlaybook
+	}
+	var mocks []actionstore.ActionMockScenario
+	if *mockScenariosFile != "" {
+		if mocks, err = actionstore.LoadMockScenarios(*mockScenariosFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitInvalidPlaybook
+		}
+	}
+	opts := testsuite.ExecuteOptions{MaxParallel: *parallel, LatencyPerSec: *latency, CheckpointFile: *checkpointFile}
+	if *resumeFile != "" {
+		if *alertsDataFile != "" {
+			fmt.Fprintln(os.Stderr, "--resume takes the alert from the checkpoint, not from --alert-data-file")
+			return exitUsage
+		}
+		if opts.Resume, err = ioutil.ReadFile(*resumeFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", *resumeFile, err.Error())
+			return exitInvalidPlaybook
+		}
+	}
+	if *alertsDataFile == "" && *resumeFile == "" && stdinIsPiped() {
+		if *resultFile != "" || *goldenFile != "" || *eventsFile != "" || *checkpointFile != "" {
+			fmt.Fprintln(os.Stderr, "--result-file, --golden, --events-file and --checkpoint-file need --alert-data-file")
+			return exitUsage
+		}
+		r := &batch.Runner{Playbook: playbookData, Mocks: mocks, Concurrency: *concurrency, IDField: *idField,
+			Options: opts}
+		return runPipeline(r, out)
+	}
+	if *alertsDataFile == "" && *resumeFile == "" {
+		fmt.Fprintln(os.Stderr, "no alert to run the playbook with: pass --alert-data-file or pipe alerts on stdin")
+		return exitUsage
+	}
+
+	alert := map[string]interface{}{}
+	if *alertsDataFile != "" {
+		alertsData, err := ioutil.ReadFile(*alertsDataFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", *alertsDataFile, err.Error())
+			return exitInvalidPlaybook
+		}
+		if alert, err = execution.ParseAlert(alertsData); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to parse the alerts data, Err: %s\n", err.Error())
+			return exitInvalidPlaybook
+		}
+	}
+
+	if *eventsFile != "" {
+		f, err := os.Create(*eventsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailure
+		}
+		defer f.Close()
+		opts.Observer = jsonLinesObserver(f)
+	}
+
+	r := testsuite.ExecuteWithOptions(playbookData, alert, mocks, opts)
+	if r.Err != nil {
+		fmt.Fprintln(os.Stderr, r.Err.Error())
+		return exitInvalidPlaybook
+	}
+	if *parallel > 1 && !*out.quiet {
+		fmt.Fprintf(os.Stderr, "Ran up to %d actions at the same time\n", r.PeakConcurrency)
+	}
+
+	d, err := out.marshal(r.Nodes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitExecutionFailure
+	}
+	out.stdout().Write(d)
+	if *resultFile != "" {
+		if err := ioutil.WriteFile(*resultFile, d, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitExecutionFailure
+		}
+	}
+
+	if *goldenFile != "" {
+		snapshot, err := testsuite.Snapshot(r.Nodes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error in building snapshot: %s\n", err.Error())
+			return exitFailure
+		}
+		diff, err := testsuite.CompareGolden(snapshot, *goldenFile, *updateGolden)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitFailure
+		}
+		if diff != "" {
+			fmt.Fprintf(os.Stderr, "Result differs from golden file:\n%s", diff)
+			return exitFailure
+		}
+	}
+	if r.ExecErr != nil {
+		fmt.Fprintf(os.Stderr, "Execution failed: %s\n", r.ExecErr.Error())
+		return exitExecutionFailure
+	}
+	return exitOK
+}
+
+// runPipeline runs the playbook for each alert on stdin and writes a JSON
+// record per alert to stdout.
+func runPipeline(r *batch.Runner, out *outputFlags) int {
+	stdout := out.stdout()
+	summary, err := r.Run(os.Stdin, stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+	switch {
+	case summary.Invalid > 0:
+		return exitInvalidPlaybook
+	case summary.Failed > 0:
+		return exitExecutionFailure
+	}
+	return exitOK
+}
+
+// jsonLinesObserver writes each event to w as a line of JSON.
+func jsonLinesObserver(w io.Writer) execution.Observer {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return execution.ObserverFunc(func(e execution.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(e)
+	})
+}
+
+// stdinIsPiped reports whether stdin is a pipe or file rather than a terminal.
+func stdinIsPiped() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice == 0
+}
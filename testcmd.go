@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rptsec.com/amg/testsuite"
+)
+
+// runTests implements `amg test <suite-file>...` and returns the exit code.
+func runTests(args []string) int {
+	fs := newFlagSet("test", "[flags] <suite-file>...")
+	showCoverage := fs.Bool("coverage", false, "Print node and branch coverage of each playbook")
+	coverageDir := fs.String("coverage-dir", "", "Directory where a copy of each playbook annotated with its coverage is written")
+	minBranchCoverage := fs.Float64("min-branch-coverage", 0, "Fail when the branch coverage of any playbook is below this percentage")
+	format := fs.String("format", "text", "Format of the report: text|junit|tap")
+	reportFile := fs.String("report-file", "", "File where the report is written instead of stdout")
+	updateGolden := fs.Bool("update", false, "Rewrite the golden files of the cases instead of comparing against them")
+	quiet := fs.Bool("quiet", false, "Print nothing on stdout, only set the exit code and write --report-file")
+	logs := addLogFlags(fs)
+	parseArgs(fs, args)
+	if !logs.setup() {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	writeReport, ok := reportWriters[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown report format: %s\n", *format)
+		return exitUsage
+	}
+
+	var results []*testsuite.SuiteResult
+	exitCode := exitOK
+	for _, path := range fs.Args() {
+		s, err := testsuite.LoadSuite(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			exitCode = exitInvalidPlaybook
+			continue
+		}
+		s.UpdateGolden = *updateGolden
+		sr := s.Run()
+		if !sr.Passed() && exitCode == exitOK {
+			exitCode = exitFailure
+		}
+		results = append(results, sr)
+	}
+	stdout := io.Writer(os.Stdout)
+	if *quiet {
+		stdout = ioutil.Discard
+	}
+	if *reportFile != "" || *format == "text" {
+		testsuite.WriteText(stdout, results)
+	}
+	if err := writeReportTo(stdout, *reportFile, writeReport, results); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		exitCode = exitFailure
+	}
+
+	// The coverage summary must not be mixed into a junit or tap report
+	// written on stdout.
+	summaryOut := stdout
+	if *reportFile == "" && *format != "text" && !*quiet {
+		summaryOut = os.Stderr
+	}
+	coverage := testsuite.MergeCoverage(results)
+	if *showCoverage || *minBranchCoverage > 0 {
+		testsuite.WriteCoverageText(summaryOut, coverage)
+	}
+	if *coverageDir != "" {
+		if err := writeAnnotatedCoverage(*coverageDir, coverage); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			exitCode = exitFailure
+		}
+	}
+	for _, c := range coverage {
+		if summary := c.Summary(); summary.BranchPercent() < *minBranchCoverage {
+			fmt.Fprintf(summaryOut, "branch coverage of %s is %.1f%%, below the required %.1f%%\n",
+				c.Playbook, summary.BranchPercent(), *minBranchCoverage)
+			exitCode = exitFailure
+		}
+	}
+	return exitCode
+}
+
+var reportWriters = map[string]func(io.Writer, []*testsuite.SuiteResult) error{
+	"text":  func(w io.Writer, results []*testsuite.SuiteResult) error { return nil },
+	"junit": testsuite.WriteJUnit,
+	"tap":   testsuite.WriteTAP,
+}
+
+// writeReportTo writes the report to path, or to stdout when path is empty.
+func writeReportTo(stdout io.Writer, path string, write func(io.Writer, []*testsuite.SuiteResult) error,
+	results []*testsuite.SuiteResult) error {
+	if path == "" {
+		return write(stdout, results)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeAnnotatedCoverage writes <playbook>.coverage.yaml for each playbook into dir.
+func writeAnnotatedCoverage(dir string, coverage []*testsuite.Coverage) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, c := range coverage {
+		base := strings.TrimSuffix(filepath.Base(c.Playbook), filepath.Ext(c.Playbook))
+		f, err := os.Create(filepath.Join(dir, base+".coverage.yaml"))
+		if err != nil {
+			return err
+		}
+		err = c.WriteAnnotated(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package testsuite
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"rptsec.com/amg/execution"
+)
+
+// Markers used in the annotated copy of a playbook
+const (
+	CoverageExecuted    = "executed"
+	CoverageNotExecuted = "not-executed"
+)
+
+// Coverage records which action nodes were executed and which outcomes of the
+// if nodes were taken over one or more runs of a playbook.
+// Nodes are tracked by their position in the playbook rather than by id, as
+// ids that are not set in the playbook are generated afresh on each parse.
+type Coverage struct {
+	Playbook string
+	nodes    []execution.N
+	ids      map[string]string
+	actions  map[string]bool
+	// if node position -> {true taken, false taken}
+	branches map[string]*[2]bool
+}
+
+// CoverageSummary holds the totals of a Coverage.
+type CoverageSummary struct {
+	Playbook            string `json:"playbook"`
+	ActionNodes         int    `json:"actionNodes"`
+	ActionNodesExecuted int    `json:"actionNodesExecuted"`
+	Branches            int    `json:"branches"`
+	BranchesTaken       int    `json:"branchesTaken"`
+}
+
+// NewCoverage creates an empty Coverage for the playbook whose nodes are given.
+func NewCoverage(playbook string, nodes []execution.N) *Coverage {
+	c := &Coverage{
+		Playbook: playbook,
+		nodes:    nodes,
+		ids:      make(map[string]string),
+		actions:  make(map[string]bool),
+		branches: make(map[string]*[2]bool),
+	}
+	WalkWithPosition(nodes, "", func(pos string, n *execution.N) {
+		c.ids[pos] = n.ID
+		switch n.NodeType {
+		case "", "execute":
+			c.actions[pos] = false
+		case "if":
+			c.branches[pos] = &[2]bool{}
+		}
+	})
+	return c
+}
+
+// Add records the coverage of a single run whose annotated nodes are given.
+func (c *Coverage) Add(annotated []execution.N) {
+	WalkWithPosition(annotated, "", func(pos string, n *execution.N) {
+		if _, ok := c.actions[pos]; ok && (n.State == execution.StateDone || n.State == execution.StateFailed) {
+			c.actions[pos] = true
+		}
+		if b, ok := c.branches[pos]; ok && n.State == execution.StateDone {
+			if n.ConditionEvaluatedTo {
+				b[0] = true
+			} else {
+				b[1] = true
+			}
+		}
+	})
+}
+
+// Merge adds the coverage recorded in o, which must be for the same playbook.
+func (c *Coverage) Merge(o *Coverage) {
+	for pos, executed := range o.actions {
+		if _, ok := c.actions[pos]; ok && executed {
+			c.actions[pos] = true
+		}
+	}
+	for pos, b := range o.branches {
+		if mine, ok := c.branches[pos]; ok {
+			mine[0] = mine[0] || b[0]
+			mine[1] = mine[1] || b[1]
+		}
+	}
+}
+
+// Summary returns the totals of the coverage.
+func (c *Coverage) Summary() CoverageSummary {
+	s := CoverageSummary{Playbook: c.Playbook, ActionNodes: len(c.actions), Branches: 2 * len(c.branches)}
+	for _, executed := range c.actions {
+		if executed {
+			s.ActionNodesExecuted++
+		}
+	}
+	for _, b := range c.branches {
+		for _, taken := range b {
+			if taken {
+				s.BranchesTaken++
+			}
+		}
+	}
+	return s
+}
+
+// NodePercent is the percentage of action nodes that were executed.
+func (s CoverageSummary) NodePercent() float64 {
+	return percent(s.ActionNodesExecuted, s.ActionNodes)
+}
+
+// BranchPercent is the percentage of if outcomes that were taken.
+func (s CoverageSummary) BranchPercent() float64 {
+	return percent(s.BranchesTaken, s.Branches)
+}
+
+func (s CoverageSummary) String() string {
+	return fmt.Sprintf("%s: nodes %d/%d (%.1f%%), branches %d/%d (%.1f%%)",
+		s.Playbook, s.ActionNodesExecuted, s.ActionNodes, s.NodePercent(),
+		s.BranchesTaken, s.Branches, s.BranchPercent())
+}
+
+func percent(n int, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// Uncovered lists the action nodes that were never executed and the if
+// outcomes that were never taken, in the order they appear in the playbook.
+func (c *Coverage) Uncovered() []string {
+	var uncovered []string
+	WalkWithPosition(c.nodes, "", func(pos string, n *execution.N) {
+		name := c.ids[pos]
+		if name == "" {
+			name = pos
+		}
+		if executed, ok := c.actions[pos]; ok && !executed {
+			uncovered = append(uncovered, fmt.Sprintf("node %s not executed", name))
+		}
+		if b, ok := c.branches[pos]; ok {
+			for _, branch := range untakenBranches(b) {
+				uncovered = append(uncovered, fmt.Sprintf("branch %s of %s not taken", branch, name))
+			}
+		}
+	})
+	return uncovered
+}
+
+// Annotated returns a copy of the playbook nodes marked with their coverage.
+func (c *Coverage) Annotated() []execution.N {
+	nodes := copyNodes(c.nodes)
+	WalkWithPosition(nodes, "", func(pos string, n *execution.N) {
+		if executed, ok := c.actions[pos]; ok {
+			n.Coverage = CoverageNotExecuted
+			if executed {
+				n.Coverage = CoverageExecuted
+			}
+		}
+		if b, ok := c.branches[pos]; ok {
+			n.Coverage = CoverageExecuted
+			if !b[0] && !b[1] {
+				n.Coverage = CoverageNotExecuted
+			}
+			n.UntakenBranches = untakenBranches(b)
+		}
+	})
+	return nodes
+}
+
+// WriteAnnotated writes the annotated copy of the playbook as yaml to w.
+func (c *Coverage) WriteAnnotated(w io.Writer) error {
+	d, err := yaml.Marshal(c.Annotated())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(d)
+	return err
+}
+
+func untakenBranches(b *[2]bool) []string {
+	var untaken []string
+	if !b[0] {
+		untaken = append(untaken, "onTrue")
+	}
+	if !b[1] {
+		untaken = append(untaken, "onFalse")
+	}
+	return untaken
+}
+
+// MergeCoverage combines the coverage of suites that test the same playbook.
+// The result is sorted by playbook.
+func MergeCoverage(results []*SuiteResult) []*Coverage {
+	byPlaybook := make(map[string]*Coverage)
+	for _, sr := range results {
+		if sr.Coverage == nil {
+			continue
+		}
+		if c, ok := byPlaybook[sr.Playbook]; ok {
+			c.Merge(sr.Coverage)
+			continue
+		}
+		c := NewCoverage(sr.Playbook, sr.Coverage.nodes)
+		c.Merge(sr.Coverage)
+		byPlaybook[sr.Playbook] = c
+	}
+	merged := make([]*Coverage, 0, len(byPlaybook))
+	for _, c := range byPlaybook {
+		merged = append(merged, c)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Playbook < merged[j].Playbook })
+	return merged
+}
+
+// WalkWithPosition calls fn for every node in the tree along with a position
+// string such as "[2].onTrue[0]" that identifies the node within the tree.
+func WalkWithPosition(nodes []execution.N, prefix string, fn func(string, *execution.N)) {
+	for i := range nodes {
+		pos := fmt.Sprintf("%s[%d]", prefix, i)
+		fn(pos, &nodes[i])
+		WalkWithPosition(nodes[i].OnTrue, pos+".onTrue", fn)
+		WalkWithPosition(nodes[i].OnFalse, pos+".onFalse", fn)
+	}
+}
+
+func copyNodes(nodes []execution.N) []execution.N {
+	if nodes == nil {
+		return nil
+	}
+	c := make([]execution.N, len(nodes))
+	copy(c, nodes)
+	for i := range c {
+		c[i].OnTrue = copyNodes(nodes[i].OnTrue)
+		c[i].OnFalse = copyNodes(nodes[i].OnFalse)
+	}
+	return c
+}
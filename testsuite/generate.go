@@ -0,0 +1,561 @@
+package testsuite
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/execution"
+)
+
+// PathStep is an action node executed or an if node evaluated on a path.
+type PathStep struct {
+	Node *execution.N
+	// Decision is the outcome of an if node
+	Decision bool
+}
+
+// Path is a sequence of steps taken by one execution of a playbook.
+type Path []PathStep
+
+// Describe names the path by the decisions taken on it, eg. "if3=true".
+func (p Path) Describe() string {
+	var decisions []string
+	for _, step := range p {
+		if step.Node.NodeType == "if" {
+			decisions = append(decisions, fmt.Sprintf("%s=%v", step.Node.ID, step.Decision))
+		}
+	}
+	if len(decisions) == 0 {
+		return "single path"
+	}
+	return strings.Join(decisions, ", ")
+}
+
+// EnumeratePaths lists every path through the if nodes of the playbook, in
+// the order they appear in the playbook with the true path first. The nodes
+// must have gone through execution.ConvertToLinkedNodes so that they have ids.
+func EnumeratePaths(nodes []execution.N) []Path {
+	paths := []Path{{}}
+	for i := range nodes {
+		n := &nodes[i]
+		var alternatives []Path
+		switch n.NodeType {
+		case "if":
+			for _, p := range EnumeratePaths(n.OnTrue) {
+				alternatives = append(alternatives, append(Path{{Node: n, Decision: true}}, p...))
+			}
+			for _, p := range EnumeratePaths(n.OnFalse) {
+				alternatives = append(alternatives, append(Path{{Node: n, Decision: false}}, p...))
+			}
+		case "execute":
+			alternatives = []Path{{{Node: n}}}
+		default:
+			continue
+		}
+
+		var extended []Path
+		for _, p := range paths {
+			for _, alt := range alternatives {
+				extended = append(extended, append(append(Path{}, p...), alt...))
+			}
+		}
+		paths = extended
+	}
+	return paths
+}
+
+// GeneratedCase is a test case generated for a path, or the reason no case
+// could be generated for it.
+type GeneratedCase struct {
+	Path       Path
+	Case       *Case
+	Infeasible string
+}
+
+// GenerateCases builds a test case for each path through the playbook. The
+// alert data and mocks of a case are chosen so that the playbook takes that
+// path: each condition is solved for the alert fields or action results it
+// reads, trying in turn the ways its comparisons combined with and, or and
+// not give the decision. Values that no condition constrains are filled with placeholders,
+// as are the values in conditions that compare two vars.
+func GenerateCases(nodes []execution.N) []GeneratedCase {
+	var generated []GeneratedCase
+	for i, p := range EnumeratePaths(nodes) {
+		c, err := generateCase(p)
+		g := GeneratedCase{Path: p, Case: c}
+		if err != nil {
+			g.Case = nil
+			g.Infeasible = err.Error()
+		} else {
+			c.Name = fmt.Sprintf("path %d: %s", i+1, p.Describe())
+		}
+		generated = append(generated, g)
+	}
+	return generated
+}
+
+// GenerateSuite returns a suite for the playbook at playbookPath with a case
+// for every feasible path.
+func GenerateSuite(playbookPath string, nodes []execution.N) (*Suite, []GeneratedCase) {
+	s := &Suite{Playbook: playbookPath}
+	generated := GenerateCases(nodes)
+	for _, g := range generated {
+		if g.Case != nil {
+			s.Cases = append(s.Cases, *g.Case)
+		}
+	}
+	return s, generated
+}
+
+// constraint is a condition on a path that must evaluate to want.
+type constraint struct {
+	expr string
+	want bool
+}
+
+// varConstraint is a constraint on the value of the var name.
+type varConstraint struct {
+	name string
+	constraint
+}
+
+// maxCombinations bounds the combinations of the ways the if nodes on a path
+// take their decisions that are tried.
+const maxCombinations = 1024
+
+// constraintsOf turns the outcomes required of comparisons into constraints
+// on each of the vars they read.
+func constraintsOf(requirements []execution.Requirement, exports map[string]string) []varConstraint {
+	var constraints []varConstraint
+	for _, r := range requirements {
+		for _, v := range execution.NewCondition(r.String()).UnknownVarsList() {
+			constraints = append(constraints, varConstraint{canonicalVar(v, exports), constraint{
+				expr: fmt.Sprintf("%s %s %s", substituteVar(r.Lhs, v), r.Op, substituteVar(r.Rhs, v)),
+				want: r.Want,
+			}})
+		}
+	}
+	return constraints
+}
+
+// solvePath picks one of the ways each if node takes its decision such that
+// the constraints of all of them can be solved, and returns the values that
+// solve them.
+func solvePath(choices [][][]varConstraint) (map[string]string, error) {
+	var firstErr error
+	combinations := 0
+	var try func(i int, chosen []varConstraint) map[string]string
+	try = func(i int, chosen []varConstraint) map[string]string {
+		values, err := solveAll(chosen)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return nil
+		}
+		if i == len(choices) {
+			return values
+		}
+		for _, way := range choices[i] {
+			if combinations++; combinations > maxCombinations {
+				return nil
+			}
+			if values := try(i+1, append(chosen[:len(chosen):len(chosen)], way...)); values != nil {
+				return values
+			}
+		}
+		return nil
+	}
+	if values := try(0, nil); values != nil {
+		return values, nil
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("the conditions on the path can be met in too many ways to try them all")
+	}
+	return nil, firstErr
+}
+
+// solveAll solves the constraints on each var, in the order the vars are
+// first constrained.
+func solveAll(constraints []varConstraint) (map[string]string, error) {
+	byName := make(map[string][]constraint)
+	var order []string
+	for _, c := range constraints {
+		if _, ok := byName[c.name]; !ok {
+			order = append(order, c.name)
+		}
+		byName[c.name] = append(byName[c.name], c.constraint)
+	}
+	values := make(map[string]string)
+	for _, name := range order {
+		val, ok := solve(byName[name])
+		if !ok {
+			return nil, fmt.Errorf("no value of %s satisfies all the conditions on the path", name)
+		}
+		values[name] = val
+	}
+	return values, nil
+}
+
+func generateCase(p Path) (*Case, error) {
+	// Canonical names of exported vars, eg. "$score" -> "@node:ac1$reputationScore"
+	exports := make(map[string]string)
+	// The ways each if node on the path takes its decision
+	var choices [][][]varConstraint
+	// Vars read by the conditions, which need a value even when the way
+	// taken does not constrain them
+	var read []string
+
+	for _, step := range p {
+		n := step.Node
+		switch n.NodeType {
+		case "execute":
+			for name, field := range n.Exports {
+				exports["$"+name] = fmt.Sprintf("@node:%s$%s", n.ID, exportedField(field))
+			}
+		case "if":
+			alternatives, ok := execution.NewCondition(n.Condition).Requirements(step.Decision)
+			if !ok {
+				return nil, fmt.Errorf("condition of %s is not made of comparisons that can be solved: %s", n.ID, n.Condition)
+			}
+			var ways [][]varConstraint
+			for _, requirements := range alternatives {
+				ways = append(ways, constraintsOf(requirements, exports))
+			}
+			choices = append(choices, ways)
+			read = append(read, execution.NewCondition(n.Condition).UnknownVarsList()...)
+		}
+	}
+
+	values, err := solvePath(choices)
+	if err != nil {
+		return nil, err
+	}
+
+	alert := make(map[string]string)
+	outputs := make(map[string]map[string]string)
+	valueOf := func(ref string) string {
+		name := canonicalVar(ref, exports)
+		val, ok := values[name]
+		if !ok {
+			val = placeholder(name)
+			values[name] = val
+		}
+		if strings.HasPrefix(name, "@alert:") {
+			alert[strings.TrimPrefix(name, "@alert:")] = val
+		}
+		if nodeID, field, ok := splitNodeVar(name); ok {
+			if outputs[nodeID] == nil {
+				outputs[nodeID] = make(map[string]string)
+			}
+			outputs[nodeID][field] = val
+		}
+		return val
+	}
+	for name := range values {
+		valueOf(name)
+	}
+	for _, ref := range read {
+		valueOf(ref)
+	}
+
+	// Every field that is exported or read later is part of the mocked result.
+	for _, n := range pathNodes(p) {
+		for _, field := range n.Exports {
+			valueOf(fmt.Sprintf("@node:%s$%s", n.ID, exportedField(field)))
+		}
+	}
+	var calls []mockedCall
+	for _, n := range pathNodes(p) {
+		if n.NodeType != "execute" {
+			continue
+		}
+		input := make(map[string]string)
+		for param, val := range n.Params {
+			switch {
+			case execution.IsTemplate(val):
+				rendered, err := renderParam(val, valueOf)
+				if err != nil {
+					return nil, fmt.Errorf("param %s of %s: %s", param, n.ID, err.Error())
+				}
+				val = rendered
+			case strings.HasPrefix(val, "@") || strings.HasPrefix(val, "$"):
+				val = valueOf(val)
+			}
+			input[param] = val
+		}
+		calls = append(calls, mockedCall{n, input})
+	}
+
+	c := &Case{Alert: execution.AlertFromStrings(alert)}
+	byUrn := make(map[string]*actionstore.ActionMockScenario)
+	var urns []string
+	for _, call := range calls {
+		result, err := mockedResult(call.node.ID, outputs[call.node.ID])
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byUrn[call.node.Urn]
+		if !ok {
+			m = &actionstore.ActionMockScenario{ActionUrn: call.node.Urn}
+			byUrn[call.node.Urn] = m
+			urns = append(urns, call.node.Urn)
+		}
+		duplicate := false
+		for _, existing := range m.Scenarios {
+			if mapsEqual(existing.Input, call.input) {
+				if !mapsEqual(existing.ResultFieldMap, result.ResultFieldMap) || existing.ResultJSON != result.ResultJSON {
+					return nil, fmt.Errorf("%s is called with the same params by two nodes that need different results",
+						call.node.Urn)
+				}
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			m.Scenarios = append(m.Scenarios, actionstore.MockScenario{Input: call.input, ActionResult: result})
+		}
+	}
+	for _, urn := range urns {
+		c.Mocks = append(c.Mocks, *byUrn[urn])
+	}
+
+	c.Expect = expectationsForPath(p)
+	return c, nil
+}
+
+// renderParam renders a param with interpolations, with the generated value
+// of each variable it interpolates, to get the input the action is mocked for.
+func renderParam(val string, valueOf func(string) string) (string, error) {
+	t, err := execution.ParseTemplate(val)
+	if err != nil {
+		return "", err
+	}
+	values := make(map[string]*execution.ValueWrapper)
+	for _, ref := range t.Refs() {
+		values[ref] = execution.WrapStringValue(valueOf(ref))
+	}
+	return t.Render(values)
+}
+
+// mockedResult builds the result of an action from the values of its fields.
+// Paths into the raw result, eg. "raw.data.score", are set in the outputJson
+// document of the result, and the other fields are output fields.
+func mockedResult(nodeID string, fields map[string]string) (actionstore.ActionResult, error) {
+	result := actionstore.ActionResult{ResultFieldMap: map[string]string{}}
+	doc := make(map[string]interface{})
+	for _, field := range sortedKeys(fields) {
+		val := fields[field]
+		switch {
+		case field == "raw":
+			result.ResultJSON = val
+		case strings.HasPrefix(field, "raw."):
+			if err := execution.SetPath(doc, strings.TrimPrefix(field, "raw."), val); err != nil {
+				return result, fmt.Errorf("result of %s: %s", nodeID, err.Error())
+			}
+		case strings.HasPrefix(field, "raw["):
+			return result, fmt.Errorf("result of %s: %s needs a raw result that is an array, which is not generated",
+				nodeID, field)
+		default:
+			result.ResultFieldMap[field] = val
+		}
+	}
+	if len(doc) > 0 {
+		if result.ResultJSON != "" {
+			return result, fmt.Errorf("result of %s is read both whole and by path", nodeID)
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return result, err
+		}
+		result.ResultJSON = string(data)
+	}
+	return result, nil
+}
+
+// mockedCall is an action node on a path with the params it is called with.
+type mockedCall struct {
+	node  *execution.N
+	input map[string]string
+}
+
+// expectationsForPath expects the nodes on the path to be done, the nodes on
+// the paths not taken to not start, and the if nodes to take the path.
+func expectationsForPath(p Path) Expectations {
+	e := Expectations{Nodes: map[string]string{}, Branches: map[string]bool{}, Error: "none"}
+	for _, step := range p {
+		n := step.Node
+		if n.GeneratedID() {
+			continue
+		}
+		e.Nodes[n.ID] = execution.StateDone
+		if n.NodeType != "if" {
+			continue
+		}
+		e.Branches[n.ID] = step.Decision
+		untaken := n.OnFalse
+		if !step.Decision {
+			untaken = n.OnTrue
+		}
+		WalkWithPosition(untaken, "", func(pos string, u *execution.N) {
+			if !u.GeneratedID() {
+				e.Nodes[u.ID] = execution.StateNotYetStarted
+			}
+		})
+	}
+	return e
+}
+
+func pathNodes(p Path) []*execution.N {
+	nodes := make([]*execution.N, len(p))
+	for i, step := range p {
+		nodes[i] = step.Node
+	}
+	return nodes
+}
+
+// exportedField maps the expression of an export to the result field it reads.
+func exportedField(expr string) string {
+	if expr == "result" {
+		return "raw"
+	}
+	return expr
+}
+
+// canonicalVar resolves an exported var to the node result it was exported from.
+func canonicalVar(name string, exports map[string]string) string {
+	if canonical, ok := exports[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+func splitNodeVar(name string) (string, string, bool) {
+	if !strings.HasPrefix(name, "@node:") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, "@node:"), "$", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func placeholder(name string) string {
+	if strings.HasPrefix(name, "@alert:") {
+		return "sample-" + strings.TrimPrefix(name, "@alert:")
+	}
+	if nodeID, field, ok := splitNodeVar(name); ok {
+		return fmt.Sprintf("sample-%s-%s", nodeID, field)
+	}
+	return "sample-" + strings.TrimLeft(name, "@$")
+}
+
+// substituteVar replaces the operand v with a placeholder that solve fills
+// in, so the constraint only depends on one var.
+func substituteVar(operand string, v string) string {
+	if operand == v {
+		return solveVar
+	}
+	return operand
+}
+
+const solveVar = "$__value"
+
+// solve finds a value that makes every constraint evaluate as wanted. The
+// candidates are derived from the literals in the constraints.
+func solve(constraints []constraint) (string, bool) {
+	var candidates []string
+	for _, c := range constraints {
+		lhs, _, rhs := execution.NewCondition(c.expr).Operands()
+		for _, literal := range []string{lhs, rhs} {
+			if literal == solveVar || strings.HasPrefix(literal, "@") || strings.HasPrefix(literal, "$") {
+				continue
+			}
+			val := execution.ParseLiteral(literal)
+			candidates = append(candidates, val.StringVal())
+			switch val.Kind {
+			case execution.NumberValue:
+				n, _ := val.Number()
+				one := big.NewRat(1, 1)
+				candidates = append(candidates,
+					ratString(new(big.Rat).Add(n, one)), ratString(new(big.Rat).Sub(n, one)))
+			case execution.BoolValue:
+				candidates = append(candidates, "true", "false")
+			case execution.StringValue:
+				if inside, outside, ok := cidrCandidates(val.StringVal()); ok {
+					candidates = append(candidates, inside, outside)
+				}
+				candidates = append(candidates, val.StringVal()+"-other")
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		if satisfiesAll(candidate, constraints) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// cidrCandidates returns the first address of a network and the address
+// following its last one, for conditions such as "@alert:srcIp inCidr
+// 10.0.0.0/8".
+func cidrCandidates(cidr string) (string, string, bool) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", "", false
+	}
+	after := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		after[i] = n.IP[i] | ^n.Mask[i]
+	}
+	for i := len(after) - 1; i >= 0; i-- {
+		after[i]++
+		if after[i] != 0 {
+			break
+		}
+	}
+	return n.IP.String(), after.String(), true
+}
+
+// ratString formats a number read from a playbook, which has a finite
+// decimal expansion.
+func ratString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := r.FloatString(20)
+	return strings.TrimRight(strings.TrimRight(s, "0"), ".")
+}
+
+func satisfiesAll(val string, constraints []constraint) bool {
+	for _, c := range constraints {
+		cond := execution.NewCondition(c.expr)
+		if len(cond.UnknownVarsList()) != 1 {
+			// Conditions comparing two vars are not solved.
+			continue
+		}
+		cond.SetVarValue(solveVar, execution.WrapStringValue(val))
+		result, ok := cond.Evaluate()
+		if !ok || result != c.want {
+			return false
+		}
+	}
+	return true
+}
+
+func mapsEqual(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
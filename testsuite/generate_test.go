@@ -0,0 +1,224 @@
+package testsuite
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/execution"
+)
+
+func TestGeneratedSuitePassesForSamplePlaybook(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../resources/sample-playbook.yaml")
+	assert.Nil(err)
+	nodes, err := execution.NewNodesFromYaml(data)
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+
+	s, generated := GenerateSuite("../resources/sample-playbook.yaml", nodes)
+	assert.Equal(2, len(generated))
+	assert.Equal("path 1: if3=true", s.Cases[0].Name)
+	assert.Equal("path 2: if3=false", s.Cases[1].Name)
+	assert.Equal(map[string]interface{}{"srcIp": "sample-srcIp", "dstIp": "sample-dstIp"}, s.Cases[0].Alert)
+
+	s.playbookData = data
+	r := s.Run()
+	for _, c := range r.Cases {
+		assert.Empty(c.Failures, c.Name)
+	}
+	assert.Equal(100.0, r.Coverage.Summary().BranchPercent())
+}
+
+func TestGenerateSolvesNestedConditions(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook := []byte(`
+- id: lookup
+  urn: urn:lookup
+  params: {ip: "@alert:srcIp"}
+  exports: {score: reputationScore}
+- id: high
+  type: if
+  condition: "$score >= 80"
+  onTrue:
+    - id: low
+      type: if
+      condition: "$score < 50"
+      onTrue:
+        - {id: never, urn: urn:never}
+  onFalse:
+    - id: internal
+      type: if
+      condition: "@alert:zone == internal"
+`)
+	nodes, err := execution.NewNodesFromYaml(playbook)
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+
+	generated := GenerateCases(nodes)
+	var described []string
+	for _, g := range generated {
+		described = append(described, g.Path.Describe())
+	}
+	assert.Equal([]string{
+		"high=true, low=true", "high=true, low=false", "high=false, internal=true", "high=false, internal=false",
+	}, described)
+
+	assert.Nil(generated[0].Case)
+	assert.Contains(generated[0].Infeasible, "@node:lookup$reputationScore")
+
+	assert.Equal("80", generated[1].Case.Mocks[0].Scenarios[0].ResultFieldMap["reputationScore"])
+	assert.Equal("79", generated[2].Case.Mocks[0].Scenarios[0].ResultFieldMap["reputationScore"])
+	assert.Equal("internal", generated[2].Case.Alert["zone"])
+	assert.Equal("internal-other", generated[3].Case.Alert["zone"])
+	assert.Equal(map[string]string{
+		"lookup": "Done", "high": "Done", "low": "Not-Yet-Started", "never": "Not-Yet-Started", "internal": "Done",
+	}, generated[2].Case.Expect.Nodes)
+
+	s := &Suite{Playbook: "inline", playbookData: playbook}
+	for _, g := range generated[1:] {
+		s.Cases = append(s.Cases, *g.Case)
+	}
+	r := s.Run()
+	for _, c := range r.Cases {
+		assert.Empty(c.Failures, c.Name)
+	}
+}
+
+func TestGenerateSolvesCidrConditions(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes, err := execution.NewNodesFromYaml([]byte(`
+- id: internal
+  type: if
+  condition: '@alert:srcIp inCidr "10.0.0.0/8"'
+  onTrue:
+    - {id: block, urn: urn:block, params: {ip: "@alert:srcIp"}}
+`))
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+
+	generated := GenerateCases(nodes)
+	if assert.Len(generated, 2) {
+		assert.Equal("10.0.0.0", generated[0].Case.Alert["srcIp"])
+		assert.Equal("11.0.0.0", generated[1].Case.Alert["srcIp"])
+	}
+}
+
+func TestGenerateMocksRawResultPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook := []byte(`
+- id: lookup
+  urn: urn:lookup
+  params: {ip: "@alert:srcIp"}
+- id: risky
+  type: if
+  condition: "@node:lookup$raw.data.score > 5"
+  onTrue:
+    - {id: block, urn: urn:block, params: {ip: "@alert:srcIp"}}
+`)
+	nodes, err := execution.NewNodesFromYaml(playbook)
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+
+	generated := GenerateCases(nodes)
+	if !assert.Len(generated, 2) {
+		return
+	}
+	result := generated[0].Case.Mocks[0].Scenarios[0].ActionResult
+	assert.JSONEq(`{"data": {"score": "6"}}`, result.ResultJSON)
+	assert.Empty(result.ResultFieldMap)
+
+	s := &Suite{Playbook: "inline", playbookData: playbook}
+	for _, g := range generated {
+		s.Cases = append(s.Cases, *g.Case)
+	}
+	r := s.Run()
+	for _, c := range r.Cases {
+		assert.Empty(c.Failures, c.Name)
+	}
+}
+
+func TestGenerateRendersTemplateParams(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook := []byte(`
+- id: notify
+  urn: urn:notify
+  params:
+    ip: "${@alert:user.ip}"
+    text: "login of ${@alert:user.name} from ${@alert:user.ip}"
+`)
+	nodes, err := execution.NewNodesFromYaml(playbook)
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+
+	generated := GenerateCases(nodes)
+	if !assert.Len(generated, 1) || !assert.NotNil(generated[0].Case) {
+		return
+	}
+	c := generated[0].Case
+	assert.Equal(map[string]interface{}{"user.ip": "sample-user.ip", "user.name": "sample-user.name"}, c.Alert)
+	assert.Equal(map[string]string{
+		"ip": "sample-user.ip", "text": "login of sample-user.name from sample-user.ip",
+	}, c.Mocks[0].Scenarios[0].Input)
+
+	s := &Suite{Playbook: "inline", playbookData: playbook, Cases: []Case{*c}}
+	r := s.Run()
+	assert.Empty(r.Cases[0].Failures)
+}
+
+func TestGenerateSolvesCompoundConditions(t *testing.T) {
+	assert := assert.New(t)
+
+	playbook := []byte(`
+- id: lookup
+  urn: urn:lookup
+  params: {ip: "@alert:srcIp"}
+  exports: {score: reputationScore}
+- id: risky
+  type: if
+  condition: '$score > 50 and not (@alert:zone == internal or @alert:user == admin)'
+  onTrue:
+    - {id: block, urn: urn:block, params: {ip: "@alert:srcIp"}}
+`)
+	nodes, err := execution.NewNodesFromYaml(playbook)
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+
+	generated := GenerateCases(nodes)
+	if !assert.Len(generated, 2) || !assert.NotNil(generated[0].Case) || !assert.NotNil(generated[1].Case) {
+		return
+	}
+	assert.Equal("51", generated[0].Case.Mocks[0].Scenarios[0].ResultFieldMap["reputationScore"])
+	assert.Equal("internal-other", generated[0].Case.Alert["zone"])
+	assert.Equal("admin-other", generated[0].Case.Alert["user"])
+	assert.Equal("50", generated[1].Case.Mocks[0].Scenarios[0].ResultFieldMap["reputationScore"])
+
+	s := &Suite{Playbook: "inline", playbookData: playbook}
+	for _, g := range generated {
+		s.Cases = append(s.Cases, *g.Case)
+	}
+	r := s.Run()
+	for _, c := range r.Cases {
+		assert.Empty(c.Failures, c.Name)
+	}
+
+	// A decision that no way of the condition allows is infeasible.
+	nodes, err = execution.NewNodesFromYaml([]byte(`
+- id: never
+  type: if
+  condition: '@alert:score > 5 and @alert:score < 3'
+`))
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+	generated = GenerateCases(nodes)
+	if assert.Len(generated, 2) {
+		assert.Contains(generated[0].Infeasible, "@alert:score")
+		assert.NotNil(generated[1].Case)
+	}
+}
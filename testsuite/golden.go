@@ -0,0 +1,158 @@
+package testsuite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"rptsec.com/amg/execution"
+)
+
+// Snapshot returns the yaml of a result tree, as written by `amg run`.
+// Generated node ids, which change from run to run, are replaced by
+// "generated-N", numbered in the order the nodes appear.
+func Snapshot(nodes []execution.N) ([]byte, error) {
+	nodes = copyNodes(nodes)
+	generated := 0
+	WalkWithPosition(nodes, "", func(pos string, n *execution.N) {
+		if n.GeneratedID() {
+			generated++
+			n.ID = fmt.Sprintf("generated-%d", generated)
+		}
+	})
+	return yaml.Marshal(nodes)
+}
+
+// CompareGolden compares actual with the contents of the golden file at path
+// and returns a diff when they differ. With update set, the golden file is
+// rewritten with actual instead.
+func CompareGolden(actual []byte, path string, update bool) (string, error) {
+	if update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return "", err
+		}
+		return "", ioutil.WriteFile(path, actual, 0644)
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading golden file: %s", err.Error())
+	}
+	if string(expected) == string(actual) {
+		return "", nil
+	}
+	return Diff(path, "actual", string(expected), string(actual)), nil
+}
+
+// Diff returns a unified diff of the lines of a and b, with 3 lines of context.
+func Diff(aName string, bName string, a string, b string) string {
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	ops := diffLines(aLines, bLines)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+	const context = 3
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// Extend the hunk while changes are within 2*context lines of each other.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		stop := end + context
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+
+		aStart, bStart, aCount, bCount := ops[start].aLine, ops[start].bLine, 0, 0
+		for _, op := range ops[start:stop] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart+1, aCount, bStart+1, bCount)
+		for _, op := range ops[start:stop] {
+			fmt.Fprintf(&sb, "%c%s\n", op.kind, op.text)
+		}
+		i = stop
+	}
+	return sb.String()
+}
+
+type diffOp struct {
+	kind  byte // ' ', '-' or '+'
+	text  string
+	aLine int
+	bLine int
+}
+
+// diffLines computes an edit script from a to b using the longest common
+// subsequence of lines.
+func diffLines(a []string, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i, j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', b[j], i, j})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', a[i], i, j})
+			i++
+		}
+	}
+	return ops
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
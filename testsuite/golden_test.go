@@ -0,0 +1,81 @@
+package testsuite
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/execution"
+)
+
+func TestSnapshotNormalizesGeneratedIds(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes, err := execution.NewNodesFromYaml([]byte(`
+- urn: urn:a
+- id: named
+  urn: urn:b
+- urn: urn:c
+`))
+	assert.Nil(err)
+	execution.ConvertToLinkedNodes(nodes)
+
+	snapshot, err := Snapshot(nodes)
+	assert.Nil(err)
+	assert.Equal(`- Urn: urn:a
+  id: generated-1
+  type: execute
+- Urn: urn:b
+  id: named
+  type: execute
+- Urn: urn:c
+  id: generated-2
+  type: execute
+`, string(snapshot))
+}
+
+func TestCompareGolden(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "golden.yaml")
+
+	_, err := CompareGolden([]byte("a\n"), path, false)
+	assert.NotNil(err)
+
+	diff, err := CompareGolden([]byte("a\nb\n"), path, true)
+	assert.Nil(err)
+	assert.Equal("", diff)
+	written, _ := ioutil.ReadFile(path)
+	assert.Equal("a\nb\n", string(written))
+
+	diff, err = CompareGolden([]byte("a\nb\n"), path, false)
+	assert.Nil(err)
+	assert.Equal("", diff)
+
+	diff, err = CompareGolden([]byte("a\nc\n"), path, false)
+	assert.Nil(err)
+	assert.Equal("--- "+path+"\n+++ actual\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n", diff)
+}
+
+func TestDiffKeepsHunksMinimal(t *testing.T) {
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	b := "1\nx\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\ny\n15\n"
+	assert.Equal(t, `--- a
++++ b
+@@ -1,5 +1,5 @@
+ 1
+-2
++x
+ 3
+ 4
+ 5
+@@ -11,5 +11,5 @@
+ 11
+ 12
+ 13
+-14
++y
+ 15
+`, Diff("a", "b", a, b))
+}
@@ -0,0 +1,234 @@
+package testsuite
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	yaml2 "gopkg.in/yaml.v2"
+	yaml3 "gopkg.in/yaml.v3"
+
+	"rptsec.com/amg/execution"
+)
+
+// Mutant is a variant of the playbook with a single change.
+type Mutant struct {
+	Description string
+	// Position of the changed node in the playbook, eg. "[2].onTrue[0]"
+	Position string
+	// Line in the playbook file of the change, 0 if unknown
+	Line int
+	// Killed is set when at least one case failed against the mutant
+	Killed   bool
+	KilledBy string
+
+	playbook []byte
+}
+
+// MutationReport is the outcome of running a suite against every mutant of
+// its playbook.
+type MutationReport struct {
+	Playbook string
+	Mutants  []*Mutant
+}
+
+// Survivors returns the mutants that no case detected.
+func (r *MutationReport) Survivors() []*Mutant {
+	var survivors []*Mutant
+	for _, m := range r.Mutants {
+		if !m.Killed {
+			survivors = append(survivors, m)
+		}
+	}
+	return survivors
+}
+
+// Score is the percentage of mutants that were killed.
+func (r *MutationReport) Score() float64 {
+	return percent(len(r.Mutants)-len(r.Survivors()), len(r.Mutants))
+}
+
+// Mutate runs the cases of the suite against every mutant of its playbook.
+// The suite must pass against the playbook as is.
+func (s *Suite) Mutate() (*MutationReport, error) {
+	if baseline := s.Run(); !baseline.Passed() {
+		return nil, fmt.Errorf("suite %s does not pass against the unmodified playbook", s.Name)
+	}
+	mutants, err := GenerateMutants(s.playbookData)
+	if err != nil {
+		return nil, err
+	}
+
+	original := s.playbookData
+	defer func() { s.playbookData = original }()
+	for _, m := range mutants {
+		s.playbookData = m.playbook
+		for i := range s.Cases {
+			if r := s.RunCase(&s.Cases[i]); !r.Passed() {
+				m.Killed = true
+				m.KilledBy = r.Name
+				break
+			}
+		}
+	}
+	return &MutationReport{Playbook: s.Playbook, Mutants: mutants}, nil
+}
+
+// conditionOperatorMutations maps an operator to the ones it is mutated into
+var conditionOperatorMutations = map[string][]string{
+	"==": {"!="},
+	"!=": {"=="},
+	">":  {">="},
+	">=": {">"},
+	"<":  {"<="},
+	"<=": {"<"},
+}
+
+// GenerateMutants returns the variants of the playbook in playbookData that
+// each have one of these changes:
+//  - the operator of a comparison in a condition is flipped (== and !=) or made inclusive or
+//    exclusive (> and >=, < and <=)
+//  - onTrue and onFalse of an if node are swapped
+//  - an action node is deleted
+//  - a literal param of an action node is changed
+func GenerateMutants(playbookData []byte) ([]*Mutant, error) {
+	nodes, err := execution.NewNodesFromYaml(playbookData)
+	if err != nil {
+		return nil, err
+	}
+	lines := nodeLines(playbookData)
+
+	var mutants []*Mutant
+	var genErr error
+	add := func(pos string, field string, description string, mutate func(*execution.N, *[]execution.N, int)) {
+		mutated := copyNodes(nodes)
+		list, i := locate(&mutated, pos)
+		mutate(&(*list)[i], list, i)
+		d, err := yaml2.Marshal(mutated)
+		if err != nil {
+			genErr = err
+			return
+		}
+		line := lines[pos+field]
+		if line == 0 {
+			line = lines[pos]
+		}
+		mutants = append(mutants, &Mutant{Description: description, Position: pos, Line: line, playbook: d})
+	}
+
+	WalkWithPosition(nodes, "", func(pos string, n *execution.N) {
+		name := n.ID
+		if name == "" {
+			name = pos
+		}
+		switch n.NodeType {
+		case "if":
+			comparisons := execution.NewCondition(n.Condition).Comparisons()
+			for _, cmp := range comparisons {
+				for _, to := range conditionOperatorMutations[cmp.Op] {
+					mutatedCondition := n.Condition[:cmp.OpPos] + to + n.Condition[cmp.OpPos+len(cmp.Op):]
+					where := "condition"
+					if len(comparisons) > 1 {
+						where = fmt.Sprintf("%q in condition", cmp.String())
+					}
+					add(pos, ".condition", fmt.Sprintf("change %q to %q in %s of %s", cmp.Op, to, where, name),
+						func(m *execution.N, _ *[]execution.N, _ int) { m.Condition = mutatedCondition })
+				}
+			}
+			add(pos, "", fmt.Sprintf("swap onTrue and onFalse of %s", name),
+				func(m *execution.N, _ *[]execution.N, _ int) { m.OnTrue, m.OnFalse = m.OnFalse, m.OnTrue })
+
+		case "", "execute":
+			add(pos, "", fmt.Sprintf("delete action node %s", name),
+				func(_ *execution.N, list *[]execution.N, i int) {
+					*list = append((*list)[:i:i], (*list)[i+1:]...)
+				})
+			for _, param := range sortedKeys(n.Params) {
+				val := n.Params[param]
+				if execution.IsTemplate(val) || strings.HasPrefix(val, "@") || strings.HasPrefix(val, "$") {
+					continue
+				}
+				mutatedVal := mutateLiteral(val)
+				param := param
+				add(pos, ".params."+param, fmt.Sprintf("change param %s of %s from %q to %q", param, name, val, mutatedVal),
+					func(m *execution.N, _ *[]execution.N, _ int) {
+						params := make(map[string]string, len(m.Params))
+						for k, v := range m.Params {
+							params[k] = v
+						}
+						params[param] = mutatedVal
+						m.Params = params
+					})
+			}
+		}
+	})
+	if genErr != nil {
+		return nil, genErr
+	}
+	return mutants, nil
+}
+
+func mutateLiteral(val string) string {
+	if n, err := strconv.Atoi(val); err == nil {
+		return strconv.Itoa(n + 1)
+	}
+	return val + "-mutated"
+}
+
+// locate finds the list holding the node at pos, and its index in that list.
+func locate(nodes *[]execution.N, pos string) (*[]execution.N, int) {
+	list := nodes
+	for {
+		end := strings.Index(pos, "]")
+		i, _ := strconv.Atoi(pos[1:end])
+		pos = pos[end+1:]
+		switch {
+		case strings.HasPrefix(pos, ".onTrue"):
+			list = &(*list)[i].OnTrue
+			pos = strings.TrimPrefix(pos, ".onTrue")
+		case strings.HasPrefix(pos, ".onFalse"):
+			list = &(*list)[i].OnFalse
+			pos = strings.TrimPrefix(pos, ".onFalse")
+		default:
+			return list, i
+		}
+	}
+}
+
+// nodeLines maps the position of every node, and of the fields within it such
+// as "[2].condition" or "[0].params.ipv4Addr", to its line in the playbook.
+func nodeLines(playbookData []byte) map[string]int {
+	lines := make(map[string]int)
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(playbookData, &doc); err != nil || len(doc.Content) == 0 {
+		return lines
+	}
+	var walk func(seq *yaml3.Node, prefix string)
+	walk = func(seq *yaml3.Node, prefix string) {
+		if seq.Kind != yaml3.SequenceNode {
+			return
+		}
+		for i, item := range seq.Content {
+			pos := fmt.Sprintf("%s[%d]", prefix, i)
+			lines[pos] = item.Line
+			if item.Kind != yaml3.MappingNode {
+				continue
+			}
+			for k := 0; k+1 < len(item.Content); k += 2 {
+				key, val := item.Content[k], item.Content[k+1]
+				switch key.Value {
+				case "onTrue", "onFalse":
+					walk(val, pos+"."+key.Value)
+				case "params":
+					for p := 0; p+1 < len(val.Content); p += 2 {
+						lines[pos+".params."+val.Content[p].Value] = val.Content[p].Line
+					}
+				default:
+					lines[pos+"."+key.Value] = key.Line
+				}
+			}
+		}
+	}
+	walk(doc.Content[0], "")
+	return lines
+}
@@ -0,0 +1,129 @@
+package testsuite
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/actionstore"
+)
+
+func TestMutantsOfSamplePlaybook(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../resources/sample-playbook.yaml")
+	assert.Nil(err)
+	mutants, err := GenerateMutants(data)
+	assert.Nil(err)
+
+	var described []string
+	for _, m := range mutants {
+		described = append(described, m.Description)
+	}
+	assert.Equal([]string{
+		"delete action node ac1",
+		"delete action node ac2",
+		`change "==" to "!=" in condition of if3`,
+		"swap onTrue and onFalse of if3",
+		"delete action node ifYesAc1",
+		"delete action node ifYesAc2",
+		"delete action node ifNoAc1",
+		`change param ipv4Addr of ifNoAc1 from "192.168.0.4" to "192.168.0.4-mutated"`,
+		"delete action node ac4",
+		`change param ipv4Addr of ac4 from "192.168.0.5" to "192.168.0.5-mutated"`,
+	}, described)
+	assert.Equal(15, mutants[2].Line)
+	assert.Equal("[2]", mutants[2].Position)
+	assert.Equal(13, mutants[3].Line)
+	assert.Equal(34, mutants[7].Line)
+	assert.Contains(string(mutants[2].playbook), "'@node:ac1$reputationScore != 50'")
+}
+
+func TestSurvivingMutants(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &Suite{
+		Name:     "weak",
+		Playbook: "weak.yaml",
+		playbookData: []byte(`
+- id: lookup
+  urn: urn:lookup
+  params:
+    ip: 10.0.0.1
+  exports:
+    score: reputationScore
+- id: check
+  type: if
+  condition: "$score > 50"
+  onTrue:
+    - id: block
+      urn: urn:block
+`),
+		sharedMocks: []actionstore.ActionMockScenario{
+			{ActionUrn: "urn:lookup", Scenarios: []actionstore.MockScenario{{
+				Input:        map[string]string{"ip": "*"},
+				ActionResult: actionstore.ActionResult{ResultFieldMap: map[string]string{"reputationScore": "90"}},
+			}}},
+			{ActionUrn: "urn:block", Scenarios: []actionstore.MockScenario{{Input: map[string]string{}}}},
+		},
+		Cases: []Case{{
+			Name:   "high score blocks",
+			Expect: Expectations{Nodes: map[string]string{"block": "Done"}},
+		}},
+	}
+
+	r, err := s.Mutate()
+	assert.Nil(err)
+	assert.Equal(5, len(r.Mutants))
+	survivors := r.Survivors()
+	assert.Equal(2, len(survivors))
+	assert.Equal(`change param ip of lookup from "10.0.0.1" to "10.0.0.1-mutated"`, survivors[0].Description)
+	assert.Equal(5, survivors[0].Line)
+	assert.Equal(`change ">" to ">=" in condition of check`, survivors[1].Description)
+	assert.Equal(10, survivors[1].Line)
+	assert.Equal(60.0, r.Score())
+
+	s.Cases[0].Expect.Nodes["block"] = "Failed"
+	_, err = s.Mutate()
+	assert.NotNil(err)
+}
+
+func TestMutantsKeepTemplateParams(t *testing.T) {
+	assert := assert.New(t)
+
+	mutants, err := GenerateMutants([]byte(`
+- id: notify
+  urn: urn:notify
+  params:
+    text: "login from ${@alert:srcIp}"
+    channel: soc
+`))
+	assert.Nil(err)
+	var described []string
+	for _, m := range mutants {
+		described = append(described, m.Description)
+	}
+	assert.Equal([]string{
+		"delete action node notify",
+		`change param channel of notify from "soc" to "soc-mutated"`,
+	}, described)
+}
+
+func TestMutantsOfCompoundConditions(t *testing.T) {
+	assert := assert.New(t)
+
+	mutants, err := GenerateMutants([]byte(`
+- id: check
+  type: if
+  condition: "$score > 50 and not (@alert:user == admin)"
+`))
+	assert.Nil(err)
+	if assert.Len(mutants, 3) {
+		assert.Equal(`change ">" to ">=" in "$score > 50" in condition of check`, mutants[0].Description)
+		assert.Contains(string(mutants[0].playbook), "$score >= 50 and not (@alert:user == admin)")
+		assert.Equal(`change "==" to "!=" in "@alert:user == admin" in condition of check`, mutants[1].Description)
+		assert.Contains(string(mutants[1].playbook), "$score > 50 and not (@alert:user != admin)")
+		assert.Equal("swap onTrue and onFalse of check", mutants[2].Description)
+	}
+}
@@ -0,0 +1,581 @@
+package testsuite
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/execution"
+)
+
+const (
+	defaultPropertyRuns      = 100
+	defaultPropertyTimeoutMs = 5000
+	// maxShrinkRuns bounds the number of runs made while shrinking a counterexample
+	maxShrinkRuns = 1000
+	// maxRegexRepeat bounds the repetitions of *, + and {n,} in generated strings
+	maxRegexRepeat = 8
+)
+
+// PropertySpec describes how to generate alert data for a playbook and the
+// invariants that must hold for every run with that data.
+type PropertySpec struct {
+	Name     string                           `json:"name,omitempty"`
+	Playbook string                           `json:"playbook"`
+	MockFile string                           `json:"mockFile,omitempty"`
+	Mocks    []actionstore.ActionMockScenario `json:"mocks,omitempty"`
+	// Runs is the number of alerts generated, 100 by default
+	Runs int `json:"runs,omitempty"`
+	// Seed of the random generator. A seed based on the time is used when 0.
+	Seed int64 `json:"seed,omitempty"`
+	// TimeoutMs is how long a run may take before it is deemed to not terminate
+	TimeoutMs  int                  `json:"timeoutMs,omitempty"`
+	Alert      map[string]FieldSpec `json:"alert"`
+	Invariants []Invariant          `json:"invariants"`
+
+	playbookData []byte
+	mocks        []actionstore.ActionMockScenario
+	fields       map[string]*fieldGen
+}
+
+// FieldSpec declares how the values of an alert field are generated. Exactly
+// one of the fields is set.
+type FieldSpec struct {
+	// Value is a constant
+	Value string `json:"value,omitempty"`
+	// Enum picks one of the values
+	Enum []string `json:"enum,omitempty"`
+	// Cidr picks an IP address within the network, eg. 10.0.0.0/8
+	Cidr string `json:"cidr,omitempty"`
+	// Regex generates a string that matches the regular expression
+	Regex string `json:"regex,omitempty"`
+	// Int picks an integer within the range
+	Int *IntRange `json:"int,omitempty"`
+}
+
+// IntRange is an inclusive range of integers.
+type IntRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Invariant is a property of a run. Exactly one of the fields is set.
+// Every run is checked for termination whether or not it is listed.
+type Invariant struct {
+	Terminates bool `json:"terminates,omitempty"`
+	// NoNodeInState fails the run if any node ends in the state, eg.
+	// Waiting-Var-Resolution
+	NoNodeInState string `json:"noNodeInState,omitempty"`
+	// NoError fails the run if the execution stopped with an error
+	NoError bool `json:"noError,omitempty"`
+	// NeverCalls fails the run if a matching action call is made
+	NeverCalls *ForbiddenCall `json:"neverCalls,omitempty"`
+}
+
+// ForbiddenCall matches calls to an action. Without Param every call to Urn
+// matches; with Param only the calls whose Param is in one of the networks.
+type ForbiddenCall struct {
+	Urn   string `json:"urn"`
+	Param string `json:"param,omitempty"`
+	// PrivateIP matches the RFC1918 networks
+	PrivateIP bool     `json:"privateIp,omitempty"`
+	InCidr    []string `json:"inCidr,omitempty"`
+}
+
+var rfc1918 = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+
+// PropertyResult is the outcome of checking a PropertySpec.
+type PropertyResult struct {
+	Name     string
+	Playbook string
+	Seed     int64
+	// Runs is the number of generated alerts that were run, including the
+	// failing one.
+	Runs      int
+	Violation string
+	// Original is the first generated alert data that violated an invariant
+	Original map[string]string
+	// Counterexample is Original shrunk to the simplest values that still
+	// violate the same invariant.
+	Counterexample map[string]string
+	ShrinkSteps    int
+}
+
+// Passed reports whether every run satisfied the invariants.
+func (r *PropertyResult) Passed() bool {
+	return r.Violation == ""
+}
+
+// LoadPropertySpec reads a property spec file along with the playbook and
+// mocks it refers to. Relative paths are resolved against the directory of
+// the spec file.
+func LoadPropertySpec(path string) (*PropertySpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading property spec %s: %s", path, err.Error())
+	}
+	p, err := ParsePropertySpec(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return p, nil
+}
+
+// ParsePropertySpec parses the yaml representation of a property spec.
+func ParsePropertySpec(data []byte, baseDir string) (*PropertySpec, error) {
+	p := &PropertySpec{}
+	if err := decodeStrict(data, p); err != nil {
+		return nil, fmt.Errorf("error in parsing property spec: %s", err.Error())
+	}
+	if p.Playbook == "" {
+		return nil, fmt.Errorf("property spec does not name a playbook")
+	}
+
+	var err error
+	p.Playbook = resolvePath(baseDir, p.Playbook)
+	if p.playbookData, err = ioutil.ReadFile(p.Playbook); err != nil {
+		return nil, fmt.Errorf("error reading playbook: %s", err.Error())
+	}
+	if p.MockFile != "" {
+		p.MockFile = resolvePath(baseDir, p.MockFile)
+	}
+	if p.mocks, err = loadMocks(p.MockFile, p.Mocks); err != nil {
+		return nil, err
+	}
+	if err := p.compile(); err != nil {
+		return nil, err
+	}
+	if p.Name == "" {
+		p.Name = filepath.Base(p.Playbook)
+	}
+	return p, nil
+}
+
+func (p *PropertySpec) compile() error {
+	p.fields = make(map[string]*fieldGen)
+	for name, spec := range p.Alert {
+		g, err := newFieldGen(spec)
+		if err != nil {
+			return fmt.Errorf("alert field %s: %s", name, err.Error())
+		}
+		p.fields[name] = g
+	}
+	for i, inv := range p.Invariants {
+		if inv.NeverCalls == nil {
+			continue
+		}
+		for _, cidr := range inv.NeverCalls.InCidr {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("invariant %d: %s", i+1, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Check runs the playbook with generated alert data until an invariant is
+// violated or all the runs are done. A violating alert is shrunk to a
+// minimal counterexample.
+func (p *PropertySpec) Check() *PropertyResult {
+	if p.fields == nil {
+		if err := p.compile(); err != nil {
+			return &PropertyResult{Name: p.Name, Playbook: p.Playbook, Violation: err.Error()}
+		}
+	}
+	runs := p.Runs
+	if runs <= 0 {
+		runs = defaultPropertyRuns
+	}
+	seed := p.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+	r := &PropertyResult{Name: p.Name, Playbook: p.Playbook, Seed: seed}
+
+	names := make([]string, 0, len(p.fields))
+	for name := range p.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for r.Runs < runs {
+		r.Runs++
+		alert := make(map[string]string, len(names))
+		for _, name := range names {
+			alert[name] = p.fields[name].generate(rng)
+		}
+		if v := p.check(alert); v != nil {
+			r.Original = alert
+			var shrunk *violation
+			r.Counterexample, shrunk, r.ShrinkSteps = p.shrink(names, alert, v)
+			r.Violation = shrunk.message
+			return r
+		}
+	}
+	return r
+}
+
+// Kinds of violations that are not of an invariant listed in the spec.
+const (
+	violatesTermination = -1
+	violatesRun         = -2
+)
+
+// violation is an invariant broken by a run.
+type violation struct {
+	// invariant is the index of the broken invariant in Invariants, or one
+	// of violatesTermination and violatesRun
+	invariant int
+	message   string
+}
+
+// shrink repeatedly replaces a field with a simpler value as long as the run
+// still violates the same invariant.
+func (p *PropertySpec) shrink(names []string, alert map[string]string, v *violation) (map[string]string, *violation, int) {
+	steps, shrinkRuns := 0, 0
+	for shrinkRuns < maxShrinkRuns {
+		improved := false
+		for _, name := range names {
+			for _, candidate := range p.fields[name].shrink(alert[name]) {
+				if candidate == alert[name] {
+					continue
+				}
+				trial := make(map[string]string, len(alert))
+				for k, val := range alert {
+					trial[k] = val
+				}
+				trial[name] = candidate
+				shrinkRuns++
+				if tv := p.check(trial); tv != nil && tv.invariant == v.invariant {
+					alert, v = trial, tv
+					improved = true
+					steps++
+					break
+				}
+			}
+			if improved {
+				break
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return alert, v, steps
+}
+
+// check runs the playbook once and returns the first invariant violated, or
+// nil.
+func (p *PropertySpec) check(alert map[string]string) *violation {
+	timeout := p.TimeoutMs
+	if timeout <= 0 {
+		timeout = defaultPropertyTimeoutMs
+	}
+	done := make(chan *CaseResult, 1)
+	stop := make(chan struct{})
+	go func() {
+		done <- ExecuteWithOptions(p.playbookData, execution.AlertFromStrings(alert), p.mocks,
+			ExecuteOptions{Stop: stop})
+	}()
+	var r *CaseResult
+	select {
+	case r = <-done:
+	case <-time.After(time.Duration(timeout) * time.Millisecond):
+		// The run is stopped rather than left running in the background.
+		close(stop)
+		return &violation{violatesTermination, fmt.Sprintf("terminates: run did not finish within %dms", timeout)}
+	}
+	if r.Err != nil {
+		return &violation{violatesRun, r.Err.Error()}
+	}
+
+	for i, inv := range p.Invariants {
+		switch {
+		case inv.NoNodeInState != "":
+			var ids []string
+			for id, n := range IndexNodes(r.Nodes) {
+				if n.State == inv.NoNodeInState {
+					ids = append(ids, id)
+				}
+			}
+			if len(ids) > 0 {
+				sort.Strings(ids)
+				return &violation{i, fmt.Sprintf("noNodeInState %s: nodes %s are %s",
+					inv.NoNodeInState, strings.Join(ids, ", "), inv.NoNodeInState)}
+			}
+		case inv.NoError:
+			if r.ExecErr != nil {
+				return &violation{i, fmt.Sprintf("noError: execution failed: %s", r.ExecErr.Error())}
+			}
+		case inv.NeverCalls != nil:
+			for _, c := range r.MockCalls {
+				if inv.NeverCalls.matches(c) {
+					return &violation{i, fmt.Sprintf("neverCalls %s: called with %s", c.Urn, formatParams(c.Params))}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (f *ForbiddenCall) matches(c actionstore.ActionCall) bool {
+	if c.Urn != f.Urn {
+		return false
+	}
+	if f.Param == "" {
+		return true
+	}
+	ip := net.ParseIP(c.Params[f.Param])
+	if ip == nil {
+		return false
+	}
+	cidrs := f.InCidr
+	if f.PrivateIP {
+		cidrs = append(append([]string{}, cidrs...), rfc1918...)
+	}
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------
+// Generators
+
+// fieldGen generates values for a field, and simpler values to shrink to.
+type fieldGen struct {
+	spec    FieldSpec
+	network *net.IPNet
+	regex   *syntax.Regexp
+}
+
+func newFieldGen(spec FieldSpec) (*fieldGen, error) {
+	g := &fieldGen{spec: spec}
+	set := 0
+	if spec.Value != "" {
+		set++
+	}
+	if len(spec.Enum) > 0 {
+		set++
+	}
+	if spec.Cidr != "" {
+		set++
+		_, network, err := net.ParseCIDR(spec.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		g.network = network
+	}
+	if spec.Regex != "" {
+		set++
+		re, err := syntax.Parse(spec.Regex, syntax.Perl)
+		if err != nil {
+			return nil, err
+		}
+		g.regex = re.Simplify()
+	}
+	if spec.Int != nil {
+		set++
+		if spec.Int.Min > spec.Int.Max {
+			return nil, fmt.Errorf("int range has min greater than max")
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of value, enum, cidr, regex or int must be set")
+	}
+	return g, nil
+}
+
+func (g *fieldGen) generate(rng *rand.Rand) string {
+	switch {
+	case len(g.spec.Enum) > 0:
+		return g.spec.Enum[rng.Intn(len(g.spec.Enum))]
+	case g.network != nil:
+		ones, bits := g.network.Mask.Size()
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		return g.ipAt(new(big.Int).Rand(rng, size))
+	case g.regex != nil:
+		var b strings.Builder
+		generateRegex(g.regex, rng, &b)
+		return b.String()
+	case g.spec.Int != nil:
+		return strconv.Itoa(g.spec.Int.Min + rng.Intn(g.spec.Int.Max-g.spec.Int.Min+1))
+	}
+	return g.spec.Value
+}
+
+// shrink returns values simpler than val, simplest first.
+func (g *fieldGen) shrink(val string) []string {
+	switch {
+	case len(g.spec.Enum) > 0:
+		for i, e := range g.spec.Enum {
+			if e == val {
+				return g.spec.Enum[:i]
+			}
+		}
+	case g.network != nil:
+		ip := net.ParseIP(val)
+		if ip == nil {
+			return nil
+		}
+		offset := new(big.Int).Sub(ipToInt(ip), ipToInt(g.network.IP))
+		if offset.Sign() <= 0 {
+			return nil
+		}
+		half := new(big.Int).Rsh(offset, 1)
+		return []string{g.ipAt(big.NewInt(0)), g.ipAt(half), g.ipAt(new(big.Int).Sub(offset, big.NewInt(1)))}
+	case g.regex != nil:
+		var b strings.Builder
+		generateRegex(g.regex, nil, &b)
+		if len(b.String()) < len(val) {
+			return []string{b.String()}
+		}
+	case g.spec.Int != nil:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil
+		}
+		// Shrink towards 0, or the end of the range closest to it.
+		target := 0
+		if target < g.spec.Int.Min {
+			target = g.spec.Int.Min
+		}
+		if target > g.spec.Int.Max {
+			target = g.spec.Int.Max
+		}
+		if n == target {
+			return nil
+		}
+		step := 1
+		if n > target {
+			step = -1
+		}
+		return []string{strconv.Itoa(target), strconv.Itoa(target + (n-target)/2), strconv.Itoa(n + step)}
+	}
+	return nil
+}
+
+func (g *fieldGen) ipAt(offset *big.Int) string {
+	ip := intToIP(new(big.Int).Add(ipToInt(g.network.IP), offset), len(g.network.IP))
+	return ip.String()
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+func intToIP(n *big.Int, size int) net.IP {
+	b := n.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+// generateRegex writes a string matching re to b. With a nil rng the
+// simplest such string is written: fewest repetitions, first alternative and
+// lowest character of each class.
+func generateRegex(re *syntax.Regexp, rng *rand.Rand, b *strings.Builder) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		b.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		b.WriteRune(pickFromClass(re.Rune, rng))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		if rng == nil {
+			b.WriteRune('a')
+		} else {
+			b.WriteRune(rune('!' + rng.Intn('~'-'!'+1)))
+		}
+	case syntax.OpCapture:
+		generateRegex(re.Sub[0], rng, b)
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			generateRegex(sub, rng, b)
+		}
+	case syntax.OpAlternate:
+		if rng == nil {
+			generateRegex(re.Sub[0], rng, b)
+		} else {
+			generateRegex(re.Sub[rng.Intn(len(re.Sub))], rng, b)
+		}
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		min, max := re.Min, re.Max
+		switch re.Op {
+		case syntax.OpStar:
+			min, max = 0, -1
+		case syntax.OpPlus:
+			min, max = 1, -1
+		case syntax.OpQuest:
+			min, max = 0, 1
+		}
+		if max < 0 {
+			max = min + maxRegexRepeat
+		}
+		count := min
+		if rng != nil {
+			count += rng.Intn(max - min + 1)
+		}
+		for i := 0; i < count; i++ {
+			generateRegex(re.Sub[0], rng, b)
+		}
+	}
+	// Anchors and empty matches add nothing.
+}
+
+// pickFromClass picks a rune from the [lo, hi] pairs of a character class,
+// preferring printable ASCII.
+func pickFromClass(ranges []rune, rng *rand.Rand) rune {
+	var printable []rune
+	for i := 0; i+1 < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if lo < ' ' {
+			lo = ' '
+		}
+		if hi > '~' {
+			hi = '~'
+		}
+		for r := lo; r <= hi; r++ {
+			printable = append(printable, r)
+		}
+	}
+	if len(printable) == 0 {
+		return ranges[0]
+	}
+	if rng == nil {
+		return printable[0]
+	}
+	return printable[rng.Intn(len(printable))]
+}
+
+// -----------------------------------------------------------------------
+
+// WritePropertyText writes the outcome of each property check to w.
+func WritePropertyText(w io.Writer, results []*PropertyResult) {
+	for _, r := range results {
+		fmt.Fprintf(w, "=== %s (%s)\n", r.Name, r.Playbook)
+		if r.Passed() {
+			fmt.Fprintf(w, "PASS  %d runs (seed %d)\n", r.Runs, r.Seed)
+			continue
+		}
+		fmt.Fprintf(w, "FAIL  after %d runs (seed %d)\n", r.Runs, r.Seed)
+		fmt.Fprintf(w, "      invariant violated: %s\n", r.Violation)
+		fmt.Fprintf(w, "      counterexample (shrunk in %d steps): %s\n", r.ShrinkSteps, formatParams(r.Counterexample))
+		fmt.Fprintf(w, "      original: %s\n", formatParams(r.Original))
+	}
+}
@@ -0,0 +1,123 @@
+package testsuite
+
+import (
+	"math/rand"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSamplePropertySpec(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := LoadPropertySpec("../resources/sample-playbook-property.yaml")
+	assert.Nil(err)
+	p.Seed = 1
+	r := p.Check()
+	assert.True(r.Passed(), r.Violation)
+	assert.Equal(20, r.Runs)
+}
+
+func TestPropertyViolationIsShrunk(t *testing.T) {
+	assert := assert.New(t)
+
+	specYaml := `
+playbook: sample-playbook.yaml
+mockFile: sample-mock-scenario.json
+runs: 200
+seed: 7
+alert:
+  srcIp: {cidr: 192.168.0.0/28}
+  dstIp: {enum: [192.168.0.2, 192.168.0.3]}
+  tag: {regex: "[a-z]{3,6}-[0-9]+"}
+invariants:
+  - neverCalls:
+      urn: www.rptsec.com/sms/v1/getDomainForIp
+      param: ipv4Addr
+      privateIp: true
+`
+	p, err := ParsePropertySpec([]byte(specYaml), "../resources")
+	assert.Nil(err)
+	r := p.Check()
+	assert.False(r.Passed())
+	assert.Contains(r.Violation, "neverCalls www.rptsec.com/sms/v1/getDomainForIp")
+	assert.Equal(map[string]string{"srcIp": "192.168.0.1", "dstIp": "192.168.0.2", "tag": "aaa-0"},
+		r.Counterexample)
+	assert.Equal("192.168.0.1", r.Original["srcIp"])
+}
+
+func TestPropertySpecErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParsePropertySpec([]byte("playbook: sample-playbook.yaml\nalert: {srcIp: {cidr: 10.0.0.0/8, value: x}}"), "../resources")
+	assert.Contains(err.Error(), "alert field srcIp: exactly one of")
+	_, err = ParsePropertySpec([]byte("playbook: sample-playbook.yaml\nalert: {srcIp: {regex: \"[\"}}"), "../resources")
+	assert.Contains(err.Error(), "alert field srcIp")
+	_, err = ParsePropertySpec([]byte("playbook: sample-playbook.yaml\nalert: {n: {int: {min: 5, max: 1}}}"), "../resources")
+	assert.Contains(err.Error(), "min greater than max")
+}
+
+func TestFieldGenerators(t *testing.T) {
+	assert := assert.New(t)
+	rng := rand.New(rand.NewSource(1))
+
+	g, err := newFieldGen(FieldSpec{Regex: `^(ab|cd)x?[0-9]{2}$`})
+	assert.Nil(err)
+	re := regexp.MustCompile(`^(ab|cd)x?[0-9]{2}$`)
+	for i := 0; i < 50; i++ {
+		assert.Regexp(re, g.generate(rng))
+	}
+	assert.Equal([]string{"ab00"}, g.shrink("cdx42"))
+
+	g, err = newFieldGen(FieldSpec{Int: &IntRange{Min: -10, Max: 10}})
+	assert.Nil(err)
+	assert.Equal([]string{"0", "4", "7"}, g.shrink("8"))
+	assert.Nil(g.shrink("0"))
+
+	g, err = newFieldGen(FieldSpec{Cidr: "10.1.0.0/16"})
+	assert.Nil(err)
+	assert.Equal([]string{"10.1.0.0", "10.1.0.128", "10.1.0.255"}, g.shrink("10.1.1.0"))
+
+	g, err = newFieldGen(FieldSpec{Enum: []string{"low", "medium", "high"}})
+	assert.Nil(err)
+	assert.Equal([]string{"low", "medium"}, g.shrink("high"))
+}
+
+func TestShrinkKeepsTheViolatedInvariant(t *testing.T) {
+	assert := assert.New(t)
+
+	// 10.0.0.1 is simpler than the other addresses but has no mock, so it
+	// violates noError rather than neverCalls.
+	specYaml := `
+playbook: sample-playbook.yaml
+mocks:
+  - actionUrn: www.vt.com/soar-services/v1/checkIpReputation
+    scenarios:
+      - input: {ipv4Addr: 10.0.0.5}
+        outputFields: {reputationScore: "10"}
+      - input: {ipv4Addr: 10.0.0.6}
+        outputFields: {reputationScore: "10"}
+      - input: {ipv4Addr: 192.168.0.4}
+        outputFields: {reputationScore: "10"}
+      - input: {ipv4Addr: 192.168.0.5}
+        outputFields: {reputationScore: "10"}
+runs: 1
+seed: 1
+alert:
+  srcIp: {value: 10.0.0.6}
+  dstIp: {enum: [10.0.0.1, 10.0.0.5, 10.0.0.6]}
+invariants:
+  - noError: true
+  - neverCalls:
+      urn: www.vt.com/soar-services/v1/checkIpReputation
+      param: ipv4Addr
+      inCidr: [10.0.0.4/30]
+`
+	p, err := ParsePropertySpec([]byte(specYaml), "../resources")
+	assert.Nil(err)
+	r := p.Check()
+	assert.Equal("10.0.0.6", r.Original["dstIp"])
+	assert.Contains(r.Violation, "neverCalls www.vt.com/soar-services/v1/checkIpReputation")
+	assert.Equal("10.0.0.5", r.Counterexample["dstIp"])
+}
@@ -0,0 +1,272 @@
+package testsuite
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"rptsec.com/amg/actionstore"
+)
+
+// WriteText writes a human readable summary of the results to w.
+func WriteText(w io.Writer, results []*SuiteResult) {
+	totalPassed, totalFailed := 0, 0
+	for _, sr := range results {
+		fmt.Fprintf(w, "=== %s (%s)\n", sr.Name, sr.Playbook)
+		for _, cr := range sr.Cases {
+			status := "PASS"
+			if !cr.Passed() {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%s  %s (%s)\n", status, cr.Name, cr.Duration.Round(time.Microsecond))
+			if cr.Err != nil {
+				fmt.Fprintf(w, "      %s\n", cr.Err.Error())
+			}
+			for _, f := range cr.Failures {
+				fmt.Fprintf(w, "      %s\n", strings.Replace(strings.TrimSuffix(f.String(), "\n"), "\n", "\n      ", -1))
+			}
+		}
+		passed, failed := sr.Counts()
+		totalPassed += passed
+		totalFailed += failed
+	}
+	fmt.Fprintf(w, "--- %d passed, %d failed\n", totalPassed, totalFailed)
+}
+
+// WriteCoverageText writes a coverage summary for each playbook to w, followed
+// by the nodes and branches that were not covered.
+func WriteCoverageText(w io.Writer, coverage []*Coverage) {
+	for _, c := range coverage {
+		fmt.Fprintf(w, "coverage: %s\n", c.Summary().String())
+		for _, u := range c.Uncovered() {
+			fmt.Fprintf(w, "      %s\n", u)
+		}
+	}
+}
+
+// -----------------------------------------------------------------------
+// JUnit XML
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+	SystemOut *junitText      `xml:"system-out,omitempty"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr"`
+	Time      string         `xml:"time,attr"`
+	Failures  []junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure  `xml:"error,omitempty"`
+	SystemOut *junitText     `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",cdata"`
+}
+
+// junitText is written as CDATA so that multi-line text stays readable.
+type junitText struct {
+	Text string `xml:",cdata"`
+}
+
+func newJUnitText(s string) *junitText {
+	if s == "" {
+		return nil
+	}
+	return &junitText{Text: s}
+}
+
+// WriteJUnit writes the results as JUnit XML to w. Each case is a testcase,
+// each failed expectation a failure. The mock calls made by a case are
+// attached as its system-out and the coverage as the system-out of the suite.
+func WriteJUnit(w io.Writer, results []*SuiteResult) error {
+	doc := junitTestSuites{}
+	var total time.Duration
+	for _, sr := range results {
+		js := junitTestSuite{Name: sr.Name}
+		var suiteTime time.Duration
+		for _, cr := range sr.Cases {
+			jc := junitTestCase{
+				Name:      cr.Name,
+				ClassName: sr.Name,
+				Time:      seconds(cr.Duration),
+				SystemOut: newJUnitText(mockCallSummary(cr.MockCalls)),
+			}
+			for _, f := range cr.Failures {
+				jf := junitFailure{
+					Message: f.String(),
+					Type:    "expectation",
+					Text:    fmt.Sprintf("expected: %s\nactual: %s", f.Expected, f.Actual),
+				}
+				if f.Diff != "" {
+					jf.Message = f.What + ": result differs from golden file"
+					jf.Text = f.Diff
+				}
+				jc.Failures = append(jc.Failures, jf)
+			}
+			if cr.Err != nil {
+				jc.Error = &junitFailure{Message: cr.Err.Error(), Type: "error"}
+				js.Errors++
+			} else if len(cr.Failures) > 0 {
+				js.Failures++
+			}
+			suiteTime += cr.Duration
+			js.TestCases = append(js.TestCases, jc)
+		}
+		js.Tests = len(sr.Cases)
+		js.Time = seconds(suiteTime)
+		if sr.Coverage != nil {
+			var b strings.Builder
+			WriteCoverageText(&b, []*Coverage{sr.Coverage})
+			js.SystemOut = newJUnitText(b.String())
+		}
+		doc.Tests += js.Tests
+		doc.Failures += js.Failures
+		doc.Errors += js.Errors
+		total += suiteTime
+		doc.Suites = append(doc.Suites, js)
+	}
+	doc.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.6f", d.Seconds())
+}
+
+// -----------------------------------------------------------------------
+// TAP
+
+// WriteTAP writes the results in the Test Anything Protocol (version 13) to
+// w. Details of failures are written as a yaml block under the test line.
+func WriteTAP(w io.Writer, results []*SuiteResult) error {
+	total := 0
+	for _, sr := range results {
+		total += len(sr.Cases)
+	}
+	fmt.Fprintf(w, "TAP version 13\n1..%d\n", total)
+
+	n := 0
+	for _, sr := range results {
+		for _, cr := range sr.Cases {
+			n++
+			status := "ok"
+			if !cr.Passed() {
+				status = "not ok"
+			}
+			fmt.Fprintf(w, "%s %d - %s / %s\n", status, n, tapEscape(sr.Name), tapEscape(cr.Name))
+			fmt.Fprintf(w, "  ---\n  duration_ms: %.3f\n", float64(cr.Duration)/float64(time.Millisecond))
+			if cr.Err != nil {
+				fmt.Fprintf(w, "  error: %q\n", cr.Err.Error())
+			}
+			if len(cr.Failures) > 0 {
+				fmt.Fprintf(w, "  failures:\n")
+				for _, f := range cr.Failures {
+					if f.Diff != "" {
+						fmt.Fprintf(w, "    - what: %q\n      diff: |\n", f.What)
+						for _, line := range splitLines(f.Diff) {
+							fmt.Fprintf(w, "        %s\n", line)
+						}
+						continue
+					}
+					fmt.Fprintf(w, "    - what: %q\n      expected: %q\n      actual: %q\n", f.What, f.Expected, f.Actual)
+				}
+			}
+			fmt.Fprintf(w, "  ...\n")
+		}
+		if sr.Coverage != nil {
+			fmt.Fprintf(w, "# coverage: %s\n", sr.Coverage.Summary().String())
+		}
+	}
+	return nil
+}
+
+func tapEscape(s string) string {
+	return strings.NewReplacer("#", "\\#", "\n", " ").Replace(s)
+}
+
+// mockCallSummary lists the calls made to each action, sorted by urn.
+func mockCallSummary(calls []actionstore.ActionCall) string {
+	if len(calls) == 0 {
+		return ""
+	}
+	byUrn := make(map[string][]actionstore.ActionCall)
+	for _, c := range calls {
+		byUrn[c.Urn] = append(byUrn[c.Urn], c)
+	}
+	urns := make([]string, 0, len(byUrn))
+	for urn := range byUrn {
+		urns = append(urns, urn)
+	}
+	sort.Strings(urns)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "mock calls: %d\n", len(calls))
+	for _, urn := range urns {
+		fmt.Fprintf(&b, "  %s: %d\n", urn, len(byUrn[urn]))
+		for _, c := range byUrn[urn] {
+			matched := ""
+			if !c.Matched {
+				matched = " (no matching scenario)"
+			}
+			fmt.Fprintf(&b, "    %s%s\n", formatParams(c.Params), matched)
+		}
+	}
+	return b.String()
+}
+
+func formatParams(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, params[k])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// WriteMutationText writes the mutation score of each report to w, followed
+// by the mutants that survived.
+func WriteMutationText(w io.Writer, reports []*MutationReport) {
+	for _, r := range reports {
+		survivors := r.Survivors()
+		fmt.Fprintf(w, "mutation: %s: %d/%d mutants killed (%.1f%%)\n",
+			r.Playbook, len(r.Mutants)-len(survivors), len(r.Mutants), r.Score())
+		for _, m := range survivors {
+			fmt.Fprintf(w, "      SURVIVED %s:%d %s: %s\n", r.Playbook, m.Line, m.Position, m.Description)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package testsuite
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/actionstore"
+)
+
+func sampleResults() []*SuiteResult {
+	return []*SuiteResult{{
+		Name:     "sample",
+		Playbook: "sample-playbook.yaml",
+		Cases: []*CaseResult{{
+			Name:     "passes",
+			Duration: 1500 * time.Microsecond,
+			MockCalls: []actionstore.ActionCall{
+				{Urn: "urn:b", Params: map[string]string{"ip": "10.0.0.1"}, Matched: true},
+				{Urn: "urn:a", Params: map[string]string{"ip": "10.0.0.2"}, Matched: false},
+			},
+		}, {
+			Name:     "fails",
+			Duration: 2 * time.Millisecond,
+			Failures: []Failure{{What: "nodes.ac1", Expected: "Done", Actual: "Failed"}},
+		}, {
+			Name: "broken",
+			Err:  errors.New("error reading alert file"),
+		}},
+	}}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	assert := assert.New(t)
+
+	var b bytes.Buffer
+	assert.Nil(WriteJUnit(&b, sampleResults()))
+
+	var doc junitTestSuites
+	assert.Nil(xml.Unmarshal(b.Bytes(), &doc))
+	assert.Equal(3, doc.Tests)
+	assert.Equal(1, doc.Failures)
+	assert.Equal(1, doc.Errors)
+
+	cases := doc.Suites[0].TestCases
+	assert.Equal("0.001500", cases[0].Time)
+	assert.Equal("mock calls: 2\n  urn:a: 1\n    {ip=\"10.0.0.2\"} (no matching scenario)\n"+
+		"  urn:b: 1\n    {ip=\"10.0.0.1\"}\n", cases[0].SystemOut.Text)
+	assert.Equal(`nodes.ac1: expected "Done", got "Failed"`, cases[1].Failures[0].Message)
+	assert.Equal("expected: Done\nactual: Failed", cases[1].Failures[0].Text)
+	assert.Equal("error reading alert file", cases[2].Error.Message)
+}
+
+func TestWriteTAP(t *testing.T) {
+	var b bytes.Buffer
+	assert.Nil(t, WriteTAP(&b, sampleResults()))
+
+	lines := strings.Split(b.String(), "\n")
+	assert.Equal(t, "TAP version 13", lines[0])
+	assert.Equal(t, "1..3", lines[1])
+	assert.Contains(t, b.String(), "ok 1 - sample / passes\n")
+	assert.Contains(t, b.String(), "not ok 2 - sample / fails\n")
+	assert.Contains(t, b.String(), "    - what: \"nodes.ac1\"\n      expected: \"Done\"\n      actual: \"Failed\"\n")
+	assert.Contains(t, b.String(), "not ok 3 - sample / broken\n")
+}
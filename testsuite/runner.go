@@ -0,0 +1,376 @@
+package testsuite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"rptsec.com/amg/actionstore"
+	"rptsec.com/amg/execution"
+)
+
+const missing = "<missing>"
+
+// Failure is an expectation that did not hold.
+type Failure struct {
+	// What identifies the expectation, eg. "nodes.ac1" or "exports.score"
+	What     string
+	Expected string
+	Actual   string
+	// Diff is set instead of Expected and Actual when comparing against a
+	// golden file.
+	Diff string
+}
+
+func (f Failure) String() string {
+	if f.Diff != "" {
+		return fmt.Sprintf("%s: result differs from golden file\n%s", f.What, f.Diff)
+	}
+	return fmt.Sprintf("%s: expected %q, got %q", f.What, f.Expected, f.Actual)
+}
+
+// CaseResult is the outcome of running a single Case.
+type CaseResult struct {
+	Name     string
+	Duration time.Duration
+	Failures []Failure
+	// Err is set when the case could not be run at all.
+	Err error
+	// ExecErr is the error that stopped the playbook execution, if any.
+	ExecErr error
+	// Nodes is the playbook annotated with the result of the execution.
+	Nodes   []execution.N
+	Exports map[string]string
+	// MockCalls are the calls the playbook made to the mocked actions.
+	MockCalls []actionstore.ActionCall
+	// PeakConcurrency is the largest number of actions that ran at the same
+	// time.
+	PeakConcurrency int
+}
+
+// Passed reports whether the case ran and all of its expectations held.
+func (r *CaseResult) Passed() bool {
+	return r.Err == nil && len(r.Failures) == 0
+}
+
+// SuiteResult is the outcome of running all the cases of a Suite.
+type SuiteResult struct {
+	Name     string
+	Playbook string
+	Cases    []*CaseResult
+	// Coverage of the playbook over all the cases. It is nil when the
+	// playbook could not be parsed.
+	Coverage *Coverage
+}
+
+// Passed reports whether every case in the suite passed.
+func (r *SuiteResult) Passed() bool {
+	for _, c := range r.Cases {
+		if !c.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// Counts returns the number of passed and failed cases.
+func (r *SuiteResult) Counts() (passed int, failed int) {
+	for _, c := range r.Cases {
+		if c.Passed() {
+			passed++
+		} else {
+			failed++
+		}
+	}
+	return passed, failed
+}
+
+// Run executes every case of the suite against its playbook.
+func (s *Suite) Run() *SuiteResult {
+	result := &SuiteResult{Name: s.Name, Playbook: s.Playbook}
+	if nodes, err := execution.NewNodesFromYaml(s.playbookData); err == nil {
+		result.Coverage = NewCoverage(s.Playbook, nodes)
+	}
+	for i := range s.Cases {
+		cr := s.RunCase(&s.Cases[i])
+		if result.Coverage != nil && cr.Err == nil {
+			result.Coverage.Add(cr.Nodes)
+		}
+		result.Cases = append(result.Cases, cr)
+	}
+	return result
+}
+
+// RunCase executes a single case against the playbook of the suite.
+func (s *Suite) RunCase(c *Case) *CaseResult {
+	start := time.Now()
+	r := s.runCase(c)
+	r.Duration = time.Since(start)
+	return r
+}
+
+func (s *Suite) runCase(c *Case) *CaseResult {
+	alert, err := c.alertData()
+	if err != nil {
+		return &CaseResult{Name: c.Name, Err: err}
+	}
+	mocks := append(append([]actionstore.ActionMockScenario{}, c.Mocks...), s.sharedMocks...)
+	r := Execute(s.playbookData, alert, mocks)
+	r.Name = c.Name
+	if r.Err != nil {
+		return r
+	}
+
+	r.Failures = c.Expect.check(r)
+	if c.Golden != "" {
+		r.Failures = append(r.Failures, s.checkGolden(c, r)...)
+	}
+	return r
+}
+
+// Execute runs the playbook in playbookData once with the given alert data,
+// against an action store built from mocks. The returned result has no
+// failures as no expectations are checked.
+func Execute(playbookData []byte, alert map[string]interface{}, mocks []actionstore.ActionMockScenario) *CaseResult {
+	return ExecuteWithOptions(playbookData, alert, mocks, ExecuteOptions{})
+}
+
+// ExecuteOptions tune how ExecuteWithOptions runs a playbook.
+type ExecuteOptions struct {
+	// MaxParallel is the number of actions run at the same time, see
+	// execution.Execution.SetMaxParallel
+	MaxParallel int
+	// LatencyPerSec is slept by the mocked actions for every second of their
+	// executionDuration
+	LatencyPerSec time.Duration
+	// Observer, if set, is notified of the events of the execution
+	Observer execution.Observer
+	// CheckpointFile, if set, is where the checkpoint of the execution is
+	// written after every change
+	CheckpointFile string
+	// Resume, if set, is a checkpoint that the execution continues from,
+	// with the alert of the checkpoint
+	Resume []byte
+	// Stop, if set, stops the execution before its next node when closed
+	Stop <-chan struct{}
+}
+
+// ExecuteWithOptions is like Execute, with the nodes and mocks run as set by
+// opts.
+func ExecuteWithOptions(playbookData []byte, alert map[string]interface{},
+	mocks []actionstore.ActionMockScenario, opts ExecuteOptions) *CaseResult {
+	r := &CaseResult{}
+	// The playbook is parsed for each run as the nodes get annotated with
+	// the result of the run.
+	nodes, err := execution.NewNodesFromYaml(playbookData)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	first, err := execution.ConvertToLinkedNodes(nodes)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	playbook := &execution.Playbook{FirstNode: first}
+	as := actionstore.NewActionStoreFromScenarios(mocks)
+	as.SimulateLatency(opts.LatencyPerSec)
+
+	ex := execution.NewExecutionForAlert(playbook, alert, as)
+	ex.SetMaxParallel(opts.MaxParallel)
+	if opts.Observer != nil {
+		ex.AddObserver(opts.Observer)
+	}
+	if opts.CheckpointFile != "" {
+		ex.SetCheckpointFile(opts.CheckpointFile)
+	}
+	if opts.Stop != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-opts.Stop:
+				ex.Stop()
+			case <-finished:
+			}
+		}()
+	}
+	if opts.Resume != nil {
+		if err := ex.Resume(opts.Resume); err != nil {
+			r.Err = err
+			return r
+		}
+	} else {
+		ex.Start()
+	}
+	state := ex.Status(0)
+	execution.UpdateWithResultStatus(&nodes, state)
+
+	r.ExecErr = ex.Err()
+	r.MockCalls = as.Calls()
+	r.PeakConcurrency = ex.PeakConcurrency()
+	r.Nodes = nodes
+	r.Exports = make(map[string]string)
+	for name, val := range state.ExportedValues() {
+		r.Exports[name] = val.StringVal()
+	}
+	return r
+}
+
+func (s *Suite) checkGolden(c *Case, r *CaseResult) []Failure {
+	snapshot, err := Snapshot(r.Nodes)
+	if err != nil {
+		r.Err = err
+		return nil
+	}
+	diff, err := CompareGolden(snapshot, c.Golden, s.UpdateGolden)
+	if err != nil {
+		r.Err = err
+		return nil
+	}
+	if diff != "" {
+		return []Failure{{What: "golden", Diff: diff}}
+	}
+	return nil
+}
+
+func (c *Case) alertData() (map[string]interface{}, error) {
+	alert := make(map[string]interface{})
+	if c.AlertFile != "" {
+		data, err := ioutil.ReadFile(c.AlertFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading alert file: %s", err.Error())
+		}
+		if alert, err = execution.ParseAlert(data); err != nil {
+			return nil, fmt.Errorf("unable to parse the alert data in %s: %s", c.AlertFile, err.Error())
+		}
+	}
+	// Inline fields take precedence over the ones from the file.
+	for k, v := range c.Alert {
+		alert[k] = v
+	}
+	return alert, nil
+}
+
+// IndexNodes maps the id of every node in the tree, including the nested ones,
+// to the node.
+func IndexNodes(nodes []execution.N) map[string]*execution.N {
+	index := make(map[string]*execution.N)
+	var walk func([]execution.N)
+	walk = func(ns []execution.N) {
+		for i := range ns {
+			index[ns[i].ID] = &ns[i]
+			walk(ns[i].OnTrue)
+			walk(ns[i].OnFalse)
+		}
+	}
+	walk(nodes)
+	return index
+}
+
+func (e *Expectations) check(r *CaseResult) []Failure {
+	var failures []Failure
+	fail := func(what string, expected string, actual string) {
+		failures = append(failures, Failure{What: what, Expected: expected, Actual: actual})
+	}
+	nodes := IndexNodes(r.Nodes)
+
+	for _, id := range sortedKeys(e.Nodes) {
+		actual := missing
+		if n, ok := nodes[id]; ok {
+			actual = n.State
+		}
+		if actual != e.Nodes[id] {
+			fail("nodes."+id, e.Nodes[id], actual)
+		}
+	}
+
+	for _, id := range sortedKeys(e.Branches) {
+		expected := fmt.Sprint(e.Branches[id])
+		actual := missing
+		if n, ok := nodes[id]; ok {
+			actual = "not evaluated"
+			if n.State == execution.StateDone {
+				actual = fmt.Sprint(n.ConditionEvaluatedTo)
+			}
+		}
+		if actual != expected {
+			fail("branches."+id, expected, actual)
+		}
+	}
+
+	for _, id := range sortedKeys(e.Results) {
+		var fields map[string]string
+		if n, ok := nodes[id]; ok {
+			fields = n.ResultFields
+		}
+		for _, field := range sortedKeys(e.Results[id]) {
+			actual, ok := fields[field]
+			if !ok {
+				actual = missing
+			}
+			if actual != e.Results[id][field] {
+				fail("results."+id+"."+field, e.Results[id][field], actual)
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(e.Exports) {
+		actual, ok := r.Exports[name]
+		if !ok {
+			actual = missing
+		}
+		if actual != e.Exports[name] {
+			fail("exports."+name, e.Exports[name], actual)
+		}
+	}
+
+	for _, id := range sortedKeys(e.Errors) {
+		actual := missing
+		if n, ok := nodes[id]; ok {
+			actual = n.Err
+		}
+		if actual == missing || !strings.Contains(actual, e.Errors[id]) {
+			fail("errors."+id, e.Errors[id], actual)
+		}
+	}
+
+	actualErr := "none"
+	if r.ExecErr != nil {
+		actualErr = r.ExecErr.Error()
+	}
+	switch e.Error {
+	case "":
+	case "none":
+		if r.ExecErr != nil {
+			fail("error", e.Error, actualErr)
+		}
+	default:
+		if r.ExecErr == nil || !strings.Contains(actualErr, e.Error) {
+			fail("error", e.Error, actualErr)
+		}
+	}
+	return failures
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch mm := m.(type) {
+	case map[string]string:
+		for k := range mm {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range mm {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]string:
+		for k := range mm {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,161 @@
+package testsuite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/ghodss/yaml"
+
+	"rptsec.com/amg/actionstore"
+)
+
+// Suite is a set of test cases that are run against a single playbook.
+// Relative paths in a suite file are resolved against the directory of the
+// suite file.
+type Suite struct {
+	Name string `json:"name,omitempty"`
+	// Playbook is the path of the playbook under test
+	Playbook string `json:"playbook"`
+	// MockFile is a mock scenario file shared by all the cases
+	MockFile string `json:"mockFile,omitempty"`
+	// Mocks are inline mock scenarios shared by all the cases. They are tried
+	// before the ones in MockFile.
+	Mocks []actionstore.ActionMockScenario `json:"mocks,omitempty"`
+	Cases []Case                           `json:"cases"`
+
+	// UpdateGolden makes cases rewrite their golden files instead of
+	// comparing against them.
+	UpdateGolden bool `json:"-"`
+
+	path         string
+	playbookData []byte
+	sharedMocks  []actionstore.ActionMockScenario
+}
+
+// Case is a single run of the playbook with its own alert data and the
+// expectations on the outcome.
+type Case struct {
+	Name string `json:"name"`
+	// Alert is the alert payload. Its fields override the ones in AlertFile.
+	Alert     map[string]interface{} `json:"alert,omitempty"`
+	AlertFile string                 `json:"alertFile,omitempty"`
+	// Mocks override the shared mocks. Scenarios listed here are tried before
+	// the shared scenarios of the same action.
+	Mocks  []actionstore.ActionMockScenario `json:"mocks,omitempty"`
+	Expect Expectations                     `json:"expect"`
+	// Golden is a file holding the expected snapshot of the result tree
+	Golden string `json:"golden,omitempty"`
+}
+
+// Expectations lists what a case asserts on. Only the entries present are
+// checked.
+type Expectations struct {
+	// Nodes maps a node id to its expected state, eg. Done, Failed, Not-Yet-Started
+	Nodes map[string]string `json:"nodes,omitempty"`
+	// Branches maps the id of an if node to the value its condition evaluated to
+	Branches map[string]bool `json:"branches,omitempty"`
+	// Results maps an action node id to the expected values of its result fields
+	Results map[string]map[string]string `json:"results,omitempty"`
+	// Exports maps an exported var name to its expected value
+	Exports map[string]string `json:"exports,omitempty"`
+	// Errors maps a node id to a substring expected in the error of that node
+	Errors map[string]string `json:"errors,omitempty"`
+	// Error is a substring expected in the error that stopped the execution.
+	// Set it to "none" to assert that the execution finished without error.
+	Error string `json:"error,omitempty"`
+}
+
+// LoadSuite reads a suite file along with the playbook and mocks it refers to.
+func LoadSuite(path string) (*Suite, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading suite %s: %s", path, err.Error())
+	}
+	s, err := ParseSuite(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	s.path = path
+	return s, nil
+}
+
+// ParseSuite parses the yaml representation of a suite. Relative paths in it
+// are resolved against baseDir.
+func ParseSuite(data []byte, baseDir string) (*Suite, error) {
+	s := &Suite{}
+	if err := decodeStrict(data, s); err != nil {
+		return nil, fmt.Errorf("error in parsing suite: %s", err.Error())
+	}
+	if s.Playbook == "" {
+		return nil, fmt.Errorf("suite does not name a playbook")
+	}
+
+	var err error
+	s.Playbook = resolvePath(baseDir, s.Playbook)
+	if s.playbookData, err = ioutil.ReadFile(s.Playbook); err != nil {
+		return nil, fmt.Errorf("error reading playbook: %s", err.Error())
+	}
+	if s.MockFile != "" {
+		s.MockFile = resolvePath(baseDir, s.MockFile)
+	}
+	if s.sharedMocks, err = loadMocks(s.MockFile, s.Mocks); err != nil {
+		return nil, err
+	}
+
+	for i := range s.Cases {
+		c := &s.Cases[i]
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("case-%d", i+1)
+		}
+		if c.AlertFile != "" {
+			c.AlertFile = resolvePath(baseDir, c.AlertFile)
+		}
+		if c.Golden != "" {
+			c.Golden = resolvePath(baseDir, c.Golden)
+		}
+	}
+	if s.Name == "" {
+		s.Name = filepath.Base(s.Playbook)
+	}
+	return s, nil
+}
+
+// Path returns the file the suite was loaded from, if any.
+func (s *Suite) Path() string {
+	return s.path
+}
+
+// decodeStrict decodes yaml into v, failing on fields that v does not have.
+func decodeStrict(data []byte, v interface{}) error {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// loadMocks returns the inline mocks followed by the ones in mockFile.
+func loadMocks(mockFile string, inline []actionstore.ActionMockScenario) ([]actionstore.ActionMockScenario, error) {
+	mocks := append([]actionstore.ActionMockScenario{}, inline...)
+	if mockFile == "" {
+		return mocks, nil
+	}
+	fromFile, err := actionstore.LoadMockScenarios(mockFile)
+	if err != nil {
+		return nil, err
+	}
+	return append(mocks, fromFile...), nil
+}
+
+func resolvePath(baseDir string, path string) string {
+	if filepath.IsAbs(path) || baseDir == "" {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
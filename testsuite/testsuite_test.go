@@ -0,0 +1,111 @@
+package testsuite
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"rptsec.com/amg/execution"
+)
+
+func TestSampleSuite(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := LoadSuite("../resources/sample-playbook-test.yaml")
+	assert.Nil(err)
+	assert.Equal(3, len(s.Cases))
+
+	r := s.Run()
+	for _, c := range r.Cases {
+		assert.Nil(c.Err, c.Name)
+		assert.Empty(c.Failures, c.Name)
+	}
+	assert.True(r.Passed())
+}
+
+func TestFailedExpectations(t *testing.T) {
+	assert := assert.New(t)
+
+	suiteYaml := `
+playbook: sample-playbook.yaml
+mockFile: sample-mock-scenario.json
+cases:
+  - name: wrong expectations
+    alert: {srcIp: 192.168.0.1, dstIp: 192.168.0.2}
+    expect:
+      nodes: {ac1: Failed, unknown: Done}
+      branches: {if3: false}
+      results: {ac2: {reputationScore: "50"}}
+      exports: {score: "50"}
+      error: ac1
+`
+	s, err := ParseSuite([]byte(suiteYaml), "../resources")
+	assert.Nil(err)
+
+	r := s.Run()
+	assert.False(r.Passed())
+	assert.Equal([]Failure{
+		{What: "nodes.ac1", Expected: "Failed", Actual: "Done"},
+		{What: "nodes.unknown", Expected: "Done", Actual: missing},
+		{What: "branches.if3", Expected: "false", Actual: "true"},
+		{What: "results.ac2.reputationScore", Expected: "50", Actual: "52"},
+		{What: "exports.score", Expected: "50", Actual: missing},
+		{What: "error", Expected: "ac1", Actual: "none"},
+	}, r.Cases[0].Failures)
+}
+
+func TestParseSuiteRejectsUnknownFields(t *testing.T) {
+	_, err := ParseSuite([]byte("playbook: sample-playbook.yaml\ncasez: []\n"), "../resources")
+	assert.NotNil(t, err)
+}
+
+func TestCoverage(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := LoadSuite("../resources/sample-playbook-test.yaml")
+	assert.Nil(err)
+	full := s.Run()
+	assert.Equal(CoverageSummary{
+		Playbook: s.Playbook, ActionNodes: 6, ActionNodesExecuted: 6, Branches: 2, BranchesTaken: 2,
+	}, full.Coverage.Summary())
+
+	s.Cases = s.Cases[:1]
+	partial := s.Run()
+	summary := partial.Coverage.Summary()
+	assert.Equal(5, summary.ActionNodesExecuted)
+	assert.Equal(1, summary.BranchesTaken)
+	assert.Equal(50.0, summary.BranchPercent())
+	assert.Equal([]string{
+		"branch onFalse of if3 not taken",
+		"node ifNoAc1 not executed",
+	}, partial.Coverage.Uncovered())
+
+	annotated := IndexNodes(partial.Coverage.Annotated())
+	assert.Equal(CoverageExecuted, annotated["ac1"].Coverage)
+	assert.Equal(CoverageNotExecuted, annotated["ifNoAc1"].Coverage)
+	assert.Equal([]string{"onFalse"}, annotated["if3"].UntakenBranches)
+
+	merged := MergeCoverage([]*SuiteResult{partial, full})
+	assert.Equal(1, len(merged))
+	assert.Equal(100.0, merged[0].Summary().BranchPercent())
+}
+
+func TestCoverageCountsOnlyFinishedActions(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes := []execution.N{
+		{ID: "done", NodeType: "execute"},
+		{ID: "failed", NodeType: "execute"},
+		{ID: "waiting", NodeType: "execute"},
+		{ID: "notStarted", NodeType: "execute"},
+	}
+	c := NewCoverage("playbook", nodes)
+	c.Add([]execution.N{
+		{ID: "done", NodeType: "execute", State: execution.StateDone},
+		{ID: "failed", NodeType: "execute", State: execution.StateFailed},
+		{ID: "waiting", NodeType: "execute", State: execution.StateWaitingVarResolution},
+		{ID: "notStarted", NodeType: "execute", State: execution.StateNotYetStarted},
+	})
+	assert.Equal(2, c.Summary().ActionNodesExecuted)
+	assert.Equal([]string{"node waiting not executed", "node notStarted not executed"}, c.Uncovered())
+}
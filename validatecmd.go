@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"rptsec.com/amg/execution"
+)
+
+// validationResult lists the problems found in a playbook.
+type validationResult struct {
+	Playbook string              `json:"playbook"`
+	Problems []execution.Problem `json:"problems"`
+}
+
+// runValidate implements `amg validate <playbook>...`, which checks playbooks
+// for errors without executing them.
+func runValidate(args []string) int {
+	fs := newFlagSet("validate", "[flags] <playbook>...")
+	out := addOutputFlags(fs, "text", "text|json|yaml")
+	parseArgs(fs, args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	exitCode := exitOK
+	var results []validationResult
+	for _, path := range fs.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s, Err: %s\n", path, err.Error())
+			exitCode = exitInvalidPlaybook
+			continue
+		}
+		problems := execution.Validate(data)
+		if len(problems) > 0 {
+			exitCode = exitInvalidPlaybook
+		} else {
+			problems = []execution.Problem{}
+		}
+		results = append(results, validationResult{Playbook: path, Problems: problems})
+	}
+
+	w := out.stdout()
+	if *out.format == "text" {
+		for _, r := range results {
+			if len(r.Problems) == 0 {
+				fmt.Fprintf(w, "%s: ok\n", r.Playbook)
+			}
+			for _, p := range r.Problems {
+				fmt.Fprintf(w, "%s: %s\n", r.Playbook, p.String())
+			}
+		}
+		return exitCode
+	}
+	d, err := out.marshal(results)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	w.Write(d)
+	return exitCode
+}